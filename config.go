@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// configNames lists the config files looked for, in order, in the directory
+// of the spec and then in each of its parents.
+var configNames = []string{"nex.toml", ".nexrc"}
+
+// configKeys maps the keys allowed in a config file to the flags they set.
+var configKeys = map[string]string{
+	"prefix":             "p",
+	"output-dir":         "o",
+	"standalone":         "s",
+	"main":               "main",
+	"custom-error":       "e",
+	"strict":             "strict",
+	"warnings-as-errors": "werror",
+	"json":               "json",
+	"quiet":              "q",
+	"shard":              "shard",
+	"lazy":               "lazy",
+	"bol":                "bol",
+	"nonewline":          "nonewline",
+	"caseless":           "i",
+	"interactive":        "interactive",
+	"fast":               "fast",
+	"pool":               "pool",
+	"split":              "split",
+	"incremental":        "incremental",
+	"parallel":           "parallel",
+	"semantic":           "semantic",
+	"participle":         "participle",
+	"invalid-utf8":       "invalid-utf8",
+	"bom":                "bom",
+	"crlf":               "crlf",
+	"bufsize":            "bufsize",
+	"backend":            "backend",
+	"templates":          "templates",
+	"yacc":               "yacc",
+	"gentest":            "gentest",
+	"genfuzz":            "genfuzz",
+	"genbench":           "genbench",
+}
+
+// findConfig returns the path of the config file that applies to specs in
+// dir, or "" if there is none.
+func findConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		for _, name := range configNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadConfig sets the flags named in the config file `path` that were not
+// given on the command line. The file holds one `key = value` pair per line,
+// where the value is a quoted string, a number, true or false. Lines starting
+// with '#' are comments.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	lineno := 0
+	in := bufio.NewScanner(f)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		configErr := func(msg string) error {
+			return &nex.Error{File: path, Line: lineno, Col: 1, Code: "config", Err: errors.New(msg)}
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return configErr("expected key = value")
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		name, ok := configKeys[key]
+		if !ok {
+			return configErr(fmt.Sprintf("unknown key %q", key))
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return configErr(fmt.Sprintf("bad string for %s", key))
+			}
+			rest := strings.TrimSpace(value[len(quoted):])
+			if rest != "" && rest[0] != '#' {
+				return configErr(fmt.Sprintf("unexpected %q after string", rest))
+			}
+			value, _ = strconv.Unquote(quoted)
+		} else if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		if explicit[name] {
+			continue
+		}
+		if name == "o" || name == "templates" || name == "yacc" {
+			// Relative paths are relative to the config file.
+			if value != "" && !filepath.IsAbs(value) {
+				value = filepath.Join(filepath.Dir(path), value)
+			}
+		}
+		if name == "o" {
+			outPathIsDir = true
+		}
+		if err := flag.Set(name, value); err != nil {
+			return configErr(fmt.Sprintf("bad value for %s: %v", key, err))
+		}
+	}
+	return in.Err()
+}
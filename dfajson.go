@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// dfajsonFile is set by the -dfajson flag.
+var dfajsonFile string
+
+// A specDump holds the DFAs of a spec for -dfajson.
+type specDump struct {
+	File  string         `json:"file"`
+	Rules []nex.RuleDump `json:"rules"` // The top-level family.
+}
+
+// dfaDumps holds the dumps of the specs processed since the last call to
+// writeDFAJSON.
+var dfaDumps []specDump
+
+// writeDFAJSON writes the collected dumps to filename, then resets them.
+func writeDFAJSON(filename string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dfaDumps); err != nil {
+		return err
+	}
+	dfaDumps = nil
+	return ioutil.WriteFile(filename, buf.Bytes(), 0666)
+}
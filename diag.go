@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// inFilename names the spec being processed in diagnostics.
+var inFilename = "<stdin>"
+
+// jsonDiagnostics is set by the -json flag.
+var jsonDiagnostics bool
+
+// A diagnostic is a warning or an error, in the form printed by -json.
+type diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Col      int    `json:"col,omitempty"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// printDiagnostic prints d on standard error, as a line of JSON if -json is
+// given.
+func printDiagnostic(d diagnostic) {
+	if jsonDiagnostics {
+		b, err := json.Marshal(d)
+		dieErr(err, "json")
+		fmt.Fprintln(os.Stderr, string(b))
+		return
+	}
+	switch {
+	case d.Line > 0:
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: ", d.File, d.Line, d.Col)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: ", d.File)
+	}
+	if d.Severity != "error" {
+		fmt.Fprintf(os.Stderr, "%s: ", d.Severity)
+	}
+	fmt.Fprintln(os.Stderr, d.Message)
+}
+
+// quiet is set by the -q flag, which drops the warnings and other messages
+// that are not errors.
+var quiet bool
+
+// warn prints a warning about a spec, unless -q is given.
+func warn(e *nex.Error) {
+	if quiet {
+		return
+	}
+	printDiagnostic(diagnostic{e.File, e.Line, e.Col, "warning", e.Code, e.Err.Error()})
+}
+
+// The exit statuses of nex, telling scripts what kind of failure it met.
+const (
+	exitSpec     = 1 // A spec has errors.
+	exitUsage    = 2 // The flags, arguments or config file are wrong.
+	exitIO       = 3 // A file could not be read or written, or a command failed.
+	exitInternal = 4 // Nex has a bug.
+)
+
+// exitStatus is the status of the worst failure reported so far, 0 if none.
+var exitStatus int
+
+// fail records a failure of the given exit status.
+func fail(status int) {
+	if status > exitStatus {
+		exitStatus = status
+	}
+}
+
+// report prints an error concerning the spec `input`. Errors in the spec
+// itself carry their own position; others are classed as I/O errors, but
+// for the runtime errors and internal errors of bugs.
+func report(input string, err error) {
+	var rerr runtime.Error
+	switch e, ok := err.(*nex.Error); {
+	case errors.Is(err, nex.ErrInternal) || errors.As(err, &rerr):
+		fail(exitInternal)
+	case ok && e.Code == "config":
+		fail(exitUsage)
+	case ok && e.Code != "io":
+		fail(exitSpec)
+	default:
+		fail(exitIO)
+	}
+	if e, ok := err.(*nex.Error); ok {
+		printDiagnostic(diagnostic{e.File, e.Line, e.Col, "error", e.Code, e.Err.Error()})
+		return
+	}
+	if input == "" {
+		input = "<stdin>"
+	}
+	printDiagnostic(diagnostic{input, 0, 0, "error", "io", err.Error()})
+}
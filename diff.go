@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// diffMain implements `nex diff`, which reports the rules whose behaviour
+// differs between two versions of a spec. As with diff, it returns 0 if there
+// are none and 1 if there are some. On trouble it returns the status of the
+// failure, but exitUsage for errors in the specs, which 1 would not tell from
+// changes.
+func diffMain(args []string) int {
+	fs := flag.NewFlagSet("nex diff", flag.ExitOnError)
+	fs.BoolVar(&jsonDiagnostics, "json", false, "print the changes as JSON objects")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: nex diff [-json] old.nex new.nex")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	trouble := func() int {
+		if exitStatus == exitSpec {
+			return exitUsage
+		}
+		return exitStatus
+	}
+	var progs [2]*nex.Program
+	for i, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			report(name, err)
+			return trouble()
+		}
+		progs[i], err = nex.Compile(f, nex.Options{Filename: name})
+		f.Close()
+		if err != nil {
+			report(name, err)
+			return trouble()
+		}
+	}
+	changes, err := nex.Diff(progs[0], progs[1])
+	if err != nil {
+		report("", err)
+		return trouble()
+	}
+	for _, e := range changes {
+		printDiagnostic(diagnostic{e.File, e.Line, e.Col, "change", e.Code, e.Err.Error()})
+	}
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// fromFlexMain implements `nex from-flex`, which translates a flex file to a
+// nex spec, warning of what it cannot translate. It returns the status of the
+// worst failure reported.
+func fromFlexMain(args []string) int {
+	fs := flag.NewFlagSet("nex from-flex", flag.ExitOnError)
+	output := fs.String("o", "", "output file")
+	fs.BoolVar(&quiet, "q", false, "print errors only, not warnings")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		usageExit("nex from-flex: extraneous arguments after ", fs.Arg(0))
+	}
+	filename, in := "<stdin>", io.Reader(os.Stdin)
+	if fs.NArg() == 1 {
+		filename = fs.Arg(0)
+		src, err := ioutil.ReadFile(fs.Arg(0))
+		if err != nil {
+			report(fs.Arg(0), err)
+			return exitStatus
+		}
+		in = strings.NewReader(string(src))
+	}
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			report(*output, err)
+			return exitStatus
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := nex.ConvertFlex(out, in, nex.Options{Filename: filename, Warn: warn}); err != nil {
+		report(fs.Arg(0), err)
+	}
+	return exitStatus
+}
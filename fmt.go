@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// fmtMain implements `nex fmt`, which formats specs like gofmt formats Go
+// code. It returns the status of the worst failure reported.
+func fmtMain(args []string) int {
+	fs := flag.NewFlagSet("nex fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write result to (source) file instead of stdout")
+	diff := fs.Bool("d", false, "display diffs instead of rewriting files")
+	fs.Parse(args)
+	formatFile := func(name string) error {
+		in := os.Stdin
+		inFilename = "<stdin>"
+		if name != "" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in, inFilename = f, name
+		}
+		src, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		res, err := nex.Format(src, inFilename)
+		if err != nil {
+			return err
+		}
+		switch {
+		case *diff:
+			if bytes.Equal(src, res) {
+				return nil
+			}
+			d, err := diffBytes(inFilename, src, res)
+			if err != nil {
+				return err
+			}
+			os.Stdout.Write(d)
+		case *write && name != "":
+			if bytes.Equal(src, res) {
+				return nil
+			}
+			return ioutil.WriteFile(name, res, 0666)
+		default:
+			os.Stdout.Write(res)
+		}
+		return nil
+	}
+	if fs.NArg() == 0 {
+		if err := formatFile(""); err != nil {
+			report("", err)
+		}
+		return exitStatus
+	}
+	inputs, err := expandInputs(fs.Args())
+	dieErr(err, "nex fmt")
+	for _, name := range inputs {
+		if err := formatFile(name); err != nil {
+			report(name, err)
+		}
+	}
+	return exitStatus
+}
+
+// diffBytes returns a unified diff between two versions of a file, using the
+// system's diff command as gofmt does.
+func diffBytes(name string, a, b []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "nexfmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	fa, fb := dir+"/orig", dir+"/new"
+	if err := ioutil.WriteFile(fa, a, 0666); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fb, b, 0666); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("diff", "-u", "--label", name+".orig", "--label", name, fa, fb).Output()
+	if len(out) > 0 {
+		// diff exits with status 1 when the files differ.
+		return out, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("diff: %v", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// genMode is set by the -gen flag, for //go:generate lines: nothing is
+// printed but errors, and outputs already generated from the same spec are
+// left alone.
+var genMode bool
+
+// stamp is the comment line recording the spec an output is generated from
+// in -gen mode, empty otherwise.
+var stamp string
+
+// specStamp returns the stamp of the output generated from the spec src by
+// this version of nex with the flags given, so that a change to any of them
+// shows.
+func specStamp(src []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", nex.Version())
+	flag.Visit(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%s\x00", f.Name, f.Value)
+	})
+	h.Write(src)
+	return "nex -gen sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// upToDate reports whether the file name is stamped with stamp. The stamp
+// follows the generated header, so only the start of the file is read.
+func upToDate(name, stamp string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return bytes.Contains(buf[:n], []byte("\n// "+stamp+"\n"))
+}
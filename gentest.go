@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"strings"
+)
+
+// The golden-test harness. Each testdata/NAME.input is lexed with the
+// generated lexer and the resulting tokens are compared against
+// testdata/NAME.tokens, which holds one `kind "text"` pair per line.
+var testtext = `// Code generated by nex -gentest. DO NOT EDIT.
+
+package %s
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// yyGoldenTokens runs the lexer to completion and returns one line per
+// token: the value returned by Lex followed by the quoted matched text.
+func yyGoldenTokens(in io.Reader) string {
+  var buf bytes.Buffer
+  var lval yySymType
+  yylex := NewLexer(in)
+  for {
+    kind := yylex.Lex(&lval)
+    if kind == 0 {
+      break
+    }
+    fmt.Fprintf(&buf, "%%d %%q\n", kind, yylex.Text())
+  }
+  return buf.String()
+}
+
+func TestLexerGolden(t *testing.T) {
+  inputs, err := filepath.Glob(filepath.Join("testdata", "*.input"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(inputs) == 0 {
+    t.Skip("no testdata/*.input files")
+  }
+  var tests []struct{ name, input, golden string }
+  for _, input := range inputs {
+    name := strings.TrimSuffix(filepath.Base(input), ".input")
+    golden := strings.TrimSuffix(input, ".input") + ".tokens"
+    tests = append(tests, struct{ name, input, golden string }{name, input, golden})
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      want, err := ioutil.ReadFile(tt.golden)
+      if err != nil {
+        t.Fatal(err)
+      }
+      f, err := os.Open(tt.input)
+      if err != nil {
+        t.Fatal(err)
+      }
+      defer f.Close()
+      got := yyGoldenTokens(f)
+      if got == string(want) {
+        return
+      }
+      gotLines := strings.Split(got, "\n")
+      wantLines := strings.Split(string(want), "\n")
+      for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+        var g, w string
+        if i < len(gotLines) {
+          g = gotLines[i]
+        }
+        if i < len(wantLines) {
+          w = wantLines[i]
+        }
+        if g != w {
+          t.Fatalf("%%s:%%d: got %%s, want %%s", tt.golden, i+1, g, w)
+        }
+      }
+    })
+  }
+}
+`
+
+// The fuzz harness feeds arbitrary bytes to the generated lexer. The fuzzing
+// engine catches panics; we also fail on runs that take too long and on
+// token positions that move backwards.
+var fuzztext = `// Code generated by nex -genfuzz. DO NOT EDIT.
+
+package %s
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// yyFuzzTimeout bounds the time spent lexing a single input.
+var yyFuzzTimeout = 10 * time.Second
+
+func FuzzLexer(f *testing.F) {
+  f.Add([]byte(""))
+  f.Add([]byte("\n"))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    done := make(chan string, 1)
+    go func() {
+      var lval yySymType
+      yylex := NewLexer(bytes.NewReader(data))
+      line, column := 0, 0
+      for yylex.Lex(&lval) != 0 {
+        l, c := yylex.Line(), yylex.Column()
+        if l < line || l == line && c < column {
+          done <- "position moved backwards"
+          return
+        }
+        line, column = l, c
+      }
+      done <- ""
+    }()
+    select {
+    case msg := <-done:
+      if msg != "" {
+        t.Fatalf("%%s on %%q", msg, data)
+      }
+    case <-time.After(yyFuzzTimeout):
+      t.Fatalf("lexer did not finish within %%v on %%q", yyFuzzTimeout, data)
+    }
+  })
+}
+`
+
+// The benchmark harness lexes each testdata/*.input file, reporting
+// throughput in bytes and tokens per second.
+var benchtext = `// Code generated by nex -genbench. DO NOT EDIT.
+
+package %s
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func BenchmarkLexer(b *testing.B) {
+  inputs, err := filepath.Glob(filepath.Join("testdata", "*.input"))
+  if err != nil {
+    b.Fatal(err)
+  }
+  if len(inputs) == 0 {
+    b.Skip("no testdata/*.input files")
+  }
+  for _, input := range inputs {
+    data, err := ioutil.ReadFile(input)
+    if err != nil {
+      b.Fatal(err)
+    }
+    b.Run(strings.TrimSuffix(filepath.Base(input), ".input"), func(b *testing.B) {
+      b.SetBytes(int64(len(data)))
+      b.ReportAllocs()
+      tokens := 0
+      for i := 0; i < b.N; i++ {
+        var lval yySymType
+        yylex := NewLexer(bytes.NewReader(data))
+        for yylex.Lex(&lval) != 0 {
+          tokens++
+        }
+      }
+      b.ReportMetric(float64(tokens)/b.Elapsed().Seconds(), "tokens/s")
+    })
+  }
+}
+`
+
+// harnessFilename returns the name of a test file accompanying the generated
+// file `name`, e.g. lc.nn.go with suffix "_test.go" becomes lc.nn_test.go.
+func harnessFilename(name, suffix string) string {
+	return strings.TrimSuffix(name, ".go") + suffix
+}
+
+// writeHarness emits the test harness `text` for the generated file `name`.
+// The package clause is read back from the generated file so the test lives
+// in the same package as the lexer.
+func writeHarness(name, suffix, text string) error {
+	f, err := parser.ParseFile(token.NewFileSet(), name, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return err
+	}
+	src, err := format.Source([]byte(fmt.Sprintf(prefixReplacer.Replace(text), f.Name.Name)))
+	if err != nil {
+		return err
+	}
+	if err := checkOverwrite(harnessFilename(name, suffix)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(harnessFilename(name, suffix), src, 0666)
+}
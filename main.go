@@ -1,18 +1,65 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime/debug"
 	"strings"
+
+	"github.com/blynn/nex/pkg/nex"
 )
 
-var outFilename string
+// outPath is the -o flag: the output file, or with several inputs, the output
+// directory. outFilename is the output file currently being generated.
+var outPath, outFilename string
+
+// outPathIsDir is set when outPath comes from the output-dir key of a config
+// file, and so names a directory even for a single input.
+var outPathIsDir bool
+
+// outRoot is the -outdir flag: the directory under which outputs are written
+// at the paths of their inputs relative to the current directory.
+var outRoot string
 var nfadotFile, dfadotFile string
-var autorun, standalone, customError bool
-var prefix string
+var nfamermaidFile, dfamermaidFile string
+var dfadot, nfadot *os.File
+var dfamermaid, nfamermaid *os.File
+var reportFile, htmlFile, srcmapFile string
+var reportOut, htmlOut, srcmapOut *os.File
+var autorun, keep, standalone, mainProg, customError, genTest, genFuzz, genBench, showVersion, checkOnly bool
+var showStats, strict, werror, noMinimize, lazy, fast, pool, split, semantic, participle, dump, filter, crlf, interactive, incremental, parallel, caseless, bol, nonewline bool
+var prefix, invalidUTF8, bom string
+
+// backend writes the output, as chosen by the -backend flag, and outExt is
+// the extension of the files it writes.
+var backend nex.Backend
+var backendName, outExt string
+
+// templateDir holds *.tmpl files overriding the templates of the lexer.
+var templateDir string
+
+// yaccFile is the goyacc grammar whose tokens the rules may return.
+var yaccFile string
+
+// shardSize is the maximum number of distinct rows of transitions of the
+// outermost DFA written to each table file. Zero means everything goes in
+// the main output file.
+var shardSize, bufSize int
+
+// runArgs holds the command-line arguments passed to the program run by -r.
+var runArgs []string
 
 var prefixReplacer *strings.Replacer
 
@@ -21,70 +68,663 @@ func init() {
 }
 
 func main() {
+	defer func() {
+		if x := recover(); x != nil {
+			fmt.Fprintf(os.Stderr, "nex: internal error: %v\n%s", x, debug.Stack())
+			os.Exit(exitInternal)
+		}
+	}()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			os.Exit(diffMain(os.Args[2:]))
+		case "export-tmgrammar":
+			os.Exit(exportTMGrammarMain(os.Args[2:]))
+		case "fmt":
+			os.Exit(fmtMain(os.Args[2:]))
+		case "from-flex":
+			os.Exit(fromFlexMain(os.Args[2:]))
+		case "repl":
+			os.Exit(replMain(os.Args[2:]))
+		case "test":
+			os.Exit(testMain(os.Args[2:]))
+		case "vet":
+			os.Exit(vetMain(os.Args[2:]))
+		}
+	}
 	flag.StringVar(&prefix, "p", "yy", "name prefix to use in generated code")
-	flag.StringVar(&outFilename, "o", "", `output file`)
+	flag.StringVar(&outPath, "o", "", `output file, or directory when there are several inputs`)
+	flag.StringVar(&outRoot, "outdir", "", `write each output under this directory, at the path of its input relative to the current one`)
 	flag.BoolVar(&standalone, "s", false, `standalone code; NN_FUN macro substitution, no Lex() method`)
+	flag.BoolVar(&mainProg, "main", false, `with -s, add a main() running the rules on the files named by its arguments, or standard input`)
 	flag.BoolVar(&customError, "e", false, `custom error func; no Error() method`)
-	flag.BoolVar(&autorun, "r", false, `run generated program`)
+	flag.BoolVar(&autorun, "r", false, `run generated program; arguments after -- are passed to it`)
+	flag.BoolVar(&keep, "keep", false, `with -r, keep the directory holding the generated program and print its path`)
+	flag.BoolVar(&genTest, "gentest", false, `also write a golden-test harness to NAME.nn_test.go`)
+	flag.BoolVar(&genFuzz, "genfuzz", false, `also write a fuzz harness to NAME.nn_fuzz_test.go`)
+	flag.BoolVar(&genBench, "genbench", false, `also write benchmarks to NAME.nn_bench_test.go`)
+	flag.StringVar(&backendName, "backend", "go", "backend writing the output: "+strings.Join(nex.Backends(), ", "))
+	flag.StringVar(&templateDir, "templates", "", `directory of *.tmpl files overriding the templates of the generated lexer`)
+	flag.StringVar(&yaccFile, "yacc", "", `goyacc grammar whose tokens the rules return; returning others is an error`)
+	flag.IntVar(&shardSize, "shard", 0, `split DFA tables into NAME_tables_N.go files of at most this many rows`)
 	flag.StringVar(&nfadotFile, "nfadot", "", `show NFA graph in DOT format`)
-	flag.StringVar(&dfadotFile, "dfadot", "", `show DFA graph in DOT format`)
+	flag.StringVar(&dfadotFile, "dfadot", "", `show DFA graphs in DOT format, for each rule and each family`)
+	flag.StringVar(&nfamermaidFile, "nfamermaid", "", `show NFA graph as a Mermaid state diagram`)
+	flag.StringVar(&dfamermaidFile, "dfamermaid", "", `show DFA graph as a Mermaid state diagram`)
+	flag.StringVar(&dfajsonFile, "dfajson", "", `write the DFAs of every rule as JSON`)
+	flag.BoolVar(&showStats, "stats", false, `print the automaton sizes of each rule on standard error`)
+	flag.StringVar(&reportFile, "report", "", `write a summary of the families and largest rules to this file`)
+	flag.StringVar(&htmlFile, "html", "", `write a page drawing the automata of the rules, with the summary of -report, to this file`)
+	flag.StringVar(&srcmapFile, "srcmap", "", `write the lines of the generated code holding the action of each rule to this file, as JSON`)
+	flag.StringVar(&cpuProfile, "cpuprofile", "", `write a CPU profile of nex to this file, for go tool pprof`)
+	flag.StringVar(&memProfile, "memprofile", "", `write a profile of the memory nex allocates to this file, for go tool pprof`)
+	flag.BoolVar(&strict, "strict", false, `treat rules matching the empty string as errors`)
+	flag.BoolVar(&werror, "werror", false, `treat all warnings as errors, writing no output for specs drawing any`)
+	flag.BoolVar(&noMinimize, "nominimize", false, `keep the DFAs unminimized, for debugging`)
+	flag.BoolVar(&lazy, "lazy", false, `build the DFAs in the lexer as it runs, rather than in nex`)
+	flag.BoolVar(&caseless, "i", false, `match the rules in any case, as %option caseless does`)
+	flag.BoolVar(&nonewline, "nonewline", false, `make negated classes match no newline, as %option nonewline does`)
+	flag.BoolVar(&bol, "bol", false, `make ^ match at the start of every line rather than only of the input, as %option bol does`)
+	flag.BoolVar(&interactive, "interactive", false, `end each match without reading past it when no longer match can follow, as %option interactive does`)
+	flag.StringVar(&invalidUTF8, "invalid-utf8", "", `what the lexer does with invalid UTF-8: replace, error, or rule (the default if the spec has a %invalid action)`)
+	flag.IntVar(&bufSize, "bufsize", 0, `size in bytes of the buffer NewLexer reads its input through (default 4096)`)
+	flag.StringVar(&bom, "bom", "", `skip a byte order mark starting the input: utf8, or utf16 to also read UTF-16 input`)
+	flag.BoolVar(&crlf, "crlf", false, `read the line breaks \r\n of the input as \n`)
+	flag.BoolVar(&pool, "pool", false, `add GetLexer and PutLexer, reusing lexers through a sync.Pool`)
+	flag.BoolVar(&semantic, "semantic", false, `add SemanticTokens, returning the LSP semantic tokens of the rules given a /*semantic:type*/ comment`)
+	flag.BoolVar(&participle, "participle", false, `add ParticipleLexer, returning a participle lexer.Definition whose tokens are given by /*participle:Type*/ comments`)
+	flag.BoolVar(&split, "split", false, `add Split, returning a bufio.SplitFunc splitting input into the matches of the rules`)
+	flag.BoolVar(&incremental, "incremental", false, `add Tokens and Relex, lexing a string and relexing only the tokens an edit of it changes`)
+	flag.BoolVar(&parallel, "parallel", false, `add ParallelTokens, lexing a string in chunks on concurrent goroutines`)
+	flag.BoolVar(&dump, "dump", false, `write a program printing the matches of the rules in its input as JSON lines, rather than a lexer`)
+	flag.BoolVar(&filter, "filter", false, `write a program copying its input with each match replaced by the string its action returns`)
+	flag.BoolVar(&fast, "fast", false, `write full transition tables rather than compressed ones: faster lexers, larger output`)
+	flag.BoolVar(&jsonDiagnostics, "json", false, `print warnings and errors as JSON objects`)
+	flag.BoolVar(&quiet, "q", false, `print errors only, not warnings and other messages`)
+	flag.BoolVar(&watch, "watch", false, `regenerate (or with -r, rerun) whenever an input changes`)
+	flag.BoolVar(&force, "f", false, `overwrite Go files even if nex did not generate them`)
+	flag.BoolVar(&checkOnly, "check", false, `check the specs without writing any output`)
+	flag.BoolVar(&genMode, "gen", false, `for //go:generate: print only errors, and skip specs unchanged since their output was generated`)
+	flag.BoolVar(&showVersion, "version", false, `print version and build information, then exit`)
 	flag.Parse()
 
+	if showVersion {
+		printVersion(os.Stdout)
+		return
+	}
+
+	// Defaults may come from a config file found from the directory of the
+	// first spec upwards. It applies to all the specs, as the flags do.
+	dir := "."
+	if flag.NArg() > 0 && flag.Arg(0) != "--" {
+		dir = filepath.Dir(flag.Arg(0))
+	}
+	config, err := findConfig(dir)
+	dieErr(err, "nex")
+	if config != "" {
+		if err := loadConfig(config); err != nil {
+			report(config, err)
+			os.Exit(exitStatus)
+		}
+	}
+
 	if len(prefix) > 0 {
 		prefixReplacer = strings.NewReplacer("yy", prefix)
 	}
 
 	nfadot = createDotFile(nfadotFile)
 	dfadot = createDotFile(dfadotFile)
+	nfamermaid = createMermaidFile(nfamermaidFile)
+	dfamermaid = createMermaidFile(dfamermaidFile)
+	reportOut = createDotFile(reportFile)
+	htmlOut = createDotFile(htmlFile)
+	srcmapOut = createDotFile(srcmapFile)
 	defer func() {
-		if nfadot != nil {
-			dieErr(nfadot.Close(), "Close")
+		for _, f := range []*os.File{nfadot, dfadot, nfamermaid, dfamermaid, reportOut, htmlOut, srcmapOut} {
+			if f != nil {
+				dieErr(f.Close(), "Close")
+			}
+		}
+	}()
+	backend = nex.LookupBackend(backendName)
+	dieIf(backend == nil, "nex: unknown backend "+backendName+"; choose from "+strings.Join(nex.Backends(), ", "))
+	outExt = ".nn" + backend.Ext()
+	harness := genTest || genFuzz || genBench
+	dieIf(backendName != "go" && (harness || autorun || shardSize > 0), "nex: -gentest, -genfuzz, -genbench, -shard and -r need the go backend")
+	dieIf(harness && autorun, "nex: -gentest, -genfuzz and -genbench cannot be used with -r")
+	dieIf(harness && standalone, "nex: -gentest, -genfuzz and -genbench need the Lex() method; drop -s")
+	dieIf(shardSize > 0 && autorun, "nex: -shard cannot be used with -r")
+	dieIf(lazy && (backendName != "go" || shardSize > 0 || dfadotFile != "" || dfamermaidFile != "" || dfajsonFile != ""),
+		"nex: -lazy cannot be used with other backends, -shard, -dfadot, -dfamermaid or -dfajson")
+	dieIf(invalidUTF8 != "" && invalidUTF8 != "replace" && invalidUTF8 != "error" && invalidUTF8 != "rule",
+		"nex: unknown -invalid-utf8 policy "+invalidUTF8+"; choose from replace, error, rule")
+	dieIf(bom != "" && bom != "utf8" && bom != "utf16", "nex: unknown -bom "+bom+"; choose from utf8, utf16")
+	dieIf(keep && !autorun, "nex: -keep needs -r")
+	dieIf(mainProg && (!standalone || filter || dump), "nex: -main needs -s, and cannot be used with -filter or -dump")
+	dieIf(srcmapFile != "" && backendName != "go", "nex: -srcmap needs the go backend")
+	dieIf(outRoot != "" && (outPath != "" && !outPathIsDir || autorun), "nex: -outdir cannot be used with -o or -r")
+	dieIf(genMode && (backendName != "go" || autorun || checkOnly || watch), "nex: -gen cannot be used with other backends, -r, -check or -watch")
+	quiet = quiet || genMode
+	dieIf(dump && (backendName != "go" || harness || shardSize > 0 || participle), "nex: -dump cannot be used with other backends, -gentest, -genfuzz, -genbench, -shard or -participle")
+	dieIf(filter && (backendName != "go" || harness || standalone || dump), "nex: -filter cannot be used with other backends, -gentest, -genfuzz, -genbench, -s or -dump")
+	args := flag.Args()
+	if autorun {
+		// Arguments after "--" are for the generated program.
+		for i, arg := range args {
+			if arg == "--" {
+				args, runArgs = args[:i], args[i+1:]
+				break
+			}
 		}
-		if dfadot != nil {
-			dieErr(dfadot.Close(), "Close")
+	}
+	var inputs []string
+	if len(args) > 0 {
+		var err error
+		inputs, err = expandInputs(args)
+		dieErr(err, "nex")
+	}
+	// "-" names standard input, which must then be the only input.
+	if len(inputs) == 1 && inputs[0] == "-" {
+		inputs = nil
+	}
+	for _, input := range inputs {
+		dieIf(input == "-", "nex: - (standard input) must be the only input")
+		// Say so if a later spec has a config file of its own.
+		if other, err := findConfig(filepath.Dir(input)); err == nil && other != config && !quiet {
+			msg := "config file " + other + " ignored, as the options of all the specs come from the first's"
+			if config != "" {
+				msg = "config file " + other + " ignored, as the options of all the specs come from " + config
+			}
+			printDiagnostic(diagnostic{input, 0, 0, "warning", "config", msg})
+		}
+	}
+	// Each mode handles a list of inputs, reporting errors as it goes, and
+	// returns false if there were any.
+	var run func(inputs []string) bool
+	switch {
+	case checkOnly:
+		run = func(inputs []string) bool {
+			if len(inputs) == 0 {
+				inputs = []string{""}
+			}
+			ok := true
+			for _, input := range inputs {
+				if err := checkFile(input); err != nil {
+					report(input, err)
+					ok = false
+				}
+			}
+			return ok
+		}
+	case autorun || len(inputs) == 0:
+		if len(inputs) > 1 {
+			usageExit("nex: extraneous arguments after " + inputs[0] + "; use -- to pass arguments to the program")
+		}
+		input := ""
+		if len(inputs) > 0 {
+			input = inputs[0]
+		}
+		run = func([]string) bool {
+			outFilename = outPath
+			if err := runSingle(input); err != nil {
+				report(input, err)
+				return false
+			}
+			return true
+		}
+	default:
+		outDir := ""
+		if fi, err := os.Stat(outPath); err == nil && fi.IsDir() {
+			outDir = outPath
+		} else if (len(inputs) > 1 || outPathIsDir) && outPath != "" && outRoot == "" {
+			dieErr(os.MkdirAll(outPath, 0777), "nex")
+			outDir = outPath
+		}
+		run = func(inputs []string) bool {
+			ok := true
+			for _, input := range inputs {
+				if err := generateFile(input, outDir); err != nil {
+					report(input, err)
+					ok = false
+				}
+			}
+			return ok
+		}
+	}
+	if dfajsonFile != "" {
+		generate := run
+		run = func(inputs []string) bool {
+			ok := generate(inputs)
+			dieErr(writeDFAJSON(dfajsonFile), "nex")
+			return ok
+		}
+	}
+	run = profiled(run)
+	if watch {
+		dieIf(len(inputs) == 0, "nex: -watch needs input files")
+		watchInputs(inputs, func(changed []string) {
+			if run(changed) && !autorun && !quiet {
+				fmt.Fprintf(os.Stderr, "nex: regenerated from %s\n", strings.Join(changed, " "))
+			}
+		})
+	}
+	if !run(inputs) {
+		os.Exit(exitStatus)
+	}
+}
+
+// expandInputs expands any glob patterns among the input arguments, so
+// patterns work even when the shell has not expanded them.
+func expandInputs(args []string) ([]string, error) {
+	var inputs []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				inputs = append(inputs, m)
+			}
+		}
+	}
+	return inputs, nil
+}
+
+// generateFile writes the lexer for the spec `input`. The output goes under
+// the -outdir directory if any, in outDir if it is non-empty, and otherwise
+// beside the input, unless the -o flag names the output file of a single
+// input.
+func generateFile(input, outDir string) error {
+	if strings.HasSuffix(input, ".go") {
+		return errors.New("input filename ends with .go")
+	}
+	basename := input
+	n := strings.LastIndex(basename, ".")
+	if n >= 0 {
+		basename = basename[:n]
+	}
+	switch {
+	case outRoot != "":
+		rel, err := relPath(basename)
+		if err != nil {
+			return err
+		}
+		outFilename = filepath.Join(outRoot, rel+outExt)
+		if err := os.MkdirAll(filepath.Dir(outFilename), 0777); err != nil {
+			return err
+		}
+	case outDir != "":
+		outFilename = filepath.Join(outDir, filepath.Base(basename)+outExt)
+	case outPath != "":
+		outFilename = outPath
+	default:
+		outFilename = basename + outExt
+	}
+	infile, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
+	inFilename = input
+	if !genMode {
+		return writeOutput(infile)
+	}
+	src, err := ioutil.ReadAll(infile)
+	if err != nil {
+		return err
+	}
+	if stamp = specStamp(src); upToDate(outFilename, stamp) {
+		return nil
+	}
+	return writeOutput(bytes.NewReader(src))
+}
+
+// writeOutput writes the lexer for the spec read from infile to outFilename,
+// along with the harnesses asked for.
+func writeOutput(infile io.Reader) (err error) {
+	if err := checkOverwrite(outFilename); err != nil {
+		return err
+	}
+	outfile, err := os.Create(outFilename)
+	if err != nil {
+		return err
+	}
+	// Don't leave a truncated output file behind.
+	defer func() {
+		outfile.Close()
+		if err != nil {
+			os.Remove(outFilename)
 		}
 	}()
+	if err := process(outfile, infile); err != nil {
+		return err
+	}
+	if genTest {
+		if err := writeHarness(outFilename, "_test.go", testtext); err != nil {
+			return err
+		}
+	}
+	if genFuzz {
+		if err := writeHarness(outFilename, "_fuzz_test.go", fuzztext); err != nil {
+			return err
+		}
+	}
+	if genBench {
+		if err := writeHarness(outFilename, "_bench_test.go", benchtext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// force is set by the -f flag, which lets nex overwrite Go files it did not
+// generate.
+var force bool
+
+// checkOverwrite returns an error if the Go file name exists but lacks the
+// header nex marks its output with, having perhaps been written by hand,
+// unless -f is given.
+func checkOverwrite(name string) error {
+	if force || !strings.HasSuffix(name, ".go") {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	if bytes.Contains(buf[:n], []byte("// Code generated by nex")) {
+		return nil
+	}
+	return fmt.Errorf("%s was not generated by nex; use -f to overwrite it", name)
+}
+
+// relPath returns path relative to the current directory, for -outdir to
+// mirror. Paths outside it have no place under -outdir.
+func relPath(path string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("-outdir needs inputs inside the current directory")
+	}
+	return rel, nil
+}
+
+// checkFile runs the spec `input`, or standard input if it is empty, through
+// the whole pipeline, then checks that the generated Go code parses. Nothing
+// is written.
+func checkFile(input string) (err error) {
+	infile := os.Stdin
+	inFilename = "<stdin>"
+	if input != "" {
+		if infile, err = os.Open(input); err != nil {
+			return err
+		}
+		defer infile.Close()
+		inFilename = input
+	}
+	outFilename = ""
+	var buf bytes.Buffer
+	if err := process(&buf, infile); err != nil {
+		return err
+	}
+	if backendName != "go" {
+		return nil
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "generated code", buf.Bytes(), parser.AllErrors); err != nil {
+		// The Go code in the spec is at fault, not the reading of it.
+		return &nex.Error{File: inFilename, Code: "syntax", Err: err}
+	}
+	return nil
+}
+
+// runSingle handles standard input, which is written to the file named by -o
+// or else to standard output, and the -r flag, which runs the program
+// generated from a single spec.
+func runSingle(input string) (err error) {
 	infile, outfile := os.Stdin, os.Stdout
-	var err error
-	if flag.NArg() > 0 {
-		dieIf(flag.NArg() > 1, "nex: extraneous arguments after", flag.Arg(0))
-		dieIf(strings.HasSuffix(flag.Arg(0), ".go"), "nex: input filename ends with .go:", flag.Arg(0))
-		basename := flag.Arg(0)
-		n := strings.LastIndex(basename, ".")
-		if n >= 0 {
-			basename = basename[:n]
-		}
-		infile, err = os.Open(flag.Arg(0))
-		dieErr(err, "nex")
+	inFilename = "<stdin>"
+	if input != "" {
+		if strings.HasSuffix(input, ".go") {
+			return errors.New("input filename ends with .go")
+		}
+		if infile, err = os.Open(input); err != nil {
+			return err
+		}
 		defer infile.Close()
-		if !autorun {
-			if outFilename == "" {
-				outFilename = basename + ".nn.go"
-				outfile, err = os.Create(outFilename)
-			} else {
-				outfile, err = os.Create(outFilename)
-			}
-			dieErr(err, "nex")
-			defer outfile.Close()
+		inFilename = input
+	} else if !autorun && outPath != "" && !outPathIsDir {
+		// Standard input has no name to derive the output file from, but -o
+		// names it. A directory from a config file is only for named inputs.
+		if fi, err := os.Stat(outPath); err == nil && fi.IsDir() {
+			return errors.New("-o names a directory; standard input needs an output file name")
 		}
+		return writeOutput(infile)
+	}
+	if genTest || genFuzz || genBench {
+		return errors.New("-gentest, -genfuzz and -genbench need an input file or -o")
 	}
 	if autorun {
 		tmpdir, err := ioutil.TempDir("", "nex")
-		dieIf(err != nil, "tempdir:", err)
-		defer func() {
-			dieErr(os.RemoveAll(tmpdir), "RemoveAll")
-		}()
-		outfile, err = os.Create(tmpdir + "/lets.go")
-		dieErr(err, "nex")
+		if err != nil {
+			return err
+		}
+		if keep {
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "nex: keeping %s\n", tmpdir)
+			}
+		} else {
+			defer os.RemoveAll(tmpdir)
+		}
+		if outfile, err = os.Create(tmpdir + "/lets.go"); err != nil {
+			return err
+		}
 		defer outfile.Close()
 	}
-	err = process(outfile, infile)
-	if err != nil {
-		log.Fatal(err)
+	if err := process(outfile, infile); err != nil {
+		return err
 	}
 	if autorun {
-		c := exec.Command("go", "run", outfile.Name())
+		c := exec.Command("go", append([]string{"run", outfile.Name()}, runArgs...)...)
 		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
-		dieErr(c.Run(), "go run")
+		if err := c.Run(); err != nil {
+			if !keep {
+				return fmt.Errorf("go run %s: %v (use -keep to inspect it)", outfile.Name(), err)
+			}
+			return fmt.Errorf("go run %s: %v", outfile.Name(), err)
+		}
+	}
+	return nil
+}
+
+// writer converts f to an io.Writer, keeping nil files nil.
+func writer(f *os.File) io.Writer {
+	if f == nil {
+		return nil
+	}
+	return f
+}
+
+// process compiles the spec read from input according to the flags, and
+// writes the output of the backend to output. A Go lexer is gofmt'ed when it
+// is written to outFilename.
+func process(output io.Writer, input io.Reader) error {
+	opts := nex.Options{
+		Filename:    inFilename,
+		Prefix:      prefix,
+		Standalone:  standalone,
+		Main:        mainProg,
+		CustomError: customError,
+		Strict:      strict,
+		NoMinimize:  noMinimize,
+		Lazy:        lazy,
+		Caseless:    caseless,
+		Interactive: interactive,
+		BOL:         bol,
+		NoNewline:   nonewline,
+		Fast:        fast,
+		Pool:        pool,
+		Split:       split,
+		Incremental: incremental,
+		Parallel:    parallel,
+		Semantic:    semantic,
+		Participle:  participle,
+		Dump:        dump,
+		Filter:      filter,
+		InvalidUTF8: invalidUTF8,
+		BOM:         bom,
+		CRLF:        crlf,
+		BufferSize:  bufSize,
+		Warn:        warn,
+		Stamp:       stamp,
+		NFADot:      writer(nfadot),
+		DFADot:      writer(dfadot),
+		NFAMermaid:  writer(nfamermaid),
+		DFAMermaid:  writer(dfamermaid),
+		Report:      writer(reportOut),
+		HTML:        writer(htmlOut),
+		SourceMap:   srcmapOut != nil,
+	}
+	if showStats {
+		opts.Stats = os.Stderr
+	}
+	if templateDir != "" {
+		opts.Templates = os.DirFS(templateDir)
+	}
+	if yaccFile != "" {
+		f, err := os.Open(yaccFile)
+		if err != nil {
+			return err
+		}
+		opts.Tokens, err = nex.ParseTokens(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", yaccFile, err)
+		}
+		if opts.Tokens == nil {
+			opts.Tokens = []string{}
+		}
+	}
+	if shardSize > 0 && outFilename != "" {
+		opts.ShardSize = shardSize
+		opts.WriteShard = func(n int, src []byte) error {
+			name := shardFilename(outFilename, n)
+			if err := checkOverwrite(name); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(name, src, 0666)
+		}
+	}
+	// With -werror, the warnings are reported as errors once the spec is
+	// compiled, the last one being returned.
+	var warnings []*nex.Error
+	if werror {
+		opts.Warn = func(e *nex.Error) {
+			warnings = append(warnings, e)
+		}
+	}
+	p, err := nex.Compile(input, opts)
+	if len(warnings) > 0 {
+		if err == nil {
+			err, warnings = warnings[len(warnings)-1], warnings[:len(warnings)-1]
+		}
+		for _, e := range warnings {
+			report(inFilename, e)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if dfajsonFile != "" {
+		dfaDumps = append(dfaDumps, specDump{inFilename, p.DFAs()})
+	}
+	if backendName != "go" || outFilename == "" && srcmapOut == nil {
+		return backend.Write(output, p)
+	}
+	var buf bytes.Buffer
+	if err := p.WriteGo(&buf); err != nil {
+		return err
+	}
+	src := buf.Bytes()
+	if outFilename != "" {
+		if s, err := format.Source(src); err == nil {
+			src = s
+		}
+	}
+	if srcmapOut != nil {
+		// One line for each file generated.
+		b, err := json.Marshal(p.SourceMap(outFilename, src))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(srcmapOut, "%s\n", b); err != nil {
+			return err
+		}
+	}
+	_, err = output.Write(src)
+	return err
+}
+
+// shardFilename returns the name of the n-th table file accompanying the
+// generated file `name`, e.g. lc.nn.go becomes lc.nn_tables_1.go.
+func shardFilename(name string, n int) string {
+	return fmt.Sprintf("%s_tables_%d.go", strings.TrimSuffix(name, ".go"), n)
+}
+
+// dieIf exits if cond holds, the flags or arguments being wrong.
+func dieIf(cond bool, v ...interface{}) {
+	if cond {
+		usageExit(v...)
+	}
+}
+
+// usageExit reports the flags or arguments being wrong, and exits.
+func usageExit(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(exitUsage)
+}
+
+// dieErr exits if err, from reading or writing a file, is not nil.
+func dieErr(err error, s string) {
+	if err != nil {
+		log.Printf("%v: %v", s, err)
+		os.Exit(exitIO)
+	}
+}
+
+func createDotFile(filename string) *os.File {
+	if filename == "" {
+		return nil
+	}
+	suf := strings.HasSuffix(filename, ".nex")
+	dieIf(suf, "nex: graph filename ends with .nex:", filename)
+	file, err := os.Create(filename)
+	dieErr(err, "Create")
+	return file
+}
+
+func createMermaidFile(filename string) *os.File {
+	file := createDotFile(filename)
+	if file != nil {
+		fmt.Fprintln(file, "stateDiagram-v2")
 	}
+	return file
 }
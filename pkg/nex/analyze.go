@@ -0,0 +1,304 @@
+package nex
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+// maxProductStates bounds the product automata explored by the analyses.
+// Past it, we give up rather than risk exhausting memory.
+const maxProductStates = 1 << 16
+
+// step returns the DFA state reached from v on reading r, following the same
+// precedence as the generated code: runes, then ranges, then the wild edge.
+// A nil node is the dead state.
+func step(v *node, r rune) *node {
+	if v == nil {
+		return nil
+	}
+	var dst *node
+	for _, e := range v.e {
+		if e.kind == kRune && e.r == r {
+			dst = e.dst
+			break
+		}
+	}
+	if dst == nil {
+		for _, e := range v.e {
+			if e.kind == kClass && inClass(r, e.lim) {
+				dst = e.dst
+				break
+			}
+		}
+	}
+	if dst == nil {
+		for _, e := range v.e {
+			if e.kind == kWild {
+				dst = e.dst
+				break
+			}
+		}
+	}
+	if dst == nil || dst.n == -1 {
+		return nil
+	}
+	return dst
+}
+
+// stepAnchor returns the DFA state reached from v by its ^ or $ transition,
+// nil being the dead state.
+func stepAnchor(v *node, kind int) *node {
+	if v == nil {
+		return nil
+	}
+	for _, e := range v.e {
+		if e.kind == kind && e.dst.n != -1 {
+			return e.dst
+		}
+	}
+	return nil
+}
+
+// anchored reports whether a DFA has any live ^ or $ transitions.
+func anchored(start *node) bool {
+	found := false
+	walkGraph(start, func(*node) {}, func(u *node, e *edge) {
+		if e.kind == kStart || e.kind == kEnd {
+			found = true
+		}
+	})
+	return found
+}
+
+// alphabetOf returns one representative rune for each interval of runes on
+// which all the given DFAs behave identically.
+func alphabetOf(dfas []*node) []rune {
+	points := map[rune]bool{0: true}
+	for _, start := range dfas {
+		// Edges to the dead state matter too, so we look at them all.
+		walkGraph(start, func(u *node) {
+			for _, e := range u.e {
+				switch e.kind {
+				case kRune:
+					points[e.r] = true
+					points[e.r+1] = true
+				case kClass:
+					for i := 0; i < len(e.lim); i += 2 {
+						points[e.lim[i]] = true
+						points[e.lim[i+1]+1] = true
+					}
+				}
+			}
+		}, func(*node, *edge) {})
+	}
+	var alphabet []rune
+	for r := range points {
+		alphabet = append(alphabet, r)
+	}
+	sort.Sort(runeSlice(alphabet))
+	return alphabet
+}
+
+// covered reports whether every non-empty string accepted by the DFA `b` is
+// also accepted by at least one of the DFAs in `a`. If so, it also returns
+// the indices of the DFAs in `a` that accept such strings. The answer is
+// false when the product automaton grows too large.
+func covered(a []*node, b *node) (bool, []int) {
+	dfas := append(append([]*node(nil), a...), b)
+	alphabet := alphabetOf(dfas)
+	key := func(v []*node) string {
+		buf := make([]byte, 0, 4*len(v))
+		for _, u := range v {
+			n := -1
+			if u != nil {
+				n = u.n
+			}
+			buf = append(buf, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+		}
+		return string(buf)
+	}
+	seen := map[string]bool{key(dfas): true}
+	todo := [][]*node{dfas}
+	culprits := make(map[int]bool)
+	for len(todo) > 0 {
+		v := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for _, r := range alphabet {
+			w := make([]*node, len(v))
+			for i, u := range v {
+				w[i] = step(u, r)
+			}
+			last := w[len(w)-1]
+			if last == nil {
+				continue
+			}
+			k := key(w)
+			if seen[k] {
+				continue
+			}
+			if len(seen) > maxProductStates {
+				return false, nil
+			}
+			seen[k] = true
+			if last.accept {
+				found := false
+				for i, u := range w[:len(w)-1] {
+					if u != nil && u.accept {
+						culprits[i] = true
+						found = true
+					}
+				}
+				if !found {
+					return false, nil
+				}
+			}
+			todo = append(todo, w)
+		}
+	}
+	var res []int
+	for i := range culprits {
+		res = append(res, i)
+	}
+	sort.Ints(res)
+	return true, res
+}
+
+// accepts reports whether a DFA accepts any string of runes up to top. Edges
+// are taken as step takes them, so a negated class covering every rune reads
+// nothing.
+func accepts(start *node, top rune) bool {
+	alphabet := alphabetOf([]*node{start})
+	seen := map[*node]bool{start: true}
+	todo := []*node{start}
+	for len(todo) > 0 {
+		u := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if u.accept {
+			return true
+		}
+		var next []*node
+		for _, r := range alphabet {
+			if r <= top {
+				next = append(next, step(u, r))
+			}
+		}
+		for _, e := range u.e {
+			if e.kind == kStart || e.kind == kEnd {
+				next = append(next, e.dst)
+			}
+		}
+		for _, v := range next {
+			if v != nil && v.n != -1 && !seen[v] {
+				seen[v] = true
+				todo = append(todo, v)
+			}
+		}
+	}
+	return false
+}
+
+// warnShadowed reports the rules of a family, and of its nested families,
+// that can never fire because earlier rules match everything they match, or
+// because they match nothing at all. A rule matching exactly what a single
+// earlier rule matches is reported as a duplicate. Anchored rules are only
+// checked for matching nothing.
+func (g *generator) warnShadowed(family *rule) {
+	top := rune(unicode.MaxRune)
+	if g.opts.ByteMode {
+		top = 0xff
+	}
+	var earlier []*rule
+	for _, x := range family.kid {
+		if !accepts(x.dfa, top) {
+			g.warn(x.line, x.col, "never-matches",
+				fmt.Sprintf("rule /%s/ matches no string", string(x.regex)))
+			continue
+		}
+		if anchored(x.dfa) {
+			continue
+		}
+		if len(earlier) > 0 {
+			var dfas []*node
+			for _, y := range earlier {
+				dfas = append(dfas, y.dfa)
+			}
+			var dup *rule
+			for _, y := range earlier {
+				if Equivalent(&DFA{start: y.dfa}, &DFA{start: x.dfa}) {
+					dup = y
+					break
+				}
+			}
+			ok, culprits := false, []int(nil)
+			if dup == nil {
+				// Blame a single rule if possible.
+				for i, y := range dfas {
+					if ok, _ = covered([]*node{y}, x.dfa); ok {
+						culprits = []int{i}
+						break
+					}
+				}
+				if !ok {
+					ok, culprits = covered(dfas, x.dfa)
+				}
+			}
+			if dup != nil {
+				g.warn(x.line, x.col, "duplicate",
+					fmt.Sprintf("rule /%s/ duplicates /%s/ at line %d", string(x.regex), string(dup.regex), dup.line))
+			} else if ok {
+				by := ""
+				for i, c := range culprits {
+					if i > 0 {
+						by += ", "
+					}
+					by += fmt.Sprintf("/%s/ at line %d", string(earlier[c].regex), earlier[c].line)
+				}
+				g.warn(x.line, x.col, "shadowed",
+					fmt.Sprintf("rule /%s/ is shadowed by %s", string(x.regex), by))
+			}
+		}
+		earlier = append(earlier, x)
+	}
+	for _, x := range family.kid {
+		if len(x.kid) > 0 {
+			g.warnShadowed(x)
+		}
+	}
+}
+
+// checkNullable warns about rules that can match the empty string. Such a
+// match is never reported, so the rule most likely does not mean what its
+// author intended. In strict mode, the first such rule is an error instead.
+func (g *generator) checkNullable(family *rule) error {
+	for _, x := range family.kid {
+		if x.nullable {
+			msg := fmt.Sprintf("rule /%s/ can match the empty string", string(x.regex))
+			if g.opts.Strict {
+				return &Error{g.filename, x.line, x.col, "empty-match", errors.New(msg)}
+			}
+			g.warn(x.line, x.col, "empty-match", msg)
+		}
+		if len(x.kid) > 0 {
+			if err := g.checkNullable(x); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warnLarge reports the rules of a family, and of its nested families, whose
+// DFA has more than MaxStates states.
+func (g *generator) warnLarge(family *rule) {
+	for _, x := range family.kid {
+		if n := len(dfaStates(x.dfa)); n > g.opts.MaxStates {
+			g.warn(x.line, x.col, "large-dfa",
+				fmt.Sprintf("the DFA of rule /%s/ has %d states, more than %d", string(x.regex), n, g.opts.MaxStates))
+		}
+		if len(x.kid) > 0 {
+			g.warnLarge(x)
+		}
+	}
+}
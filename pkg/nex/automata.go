@@ -0,0 +1,408 @@
+package nex
+
+import "sort"
+
+// An NFA is the nondeterministic automaton of a regex, built from its syntax
+// tree by BuildNFA.
+type NFA struct {
+	states   []*node // Reachable states, numbered by index. states[0] is the start.
+	sing     map[rune]bool
+	lim      []rune
+	nullable bool
+}
+
+// A DFA is the deterministic automaton of a regex, built from its NFA by
+// Determinize. It is the automaton the generated lexer runs.
+type DFA struct {
+	start *node
+	n     int // Number of states, not counting the dead state.
+}
+
+// An EdgeKind says what an Edge is taken on.
+type EdgeKind int
+
+const (
+	EdgeEmpty EdgeKind = kNil   // Taken without reading anything. NFAs only.
+	EdgeRune  EdgeKind = kRune  // Taken on Rune.
+	EdgeClass EdgeKind = kClass // Taken on the runes in Ranges, or not in them if Negate is set.
+	EdgeAny   EdgeKind = kWild  // Taken on any rune that no other edge of the state is taken on.
+	EdgeBegin EdgeKind = kStart // Taken at the start of the input.
+	EdgeEnd   EdgeKind = kEnd   // Taken at the end of the input.
+)
+
+// An Edge is a transition of an automaton.
+type Edge struct {
+	Kind   EdgeKind
+	Rune   rune
+	Ranges []rune // Pairs of inclusive limits, sorted and disjoint.
+	Negate bool
+	To     int // The destination state, or -1 for the dead state of a DFA.
+}
+
+// A State is a state of an automaton and its transitions.
+type State struct {
+	Accept bool
+	Edges  []Edge
+}
+
+// describeStates describes the given nodes, which are numbered by index.
+func describeStates(nodes []*node) []State {
+	states := make([]State, len(nodes))
+	for i, v := range nodes {
+		states[i].Accept = v.accept
+		for _, e := range v.e {
+			states[i].Edges = append(states[i].Edges, Edge{
+				Kind:   EdgeKind(e.kind),
+				Rune:   e.r,
+				Ranges: append([]rune(nil), e.lim...),
+				Negate: e.negate,
+				To:     e.dst.n,
+			})
+		}
+	}
+	return states
+}
+
+// States describes the states of the NFA. The start state is the first.
+func (a *NFA) States() []State {
+	return describeStates(a.states)
+}
+
+// Nullable reports whether the NFA accepts the empty string.
+func (a *NFA) Nullable() bool {
+	return a.nullable
+}
+
+// alphabetSize is the number of intervals of runes the DFA of the NFA
+// distinguishes.
+func (a *NFA) alphabetSize() int {
+	return len(a.sing) + len(a.lim)/2 + 1
+}
+
+// States describes the states of the DFA. The start state is the first.
+func (d *DFA) States() []State {
+	return describeStates(dfaStates(d.start))
+}
+
+// Match reports whether the DFA accepts all of s, as the lexer would if s
+// were the whole input.
+func (d *DFA) Match(s string) bool {
+	family := &rule{kid: []*rule{{dfa: d.start}}}
+	buf := []rune(s)
+	_, n := longestMatch(family, runesAt(buf), true)
+	return n == len(buf)
+}
+
+// An nfaBuilder builds an NFA, computing the alphabet of its DFA as it goes.
+//
+// We cannot have our alphabet be all Unicode characters. Instead, we compute
+// an alphabet for each regex:
+//
+//  1. Singles: we add single runes used in the regex: any rune not in a range.
+//     These are held in `sing`.
+//
+//  2. Ranges: entire ranges become elements of the alphabet. If ranges in the
+//     same expression overlap, we break them up into non-overlapping ranges.
+//     The generated code checks singles before ranges, so there's no need to
+//     break up a range if it contains a single. These are gathered in
+//     `lim`, and split up once the NFA is built.
+//
+//  3. Wild: we add an element representing all other runes.
+//
+// e.g. the alphabet of /[0-9]*[Ee][2-5]*/ is sing: { E, e },
+// lim: { [0-1], [2-5], [6-9] } and the wild element.
+type nfaBuilder struct {
+	n    int // Number of nodes created.
+	sing map[rune]bool
+	lim  *intervalSet
+}
+
+func (b *nfaBuilder) newNode() *node {
+	res := new(node)
+	res.n = b.n
+	b.n++
+	return res
+}
+
+func newEdge(u, v *node, kind int) *edge {
+	return addEdge(u, &edge{kind: kind, dst: v})
+}
+
+func newRuneEdge(u, v *node, r rune) *edge {
+	return addEdge(u, &edge{kind: kRune, r: r, dst: v})
+}
+
+// addEdge adds e to the edges of u, which are kept sorted by rune, after
+// those with the same rune. The edges of the DFA states of a large class are
+// added in order, so this is usually an append.
+func addEdge(u *node, e *edge) *edge {
+	i := sort.Search(len(u.e), func(i int) bool { return u.e[i].r > e.r })
+	u.e = append(u.e, nil)
+	copy(u.e[i+1:], u.e[i:])
+	u.e[i] = e
+	return e
+}
+
+// build returns the start and end nodes of the NFA of re. They are the same
+// node if re is empty.
+func (b *nfaBuilder) build(re *Regex) (start, end *node) {
+	switch re.Op {
+	case OpEmpty:
+		end = b.newNode()
+		start = end
+	case OpRune:
+		start, end = b.newNode(), b.newNode()
+		newRuneEdge(start, end, re.Rune)
+		b.sing[re.Rune] = true
+	case OpClass:
+		start, end = b.newNode(), b.newNode()
+		e := newEdge(start, end, kClass)
+		e.negate = re.Negate
+		e.lim = newIntervalSet().add(re.Ranges...).union()
+		for i := 0; i+1 < len(re.Ranges); i += 2 {
+			if l, r := re.Ranges[i], re.Ranges[i+1]; l == r {
+				b.sing[l] = true
+			} else {
+				b.lim.add(l, r)
+			}
+		}
+	case OpAny:
+		start, end = b.newNode(), b.newNode()
+		newEdge(start, end, kWild)
+	case OpBegin:
+		start, end = b.newNode(), b.newNode()
+		newEdge(start, end, kStart)
+	case OpEnd:
+		start, end = b.newNode(), b.newNode()
+		newEdge(start, end, kEnd)
+	case OpStar, OpPlus, OpQuest:
+		start, end = b.build(re.Sub[0])
+		if start == end {
+			return
+		}
+		switch re.Op {
+		case OpStar:
+			newEdge(end, start, kNil)
+			nend := b.newNode()
+			newEdge(end, nend, kNil)
+			start, end = end, nend
+		case OpPlus:
+			newEdge(end, start, kNil)
+			nend := b.newNode()
+			newEdge(end, nend, kNil)
+			end = nend
+		case OpQuest:
+			newEdge(start, end, kNil)
+		}
+	case OpConcat:
+		for _, sub := range re.Sub {
+			nstart, nend := b.build(sub)
+			if start == nil {
+				start, end = nstart, nend
+			} else if nstart != nend {
+				end.e = make([]*edge, len(nstart.e))
+				copy(end.e, nstart.e)
+				end = nend
+			}
+		}
+		if start == nil {
+			end = b.newNode()
+			start = end
+		}
+	case OpAlt:
+		for _, sub := range re.Sub {
+			nstart, nend := b.build(sub)
+			if start == nil {
+				start, end = nstart, nend
+				continue
+			}
+			tmp := b.newNode()
+			newEdge(tmp, start, kNil)
+			newEdge(tmp, nstart, kNil)
+			start = tmp
+			tmp = b.newNode()
+			newEdge(end, tmp, kNil)
+			newEdge(nend, tmp, kNil)
+			end = tmp
+		}
+		if start == nil {
+			end = b.newNode()
+			start = end
+		}
+	default:
+		panic(ErrInternal)
+	}
+	return
+}
+
+// BuildNFA builds the NFA of a regex.
+func BuildNFA(re *Regex) *NFA {
+	b := &nfaBuilder{sing: make(map[rune]bool), lim: newIntervalSet()}
+	start, end := b.build(re)
+	end.accept = true
+	n := b.n
+
+	// Compute shortlist of nodes (reachable nodes), as we may have discarded
+	// nodes left over from parsing. Also, make short[0] the start node.
+	short := make([]*node, 0, n)
+	{
+		mark := make([]bool, n)
+		newn := make([]int, n)
+		visit := func(u *node) {
+			mark[u.n] = true
+			newn[u.n] = len(short)
+			short = append(short, u)
+		}
+		// Number the nodes depth first, keeping on a stack the nodes being
+		// visited and how many of their edges have been followed.
+		type frame struct {
+			u *node
+			i int
+		}
+		visit(start)
+		stack := []frame{{start, 0}}
+		for len(stack) > 0 {
+			f := &stack[len(stack)-1]
+			if f.i == len(f.u.e) {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			v := f.u.e[f.i].dst
+			f.i++
+			if !mark[v.n] {
+				visit(v)
+				stack = append(stack, frame{v, 0})
+			}
+		}
+		for _, v := range short {
+			v.n = newn[v.n]
+		}
+	}
+	a := &NFA{states: short, sing: b.sing, lim: b.lim.pieces()}
+	n = len(short)
+
+	{ // Is the accepting node reachable from the start by nil edges alone?
+		mark := make([]bool, n)
+		todo := []*node{start}
+		mark[start.n] = true
+		for len(todo) > 0 {
+			u := todo[len(todo)-1]
+			todo = todo[:len(todo)-1]
+			a.nullable = a.nullable || u.accept
+			for _, e := range u.e {
+				if e.kind == kNil && !mark[e.dst.n] {
+					mark[e.dst.n] = true
+					todo = append(todo, e.dst)
+				}
+			}
+		}
+	}
+	return a
+}
+
+// Determinize builds the DFA of an NFA by the subset construction.
+func Determinize(a *NFA) *DFA {
+	short := a.states
+	n := len(short)
+	// nilClose adds to st the states reachable from it by nil edges. A state
+	// already in st has had its edges followed, or will have.
+	var stack []int
+	nilClose := func(st bitset) {
+		stack = stack[:0]
+		st.each(func(i int) { stack = append(stack, i) })
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, e := range short[i].e {
+				if e.kind == kNil && !st.has(e.dst.n) {
+					st.add(e.dst.n)
+					stack = append(stack, e.dst.n)
+				}
+			}
+		}
+	}
+	var todo []*node
+	// DFA states are looked up by the bytes of their sets of NFA states.
+	tab := make(map[string]*node)
+	var buf []byte
+	dfacount := 0
+	{ // Construct the node of no return.
+		tmp := new(node)
+		tmp.n = -1
+		tab[string(newBitset(n).appendKey(nil))] = tmp
+	}
+	newDFANode := func(st bitset) (res *node, found bool) {
+		buf = st.appendKey(buf[:0])
+		res, found = tab[string(buf)]
+		if !found {
+			res = new(node)
+			res.n = dfacount
+			dfacount++
+			st.each(func(i int) {
+				res.accept = res.accept || short[i].accept
+				res.set = append(res.set, i)
+			})
+			tab[string(buf)] = res
+		}
+		return res, found
+	}
+
+	get := func(states bitset) *node {
+		nilClose(states)
+		node, old := newDFANode(states)
+		if !old {
+			todo = append(todo, node)
+		}
+		return node
+	}
+	getcb := func(v *node, cb func(*edge) bool) *node {
+		states := newBitset(n)
+		for _, i := range v.set {
+			for _, e := range short[i].e {
+				if cb(e) {
+					states.add(e.dst.n)
+				}
+			}
+		}
+		return get(states)
+	}
+	var runes []rune
+	for r := range a.sing {
+		runes = append(runes, r)
+	}
+	sort.Sort(runeSlice(runes))
+	lim := a.lim
+	states := newBitset(n)
+	// The DFA start state is the state representing the nil-closure of the start
+	// node in the NFA. Recall it has index 0.
+	states.add(0)
+	dfastart := get(states)
+	for len(todo) > 0 {
+		v := todo[len(todo)-1]
+		todo = todo[0 : len(todo)-1]
+		// Singles.
+		for _, r := range runes {
+			newRuneEdge(v, getcb(v, func(e *edge) bool {
+				return e.kind == kRune && e.r == r ||
+					e.kind == kWild ||
+					e.kind == kClass && e.negate != inClass(r, e.lim)
+			}), r)
+		}
+		// Character ranges.
+		for j := 0; j < len(lim); j += 2 {
+			e := newEdge(v, getcb(v, func(e *edge) bool {
+				return e.kind == kWild ||
+					e.kind == kClass && e.negate != inClass(lim[j], e.lim)
+			}), kClass)
+			e.lim = append(make([]rune, 0, 2), lim[j], lim[j+1])
+		}
+		// Wild.
+		newEdge(v, getcb(v, func(e *edge) bool {
+			return e.kind == kWild || (e.kind == kClass && e.negate)
+		}), kWild)
+		// ^ and $.
+		newEdge(v, getcb(v, func(e *edge) bool { return e.kind == kStart }), kStart)
+		newEdge(v, getcb(v, func(e *edge) bool { return e.kind == kEnd }), kEnd)
+	}
+	return &DFA{dfastart, dfacount}
+}
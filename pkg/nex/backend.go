@@ -0,0 +1,77 @@
+package nex
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// A Backend writes a compiled spec in some output form, such as Go source or
+// tables for a runtime in another language. Backends work from the DFAs and
+// actions of the rules as described by Program.DFAs.
+type Backend interface {
+	// Ext is the extension of the files written, e.g. ".go".
+	Ext() string
+	// Write writes the output for p to w.
+	Write(w io.Writer, p *Program) error
+}
+
+var backends = map[string]Backend{
+	"go":     goBackend{},
+	"json":   jsonBackend{},
+	"chroma": chromaBackend{},
+}
+
+// RegisterBackend makes a backend available under a name, replacing any
+// backend already registered under it. The "go", "json" and "chroma"
+// backends are built in.
+func RegisterBackend(name string, b Backend) {
+	backends[name] = b
+}
+
+// LookupBackend returns the backend registered under a name, or nil.
+func LookupBackend(name string) Backend {
+	return backends[name]
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// goBackend writes the Go lexer, as WriteGo does.
+type goBackend struct{}
+
+func (goBackend) Ext() string { return ".go" }
+
+func (goBackend) Write(w io.Writer, p *Program) error {
+	return p.WriteGo(w)
+}
+
+// jsonBackend writes the DFAs and actions of the rules as indented JSON.
+type jsonBackend struct{}
+
+// A tableDump is the output of the json backend.
+type tableDump struct {
+	Package     string     `json:"package"`
+	StartAction string     `json:"start_action,omitempty"`
+	EndAction   string     `json:"end_action,omitempty"`
+	Rules       []RuleDump `json:"rules"`
+}
+
+func (jsonBackend) Ext() string { return ".json" }
+
+func (jsonBackend) Write(w io.Writer, p *Program) error {
+	if p.g.opts.Lazy {
+		return ErrLazy
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tableDump{p.Package(), p.root.startCode, p.root.endCode, p.DFAs()})
+}
@@ -0,0 +1,40 @@
+package nex
+
+import "math/bits"
+
+// A bitset is a set of small non-negative ints, such as the NFA states the
+// subset construction gathers into a DFA state.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (s bitset) add(i int) {
+	s[i/64] |= 1 << uint(i%64)
+}
+
+func (s bitset) has(i int) bool {
+	return s[i/64]&(1<<uint(i%64)) != 0
+}
+
+// each calls f on the members of s in increasing order.
+func (s bitset) each(f func(int)) {
+	for k, w := range s {
+		for w != 0 {
+			f(k*64 + bits.TrailingZeros64(w))
+			w &= w - 1
+		}
+	}
+}
+
+// appendKey appends to buf the bytes of s, a map key eight times smaller
+// than a byte per member.
+func (s bitset) appendKey(buf []byte) []byte {
+	for _, w := range s {
+		for k := 0; k < 64; k += 8 {
+			buf = append(buf, byte(w>>uint(k)))
+		}
+	}
+	return buf
+}
@@ -0,0 +1,174 @@
+package nex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A Builder assembles a spec rule by rule, for programs that derive their
+// rules from data rather than from a .nex file:
+//
+//	b := nex.NewBuilder()
+//	b.Rule(`[0-9]+`, "return NUM")
+//	b.Rule(`[ \t\n]`, "")
+//	b.Code("package calc")
+//	err := b.Generate(w, nex.Options{})
+//
+// Regexes are written without delimiters, and actions are Go statements
+// without the surrounding braces. In errors and warnings, the line is the
+// number of the rule, counting from 1 in the order the rules were added, and
+// the column is 1 plus the offset in the regex.
+type Builder struct {
+	root   Rule
+	family []*Rule // The families being built, innermost last.
+	last   *Rule   // The rule added last.
+	n      int     // Number of rules added.
+	code   string
+	err    error
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder() *Builder {
+	b := new(Builder)
+	b.family = []*Rule{&b.root}
+	return b
+}
+
+// add appends a rule with the given regex to the current family.
+func (b *Builder) add(regex string) *Rule {
+	b.n++
+	x := &Rule{Regex: regex, Line: b.n, ActionLine: b.n}
+	f := b.family[len(b.family)-1]
+	f.Rules = append(f.Rules, x)
+	b.last = x
+	return x
+}
+
+// action wraps the statements of an action in braces, and checks they parse.
+func (b *Builder) action(what, code string) string {
+	code = "{ " + code + " }"
+	if err := checkAction(code, "<builder>", b.n, 1); err != nil && b.err == nil {
+		err.Err = fmt.Errorf("%s: %v", what, err.Err)
+		b.err = err
+	}
+	return code
+}
+
+// Rule adds a rule to the current family. The action runs when the regex
+// matches.
+func (b *Builder) Rule(regex, action string) *Builder {
+	x := b.add(regex)
+	x.Action = b.action("action of /"+regex+"/", action)
+	return b
+}
+
+// Begin adds a rule whose matches are lexed again by a nested family of
+// rules, which the following calls add to until the matching End. The
+// action runs before the nested family starts.
+func (b *Builder) Begin(regex, action string) *Builder {
+	x := b.add(regex)
+	x.StartAction = b.action("'<' action of /"+regex+"/", action)
+	b.family = append(b.family, x)
+	return b
+}
+
+// End closes the family opened by the last Begin. The action runs when the
+// nested family has consumed the text of the match.
+func (b *Builder) End(action string) *Builder {
+	if len(b.family) == 1 {
+		if b.err == nil {
+			b.err = errors.New("End without Begin")
+		}
+		return b
+	}
+	x := b.family[len(b.family)-1]
+	x.EndAction = b.action("'>' action of /"+x.Regex+"/", action)
+	b.family = b.family[:len(b.family)-1]
+	return b
+}
+
+// Priority sets the priority of the rule added last, as %priority does:
+// among the rules of a family matching the same text, one of higher priority
+// wins.
+func (b *Builder) Priority(n int) *Builder {
+	if b.last == nil {
+		if b.err == nil {
+			b.err = errors.New("Priority without a rule")
+		}
+		return b
+	}
+	b.last.Priority = n
+	return b
+}
+
+// Type annotates the rule added last as %type does: on a match, the text is
+// stored in the field of lval, converted by the function convert if it is
+// not empty, before the action runs, and token is returned after it. The
+// field and the function can be empty.
+func (b *Builder) Type(token, field, convert string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	switch {
+	case b.last == nil:
+		b.err = errors.New("Type without a rule")
+	case b.last.StartAction != "":
+		b.err = errors.New("Type on a rule with nested rules")
+	case !isToken(token) || field != "" && !isName(field) || convert != "" && (field == "" || !isFunc(convert)):
+		b.err = &Error{"<builder>", b.n, 1, "syntax", ErrBadType}
+	default:
+		b.last.Token, b.last.Field, b.last.Convert = token, field, convert
+	}
+	return b
+}
+
+// Code sets the Go code following the rules, which must start with a
+// package clause.
+func (b *Builder) Code(src string) *Builder {
+	if !strings.HasSuffix(src, "\n") {
+		src += "\n"
+	}
+	b.code = src
+	return b
+}
+
+// Spec returns the spec built so far.
+func (b *Builder) Spec() (*Spec, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.family) > 1 {
+		return nil, errors.New("Begin without End")
+	}
+	if strings.TrimSpace(b.code) == "" {
+		return nil, errors.New("no Go code; call Code with at least a package clause")
+	}
+	return &Spec{Rules: b.root.Rules, Code: b.code, CodeLine: 1, CodeCol: 1}, nil
+}
+
+// Compile builds the DFAs of the rules added so far.
+func (b *Builder) Compile(opts Options) (*Program, error) {
+	if opts.Filename == "" {
+		opts.Filename = "<builder>"
+	}
+	if e, ok := b.err.(*Error); ok {
+		e.File = opts.Filename
+	}
+	sp, err := b.Spec()
+	if err != nil {
+		return nil, err
+	}
+	return CompileSpec(sp, opts)
+}
+
+// Generate compiles the rules added so far and writes the Go source of the
+// lexer to w.
+func (b *Builder) Generate(w io.Writer, opts Options) error {
+	p, err := b.Compile(opts)
+	if err != nil {
+		return err
+	}
+	return p.WriteGo(w)
+}
@@ -0,0 +1,83 @@
+package nex
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// chromaBackend writes the rules as a lexer in the XML format of chroma, the
+// syntax highlighter. The token type of each rule is given by a
+// /*chroma:Type*/ or //chroma:Type comment in its action, e.g.
+// /*chroma:Keyword*/, and defaults to Text. The rules nested in a rule lex
+// its matches, in a state of their own. Actions are not run, and as chroma
+// takes the first rule that matches rather than the longest match, rules may
+// need reordering.
+type chromaBackend struct{}
+
+func (chromaBackend) Ext() string { return ".xml" }
+
+// chromaDirective finds the token type in an action.
+var chromaDirective = regexp.MustCompile(`(?://|/\*)chroma:([A-Za-z]+)`)
+
+func (chromaBackend) Write(w io.Writer, p *Program) error {
+	out := bufio.NewWriter(w)
+	out.WriteString("<lexer>\n  <config>\n    <name>")
+	xml.EscapeText(out, []byte(p.Package()))
+	out.WriteString("</name>\n")
+	if p.g.opts.Caseless {
+		out.WriteString("    <case_insensitive>true</case_insensitive>\n")
+	}
+	out.WriteString("  </config>\n  <rules>\n")
+	if err := writeChromaState(out, "root", &p.root, p.g.defs, p.g.opts.NoNewline); err != nil {
+		return err
+	}
+	out.WriteString("  </rules>\n</lexer>\n")
+	return out.Flush()
+}
+
+// writeChromaState writes the state running a family, followed by those of
+// the families nested in it. Runes no rule matches are passed as Text, as
+// nex skips them. {NAME} stands for the regex defs maps NAME to, and if
+// nonewline is set, negated classes match no newline.
+func writeChromaState(out *bufio.Writer, name string, family *rule, defs map[string]*Regex, nonewline bool) error {
+	fmt.Fprintf(out, "    <state name=%q>\n", name)
+	var nested []*rule
+	for _, x := range family.kid {
+		re, _, err := parseRegex(x.regex, defs)
+		if err != nil {
+			return err
+		}
+		if nonewline {
+			re = excludeNewline(re)
+		}
+		out.WriteString("      <rule pattern=\"")
+		xml.EscapeText(out, []byte(foreignRegex(re, "(?s:.)")))
+		out.WriteString("\">\n")
+		if x.kid != nil {
+			fmt.Fprintf(out, "        <usingself state=%q/>\n", chromaState(x))
+			nested = append(nested, x)
+		} else {
+			typ := "Text"
+			if m := chromaDirective.FindStringSubmatch(x.code); m != nil {
+				typ = m[1]
+			}
+			fmt.Fprintf(out, "        <token type=%q/>\n", typ)
+		}
+		out.WriteString("      </rule>\n")
+	}
+	out.WriteString("      <rule pattern=\"(?s:.)\">\n        <token type=\"Text\"/>\n      </rule>\n    </state>\n")
+	for _, x := range nested {
+		if err := writeChromaState(out, chromaState(x), x, defs, nonewline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chromaState names the state of the family nested in a rule.
+func chromaState(x *rule) string {
+	return fmt.Sprintf("rule%d_%d", x.line, x.col)
+}
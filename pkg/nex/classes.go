@@ -0,0 +1,73 @@
+package nex
+
+// runeClasses partitions the runes into the classes of a family: two runes
+// are in the same class if every state of every DFA of the family goes to
+// the same state on both. The generated lexer maps each rune it reads to its
+// class, then looks up its transition by class, so the tables need one
+// column per class rather than code per range.
+type runeClasses struct {
+	lo    []rune // Sorted starts of the ranges of runes, the first being 0.
+	class []int  // Class of the runes from lo[i] up to lo[i+1].
+	n     int    // Number of classes.
+}
+
+// familyClasses computes the classes of the family made of the given rules.
+// Nested rules belong to other families, so their DFAs are not consulted.
+func familyClasses(kids []*rule) *runeClasses {
+	var starts []*node
+	for _, x := range kids {
+		starts = append(starts, x.dfa)
+	}
+	alphabet := alphabetOf(starts)
+	// Runes from one element of the alphabet up to the next behave the same
+	// in every state, so we refine the partition of the elements by the
+	// state each DFA state goes to on them.
+	class := make([]int, len(alphabet))
+	n := 1
+	for _, x := range kids {
+		for _, v := range dfaStates(x.dfa) {
+			class, n = refine(class, func(i int) int { return stepState(v, alphabet[i]) })
+		}
+	}
+	return mergeClasses(alphabet, class, n)
+}
+
+// refine splits the classes of the elements of an alphabet by the values f
+// takes on them, returning the new classes and their number.
+func refine(class []int, f func(i int) int) ([]int, int) {
+	ids := make(map[[2]int]int)
+	next := make([]int, len(class))
+	for i := range class {
+		key := [2]int{class[i], f(i)}
+		id, ok := ids[key]
+		if !ok {
+			id = len(ids)
+			ids[key] = id
+		}
+		next[i] = id
+	}
+	return next, len(ids)
+}
+
+// mergeClasses makes the runeClasses of the n classes of the elements of
+// an alphabet, merging neighbouring ranges of the same class.
+func mergeClasses(alphabet []rune, class []int, n int) *runeClasses {
+	rc := &runeClasses{n: n}
+	for i, r := range alphabet {
+		if i > 0 && class[i] == class[i-1] {
+			continue
+		}
+		rc.lo = append(rc.lo, r)
+		rc.class = append(rc.class, class[i])
+	}
+	return rc
+}
+
+// stepState returns the number of the state v goes to on reading r, which
+// is -1 for the dead state.
+func stepState(v *node, r rune) int {
+	if u := step(v, r); u != nil {
+		return u.n
+	}
+	return -1
+}
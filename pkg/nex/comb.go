@@ -0,0 +1,124 @@
+package nex
+
+import (
+	"bufio"
+	"sort"
+)
+
+// combWindow is how many of the states before it are tried as the default
+// of a state.
+const combWindow = 128
+
+// A combTable is a transition table compressed the way lex does it. The
+// transitions a state does not share with its default state are laid out
+// in next at base[state]+class, overlapping those of other states, with
+// check telling whose they are. Other transitions are looked up in the
+// default state, if any, and go to the dead state otherwise:
+//
+//	for ; st != -1; st = def[st] {
+//		if i := base[st] + c; check[i] == st {
+//			return next[i]
+//		}
+//	}
+//	return -1
+type combTable struct {
+	base, def, next, check []int
+}
+
+// compress compresses the rows of a transition table, -1 being the dead
+// state.
+func compress(rows [][]int) *combTable {
+	n := len(rows)
+	t := &combTable{base: make([]int, n), def: make([]int, n)}
+	if n == 0 {
+		return t
+	}
+	m := len(rows[0])
+	// The classes of the transitions each state keeps.
+	kept := make([][]int, n)
+	for s, row := range rows {
+		t.def[s] = -1
+		for c, dst := range row {
+			if dst != -1 {
+				kept[s] = append(kept[s], c)
+			}
+		}
+		// A default must come earlier, so that chains of them end, and
+		// must save more transitions than the dead state.
+		best := len(kept[s])
+		for d := s - 1; d >= 0 && d >= s-combWindow; d-- {
+			diff := 0
+			for c, dst := range row {
+				if rows[d][c] != dst {
+					diff++
+				}
+			}
+			if diff < best {
+				best, t.def[s] = diff, d
+			}
+		}
+		if d := t.def[s]; d != -1 {
+			kept[s] = kept[s][:0]
+			for c, dst := range row {
+				if rows[d][c] != dst {
+					kept[s] = append(kept[s], c)
+				}
+			}
+		}
+	}
+
+	// Lay out the states with the most transitions first, each at the
+	// lowest base where its transitions fit.
+	order := make([]int, n)
+	for s := range order {
+		order[s] = s
+	}
+	sort.SliceStable(order, func(i, j int) bool { return len(kept[order[i]]) > len(kept[order[j]]) })
+	var used []bool
+	size := m
+	for _, s := range order {
+		b := 0
+	fit:
+		for ; ; b++ {
+			for _, c := range kept[s] {
+				if b+c < len(used) && used[b+c] {
+					continue fit
+				}
+			}
+			break
+		}
+		t.base[s] = b
+		for _, c := range kept[s] {
+			for len(used) <= b+c {
+				used = append(used, false)
+			}
+			used[b+c] = true
+		}
+		if b+m > size {
+			size = b + m
+		}
+	}
+	t.next, t.check = make([]int, size), make([]int, size)
+	for i := range t.check {
+		t.check[i] = -1
+	}
+	for s, row := range rows {
+		for _, c := range kept[s] {
+			t.next[t.base[s]+c] = row[c]
+			t.check[t.base[s]+c] = s
+		}
+	}
+	return t
+}
+
+// writeComb emits a combTable.
+func writeComb(out *bufio.Writer, t *combTable) {
+	out.WriteString("&comb{")
+	for i, v := range [][]int{t.base, t.def, t.next, t.check} {
+		if i > 0 {
+			out.WriteString(",\n")
+		}
+		writeInts(out, v)
+	}
+	out.WriteString("}")
+}
@@ -0,0 +1,224 @@
+package nex
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A familyDFA is the product of the DFAs of the rules of a family: its states
+// are the sets of states the DFAs can be in at once, so the generated lexer
+// takes a single transition per rune however many rules compete. A state
+// accepts for the earliest of the rules that accept in it.
+type familyDFA struct {
+	rc     *runeClasses
+	next   [][]int // Transitions, by state and rune class; -1 is the dead state.
+	acc    []int   // Rule accepted in each state, or -1.
+	endAcc []int   // Rule accepted after the $ transitions of each state, or -1.
+	// State 0 is where every DFA starts, and begin is where they are after
+	// following their ^ transitions at the start of the input, accepting
+	// beginAcc there.
+	begin, beginAcc int
+}
+
+// familyState is a state of the product: the states of the DFAs of a family
+// that are alive, in the order of the rules.
+type familyState []ruleState
+
+type ruleState struct {
+	i int   // Index of the rule in the family.
+	v *node // State of its DFA.
+}
+
+func (s familyState) key() string {
+	var b strings.Builder
+	for _, x := range s {
+		fmt.Fprintf(&b, "%d:%d,", x.i, x.v.n)
+	}
+	return b.String()
+}
+
+// normalize sorts the states and drops duplicates.
+func (s familyState) normalize() familyState {
+	sort.Slice(s, func(a, b int) bool {
+		if s[a].i != s[b].i {
+			return s[a].i < s[b].i
+		}
+		return s[a].v.n < s[b].v.n
+	})
+	var res familyState
+	for k, x := range s {
+		if k == 0 || x != s[k-1] {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// follow returns the states reached from v by taking edges of the given
+// kind, which is kStart or kEnd, one or more times.
+func follow(v *node, kind int) []*node {
+	var res []*node
+	mark := map[*node]bool{v: true}
+	for {
+		var dst *node
+		for _, e := range v.e {
+			if e.kind == kind && e.dst.n != -1 {
+				dst = e.dst
+			}
+		}
+		if dst == nil || mark[dst] {
+			return res
+		}
+		mark[dst] = true
+		res = append(res, dst)
+		v = dst
+	}
+}
+
+// combine builds the product of the DFAs of a family, minimized unless
+// Options.NoMinimize is set.
+func (g *generator) combine(kids []*rule) *familyDFA {
+	f := &familyDFA{rc: familyClasses(kids), beginAcc: -1}
+	var states []familyState
+	index := make(map[string]int)
+	add := func(s familyState) int {
+		k := s.key()
+		n, ok := index[k]
+		if !ok {
+			n = len(states)
+			index[k] = n
+			states = append(states, s)
+		}
+		return n
+	}
+	var restart, begin familyState
+	for i, x := range kids {
+		restart = append(restart, ruleState{i, x.dfa})
+		begin = append(begin, ruleState{i, x.dfa})
+		for _, v := range follow(x.dfa, kStart) {
+			begin = append(begin, ruleState{i, v})
+			if v.accept && f.beginAcc == -1 {
+				f.beginAcc = i
+			}
+		}
+	}
+	add(restart)
+	f.begin = add(begin.normalize())
+	// Pick a rune of each class to step the DFAs with.
+	reps := make([]rune, f.rc.n)
+	for k, c := range f.rc.class {
+		reps[c] = f.rc.lo[k]
+	}
+	for k := 0; k < len(states); k++ {
+		s := states[k]
+		acc, endAcc := -1, -1
+		for _, x := range s {
+			if x.v.accept && acc == -1 {
+				acc = x.i
+			}
+			for _, v := range follow(x.v, kEnd) {
+				if v.accept && endAcc == -1 {
+					endAcc = x.i
+				}
+			}
+		}
+		f.acc = append(f.acc, acc)
+		f.endAcc = append(f.endAcc, endAcc)
+		row := make([]int, f.rc.n)
+		for c, r := range reps {
+			var t familyState
+			for _, x := range s {
+				if v := step(x.v, r); v != nil {
+					t = append(t, ruleState{x.i, v})
+				}
+			}
+			if len(t) == 0 {
+				row[c] = -1
+				continue
+			}
+			row[c] = add(t.normalize())
+		}
+		f.next = append(f.next, row)
+	}
+	if !g.opts.NoMinimize {
+		f.minimize()
+	}
+	return f
+}
+
+// minimize merges the states of a familyDFA that accept the same rules on
+// the same inputs. States 0 and begin are kept even if they can never accept.
+func (f *familyDFA) minimize() {
+	n, m := len(f.next), f.rc.n
+	// Index n stands for the dead state.
+	dst := func(i, j int) int {
+		if i == n || f.next[i][j] == -1 {
+			return n
+		}
+		return f.next[i][j]
+	}
+	class := make([]int, n+1)
+	ids := make(map[[2]int]int)
+	for i := 0; i <= n; i++ {
+		key := [2]int{-1, -1}
+		if i < n {
+			key = [2]int{f.acc[i], f.endAcc[i]}
+		}
+		id, ok := ids[key]
+		if !ok {
+			id = len(ids)
+			ids[key] = id
+		}
+		class[i] = id
+	}
+	hopcroft(n+1, m, dst, class)
+	dead := class[n]
+	// Renumber the blocks, keeping state 0 first.
+	num := make(map[int]int)
+	var reps []int
+	for _, i := range []int{0, f.begin} {
+		if _, ok := num[class[i]]; !ok {
+			num[class[i]] = len(reps)
+			reps = append(reps, i)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, ok := num[class[i]]; !ok && class[i] != dead {
+			num[class[i]] = len(reps)
+			reps = append(reps, i)
+		}
+	}
+	g := &familyDFA{rc: f.rc, begin: num[class[f.begin]], beginAcc: f.beginAcc}
+	for _, i := range reps {
+		row := make([]int, m)
+		for j := range row {
+			if t := dst(i, j); class[t] == dead {
+				row[j] = -1
+			} else {
+				row[j] = num[class[t]]
+			}
+		}
+		g.next = append(g.next, row)
+		g.acc = append(g.acc, f.acc[i])
+		g.endAcc = append(g.endAcc, f.endAcc[i])
+	}
+	*f = *g
+}
+
+// stops tells, for each state, whether a match reaching it can end there
+// without looking at the next rune: the state has no transitions, and no
+// rule accepting at the end of the input would win over the one it accepts.
+func (f *familyDFA) stops() []bool {
+	stop := make([]bool, len(f.next))
+	for i, row := range f.next {
+		stop[i] = f.endAcc[i] == -1 || f.acc[i] != -1 && f.acc[i] < f.endAcc[i]
+		for _, t := range row {
+			if t != -1 {
+				stop[i] = false
+				break
+			}
+		}
+	}
+	return stop
+}
@@ -0,0 +1,87 @@
+package nex
+
+// The dump of the DFAs describes them exactly as the generated tables do.
+// States are numbered as in the tables, and -1 denotes the dead state.
+
+// A RuleDump describes the DFA and actions of a rule, and the rules nested
+// in it.
+type RuleDump struct {
+	Index       int         `json:"index"` // Position in the family, which wins ties.
+	Line        int         `json:"line"`
+	Col         int         `json:"col"`
+	Regex       string      `json:"regex"`
+	Nullable    bool        `json:"nullable"`
+	Action      string      `json:"action,omitempty"`
+	StartAction string      `json:"start_action,omitempty"` // For a rule with nested rules.
+	EndAction   string      `json:"end_action,omitempty"`
+	States      []StateDump `json:"states"`
+	Rules       []RuleDump  `json:"rules,omitempty"` // The nested family, if any.
+}
+
+// A StateDump describes a DFA state and its transitions.
+type StateDump struct {
+	Accept      bool             `json:"accept"`
+	Transitions []TransitionDump `json:"transitions,omitempty"`
+	Default     int              `json:"default"` // Destination on any other rune.
+	Start       int              `json:"start"`   // Destination on ^.
+	End         int              `json:"end"`     // Destination on $.
+}
+
+// A TransitionDump is taken on the runes from Lo to Hi inclusive.
+type TransitionDump struct {
+	Lo   rune `json:"lo"`
+	Hi   rune `json:"hi"`
+	Next int  `json:"next"`
+}
+
+// DFAs describes the DFAs of the top-level family of rules. It returns nil
+// in lazy mode.
+func (p *Program) DFAs() []RuleDump {
+	if p.g.opts.Lazy {
+		return nil
+	}
+	return dumpFamily(&p.root)
+}
+
+func dumpFamily(family *rule) []RuleDump {
+	var rules []RuleDump
+	for i, x := range family.kid {
+		rules = append(rules, RuleDump{
+			Index:       i,
+			Line:        x.line,
+			Col:         x.col,
+			Regex:       string(x.regex),
+			Nullable:    x.nullable,
+			Action:      x.code,
+			StartAction: x.startCode,
+			EndAction:   x.endCode,
+			States:      dumpDFA(x.dfa),
+			Rules:       dumpFamily(x),
+		})
+	}
+	return rules
+}
+
+func dumpDFA(start *node) []StateDump {
+	sorted := dfaStates(start)
+	states := make([]StateDump, len(sorted))
+	for i, v := range sorted {
+		s := StateDump{Accept: v.accept, Default: -1, Start: -1, End: -1}
+		for _, e := range v.e {
+			switch e.kind {
+			case kRune:
+				s.Transitions = append(s.Transitions, TransitionDump{e.r, e.r, e.dst.n})
+			case kClass:
+				s.Transitions = append(s.Transitions, TransitionDump{e.lim[0], e.lim[1], e.dst.n})
+			case kWild:
+				s.Default = e.dst.n
+			case kStart:
+				s.Start = e.dst.n
+			case kEnd:
+				s.End = e.dst.n
+			}
+		}
+		states[i] = s
+	}
+	return states
+}
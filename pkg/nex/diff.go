@@ -0,0 +1,246 @@
+package nex
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Diff compares the rules of two versions of a spec by what they do rather
+// than how they are written. The rules of each family, and those nested in
+// them, are paired up: first those with the same regex, then those whose
+// DFAs are equivalent, then those with the same action, then those matching
+// some string in common. It returns the changes found, with codes:
+//
+//   - "removed" and "added" for the rules left unpaired;
+//   - "changed" for a pair whose regexes match different strings, with an
+//     example of the shortest such string;
+//   - "action" for a pair whose actions differ;
+//   - "precedence" for two pairs whose order changed while some input
+//     matches both of them, so that the other one now wins.
+//
+// Removed rules are placed in the old spec and come first, the others in the
+// new one, ordered by position. Both programs must have been compiled without
+// Options.Lazy.
+func Diff(old, new *Program) ([]*Error, error) {
+	if old.g.opts.Lazy || new.g.opts.Lazy {
+		return nil, ErrLazy
+	}
+	d := &differ{old: old.g.filename, new: new.g.filename}
+	oldNames, oldFams := old.familyList()
+	newNames, newFams := new.familyList()
+	for i, name := range newNames {
+		j := 0
+		for j < len(oldNames) && oldNames[j] != name {
+			j++
+		}
+		if j == len(oldNames) {
+			d.family(nil, newFams[i].kid)
+			continue
+		}
+		d.family(oldFams[j].kid, newFams[i].kid)
+	}
+	for j, name := range oldNames {
+		found := false
+		for _, n := range newNames {
+			found = found || n == name
+		}
+		if !found {
+			d.family(oldFams[j].kid, nil)
+		}
+	}
+	// The removed rules come first, then the others by position.
+	sort.SliceStable(d.changes, func(i, j int) bool {
+		a, b := d.changes[i], d.changes[j]
+		if (a.Code == "removed") != (b.Code == "removed") {
+			return a.Code == "removed"
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return d.changes, nil
+}
+
+// familyList returns the names of the families of the program, the outermost
+// one being unnamed, and their rules.
+func (p *Program) familyList() ([]string, []rule) {
+	names := []string{""}
+	for i := 1; i < len(p.g.families); i++ {
+		names = append(names, p.g.families[i].Name)
+	}
+	return names, append([]rule{p.root}, p.families...)
+}
+
+// A differ collects the changes found by Diff.
+type differ struct {
+	old, new string // The file names of the specs.
+	changes  []*Error
+}
+
+func (d *differ) add(file string, x *rule, code, msg string) {
+	d.changes = append(d.changes, &Error{file, x.line, x.col, code, errors.New(msg)})
+}
+
+// sameCode reports whether two actions are the same but for spacing.
+func sameCode(a, b string) bool {
+	return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
+
+// emptyCode reports whether actions do nothing, and so say nothing about
+// which rule they belong to.
+func emptyCode(code string) bool {
+	return strings.Trim(code, "{} \t\n") == ""
+}
+
+// family compares the rules of a family in both versions.
+func (d *differ) family(a, b []*rule) {
+	pair := make([]int, len(a)) // The index in b paired with each rule of a.
+	paired := make([]bool, len(b))
+	for i := range pair {
+		pair[i] = -1
+	}
+	// Rules paired by one test are out of the running for the next ones.
+	for _, same := range []func(x, y *rule) bool{
+		func(x, y *rule) bool { return string(x.regex) == string(y.regex) },
+		func(x, y *rule) bool { return Equivalent(&DFA{start: x.dfa}, &DFA{start: y.dfa}) },
+		func(x, y *rule) bool {
+			return !emptyCode(x.code+x.startCode) && sameCode(x.code, y.code) && sameCode(x.startCode, y.startCode)
+		},
+		func(x, y *rule) bool {
+			_, _, ok := witness(x.dfa, y.dfa, func(p, q bool) bool { return p && q })
+			return ok
+		},
+	} {
+		for i, x := range a {
+			for j := 0; pair[i] == -1 && j < len(b); j++ {
+				if !paired[j] && same(x, b[j]) {
+					pair[i], paired[j] = j, true
+				}
+			}
+		}
+	}
+	for i, x := range a {
+		if pair[i] == -1 {
+			d.add(d.old, x, "removed", fmt.Sprintf("rule /%s/ removed", string(x.regex)))
+		}
+	}
+	for j, y := range b {
+		if !paired[j] {
+			d.add(d.new, y, "added", fmt.Sprintf("rule /%s/ added", string(y.regex)))
+		}
+	}
+	for i, x := range a {
+		if pair[i] == -1 {
+			continue
+		}
+		y := b[pair[i]]
+		if s, now, ok := witness(x.dfa, y.dfa, func(p, q bool) bool { return p != q }); ok {
+			what := "no longer matches"
+			if now {
+				what = "now matches"
+			}
+			d.add(d.new, y, "changed", fmt.Sprintf("rule /%s/, formerly /%s/ at line %d, %s %s", string(y.regex), string(x.regex), x.line, what, s))
+		}
+		if !sameCode(x.code, y.code) || !sameCode(x.startCode, y.startCode) || !sameCode(x.endCode, y.endCode) {
+			d.add(d.new, y, "action", fmt.Sprintf("action of /%s/ changed", string(y.regex)))
+		}
+		for k := i + 1; k < len(a); k++ {
+			if pair[k] == -1 || pair[k] > pair[i] {
+				continue
+			}
+			// x came before a[k] and now comes after.
+			z := b[pair[k]]
+			if s, _, ok := witness(y.dfa, z.dfa, func(p, q bool) bool { return p && q }); ok {
+				d.add(d.new, z, "precedence", fmt.Sprintf("rule /%s/ now wins over /%s/ at line %d on %s", string(z.regex), string(y.regex), y.line, s))
+			}
+		}
+		if len(x.kid) > 0 || len(y.kid) > 0 {
+			d.family(x.kid, y.kid)
+		}
+	}
+}
+
+// witness searches the product of two DFAs for the shortest non-empty input
+// leading to states for which want holds, given whether each accepts. The
+// input is written quoted, with ^ before it if it is read at the start of the
+// input and $ after it if at the end, and returned with whether b accepts it.
+// Runes are picked printable where the DFAs allow.
+func witness(a, b *node, want func(p, q bool) bool) (string, bool, bool) {
+	var runes []rune
+	alphabet := alphabetOf([]*node{a, b})
+	for i, lo := range alphabet {
+		if lo > unicode.MaxRune {
+			break
+		}
+		hi := rune(unicode.MaxRune)
+		if i+1 < len(alphabet) {
+			hi = alphabet[i+1] - 1
+		}
+		r := lo
+		for c := lo; c <= hi && c < lo+128; c++ {
+			if unicode.IsPrint(c) && c != ' ' {
+				r = c
+				break
+			}
+		}
+		runes = append(runes, r)
+	}
+	// A state of the product also records whether the end of the input has
+	// been read, after which nothing else can be.
+	type state struct {
+		a, b *node
+		end  bool
+	}
+	type visit struct {
+		from state
+		r    rune // The rune read, or -1 for ^ and -2 for $.
+	}
+	accept := func(v *node) bool { return v != nil && v.accept }
+	start := state{a, b, false}
+	seen := map[state]visit{start: {}}
+	queue := []state{start}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if p != start && want(accept(p.a), accept(p.b)) {
+			var s []rune
+			prefix, suffix := "", ""
+			for q := p; q != start; q = seen[q].from {
+				switch r := seen[q].r; r {
+				case -1:
+					prefix = "^"
+				case -2:
+					suffix = "$"
+				default:
+					s = append([]rune{r}, s...)
+				}
+			}
+			return prefix + strconv.Quote(string(s)) + suffix, accept(p.b), true
+		}
+		next := func(q state, r rune) {
+			if q.a == nil && q.b == nil {
+				return
+			}
+			if _, ok := seen[q]; !ok {
+				seen[q] = visit{p, r}
+				queue = append(queue, q)
+			}
+		}
+		if p.end {
+			continue
+		}
+		if p == start {
+			next(state{stepAnchor(a, kStart), stepAnchor(b, kStart), false}, -1)
+		}
+		for _, r := range runes {
+			next(state{step(p.a, r), step(p.b, r), false}, r)
+		}
+		next(state{stepAnchor(p.a, kEnd), stepAnchor(p.b, kEnd), true}, -2)
+	}
+	return "", false, false
+}
@@ -0,0 +1,77 @@
+package nex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// DotOptions controls how automata are drawn in DOT format. The zero value
+// draws them as the -nfadot and -dfadot flags do.
+type DotOptions struct {
+	// RankDir is the direction of the layout, e.g. "LR" for left to right.
+	// It defaults to Graphviz's, top to bottom.
+	RankDir string
+	// NoLabels leaves the rune transitions unlabelled, which keeps graphs with
+	// large alphabets readable.
+	NoLabels bool
+	// AcceptColor fills the accepting states. It defaults to "green".
+	AcceptColor string
+	// RuleColors fill the accepting states of the combined automaton of a
+	// family by the rule that wins there, indexed by position in the family.
+	// Rules past the end of the slice get AcceptColor.
+	RuleColors []string
+}
+
+func (opts DotOptions) writeHeader(outf io.Writer, id string) {
+	fmt.Fprintf(outf, "digraph %v {\n", id)
+	if opts.RankDir != "" {
+		fmt.Fprintf(outf, "  rankdir=%v;\n", opts.RankDir)
+	}
+	fmt.Fprintf(outf, "  0[shape=box];\n")
+}
+
+// acceptColor returns the colour of the accepting states won by the i-th
+// rule of a family, or of all accepting states if i is -1.
+func (opts DotOptions) acceptColor(i int) string {
+	if 0 <= i && i < len(opts.RuleColors) && opts.RuleColors[i] != "" {
+		return opts.RuleColors[i]
+	}
+	if opts.AcceptColor != "" {
+		return opts.AcceptColor
+	}
+	return "green"
+}
+
+// WriteDot draws the NFA as a graph named `name` in DOT format. The start
+// state is boxed, blue transitions are taken on any rune, and unlabelled
+// black ones are empty, ^ or $ transitions.
+func (a *NFA) WriteDot(w io.Writer, name string, opts DotOptions) error {
+	out := bufio.NewWriter(w)
+	writeDotGraph(out, a.states[0], name, opts)
+	return out.Flush()
+}
+
+// WriteDot draws the DFA as a graph named `name` in DOT format. The start
+// state is boxed, blue transitions are taken on any rune not on another
+// transition, unlabelled black ones are ^ or $ transitions, and the dead
+// state is left out.
+func (d *DFA) WriteDot(w io.Writer, name string, opts DotOptions) error {
+	out := bufio.NewWriter(w)
+	writeDotGraph(out, d.start, name, opts)
+	return out.Flush()
+}
+
+// WriteFamilyDot draws, for each family of rules, the automaton that runs
+// their DFAs in parallel, as the lexer does. Each accepting state is labelled
+// with the rule that wins there. The graph of the outermost family is named
+// FAMILY, and those of nested families after the line of the rule holding
+// them.
+func (p *Program) WriteFamilyDot(w io.Writer, opts DotOptions) error {
+	if p.g.opts.Lazy {
+		return ErrLazy
+	}
+	out := bufio.NewWriter(w)
+	writeFamilyDots(out, &p.root, "FAMILY", opts)
+	return out.Flush()
+}
@@ -0,0 +1,34 @@
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+)
+
+// dumpFile returns the package clause of the program written by
+// Options.Dump.
+func (g *generator) dumpFile() *ast.File {
+	return &ast.File{Name: ast.NewIdent("main")}
+}
+
+// dumpTable returns the fields of the dumpFamily giving the regexes of the
+// rules of the outermost family, which name their matches in the output of
+// Options.Dump.
+func dumpTable(root *rule) string {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	var write func(kids []*rule)
+	write = func(kids []*rule) {
+		out.WriteString("[]string{")
+		for _, x := range kids {
+			fmt.Fprintf(out, "%q, ", string(x.regex))
+		}
+		out.WriteString("}, ")
+		writeNested(out, kids, "dumpFamily", write)
+	}
+	write(root.kid)
+	out.Flush()
+	return buf.String()
+}
@@ -0,0 +1,109 @@
+package nex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// writeFamilyDot prints, in DOT format, the automaton obtained by running
+// the DFAs of a family in parallel, as the generated scanner does. Each
+// accepting state is labelled with the rule that wins there, followed by any
+// other rules that accept but lose on precedence. Only rune transitions are
+// shown; ^ and $ are left out.
+func writeFamilyDot(outf io.Writer, family *rule, id string, opts DotOptions) {
+	var dfas []*node
+	for _, x := range family.kid {
+		dfas = append(dfas, x.dfa)
+	}
+	alphabet := alphabetOf(dfas)
+	key := func(v []*node) string {
+		var b strings.Builder
+		for _, u := range v {
+			n := -1
+			if u != nil {
+				n = u.n
+			}
+			fmt.Fprintf(&b, "%d,", n)
+		}
+		return b.String()
+	}
+	index := map[string]int{key(dfas): 0}
+	states := [][]*node{dfas}
+	opts.writeHeader(outf, id)
+	for k := 0; k < len(states); k++ {
+		v := states[k]
+		var accepts []int
+		for i, u := range v {
+			if u != nil && u.accept {
+				accepts = append(accepts, i)
+			}
+		}
+		if len(accepts) > 0 {
+			x := family.kid[accepts[0]]
+			label := fmt.Sprintf("%d\nrule %d: /%s/", k, accepts[0], string(x.regex))
+			if len(accepts) > 1 {
+				label += fmt.Sprintf("\nalso %v", accepts[1:])
+			}
+			fmt.Fprintf(outf, "  %v[style=filled,color=%v,label=%q];\n", k, opts.acceptColor(accepts[0]), label)
+		}
+		// Group the intervals of the alphabet by destination.
+		var dsts []int
+		ranges := make(map[int][]rune)
+		for j, r := range alphabet {
+			w := make([]*node, len(v))
+			live := false
+			for i, u := range v {
+				w[i] = step(u, r)
+				live = live || w[i] != nil
+			}
+			if !live {
+				continue
+			}
+			wk := key(w)
+			dst, ok := index[wk]
+			if !ok {
+				if len(states) >= maxProductStates {
+					fmt.Fprintf(outf, "  // Truncated at %d states.\n}\n", len(states))
+					return
+				}
+				dst = len(states)
+				index[wk] = dst
+				states = append(states, w)
+			}
+			hi := rune(unicode.MaxRune)
+			if j+1 < len(alphabet) {
+				hi = alphabet[j+1] - 1
+			}
+			if _, ok := ranges[dst]; !ok {
+				dsts = append(dsts, dst)
+			}
+			if lim := ranges[dst]; len(lim) > 0 && lim[len(lim)-1]+1 == r {
+				lim[len(lim)-1] = hi
+			} else {
+				ranges[dst] = append(lim, r, hi)
+			}
+		}
+		for _, dst := range dsts {
+			if opts.NoLabels {
+				fmt.Fprintf(outf, "  %v -> %v;\n", k, dst)
+				continue
+			}
+			label := classLabel(&edge{kind: kClass, lim: ranges[dst]})
+			fmt.Fprintf(outf, "  %v -> %v[label=%q];\n", k, dst, label)
+		}
+	}
+	fmt.Fprintln(outf, "}")
+}
+
+// writeFamilyDots calls writeFamilyDot on a family and on each of its
+// nested families.
+func writeFamilyDots(outf io.Writer, family *rule, id string, opts DotOptions) {
+	writeFamilyDot(outf, family, id, opts)
+	for _, x := range family.kid {
+		if len(x.kid) > 0 {
+			writeFamilyDots(outf, x, "FAMILY_"+x.id, opts)
+		}
+	}
+}
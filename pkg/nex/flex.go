@@ -0,0 +1,500 @@
+package nex
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A flexRule is a rule from the rules section of a flex file.
+type flexRule struct {
+	conds   []string // Start conditions, nil for the default ones, "*" for all.
+	pattern string   // Without its start conditions.
+	action  string   // C code. "|" means the action of the next rule.
+	line    int
+}
+
+// posixClasses maps POSIX character class names to nex class contents.
+var posixClasses = map[string]string{
+	"alnum":  `0-9A-Za-z`,
+	"alpha":  `A-Za-z`,
+	"blank":  ` \t`,
+	"digit":  `0-9`,
+	"graph":  `!-~`,
+	"lower":  `a-z`,
+	"print":  ` -~`,
+	"punct":  "!-\\/:-@\\[-`{-~",
+	"space":  ` \t\n\r\f\v`,
+	"upper":  `A-Z`,
+	"xdigit": `0-9A-Fa-f`,
+}
+
+// nexLiteral returns the nex regex matching the rune c literally.
+func nexLiteral(c rune) string {
+	switch {
+	case ispunct(c):
+		return `\` + string(c)
+	case c == 0:
+		return `\0`
+	}
+	for i, e := range escaped {
+		if e == c {
+			return `\` + string(escapes[i])
+		}
+	}
+	if c < 0x20 || c == 0x7f {
+		return fmt.Sprintf(`\x%02x`, c)
+	}
+	return string(c)
+}
+
+// flexEscape decodes the escape sequence after a backslash at s[i], returning
+// the rune and the index past the sequence.
+func flexEscape(s []rune, i int) (rune, int) {
+	if i >= len(s) {
+		return '\\', i
+	}
+	c := s[i]
+	switch {
+	case c == 'x':
+		j := i + 1
+		for j < len(s) && j < i+3 && strings.ContainsRune("0123456789abcdefABCDEF", s[j]) {
+			j++
+		}
+		if n, err := strconv.ParseUint(string(s[i+1:j]), 16, 32); err == nil {
+			return rune(n), j
+		}
+	case '0' <= c && c <= '7':
+		j := i
+		for j < len(s) && j < i+3 && '0' <= s[j] && s[j] <= '7' {
+			j++
+		}
+		n, _ := strconv.ParseUint(string(s[i:j]), 8, 32)
+		return rune(n), j
+	}
+	for k, e := range escapes {
+		if e == c {
+			return escaped[k], i + 1
+		}
+	}
+	return c, i + 1
+}
+
+// translateFlexPattern converts a flex pattern into a nex regex, with
+// quoted strings, escapes and POSIX classes rewritten, and references to
+// the definitions named in defs renamed to their nex names. Flex features
+// without a nex equivalent are dropped and described in the notes.
+func translateFlexPattern(pattern string, defs map[string]string) (regex string, notes []string) {
+	s := []rune(pattern)
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			var str strings.Builder
+			n := 0
+			for i++; i < len(s) && s[i] != '"'; n++ {
+				r := s[i]
+				i++
+				if r == '\\' {
+					r, i = flexEscape(s, i)
+				}
+				str.WriteString(nexLiteral(r))
+			}
+			i++
+			if n > 1 {
+				// Quantifiers apply to the whole string.
+				out.WriteString("(" + str.String() + ")")
+			} else {
+				out.WriteString(str.String())
+			}
+		case c == '[':
+			out.WriteRune('[')
+			i++
+			if i < len(s) && s[i] == '^' {
+				out.WriteRune('^')
+				i++
+			}
+			first := true
+			for i < len(s) && (s[i] != ']' || first) {
+				first = false
+				switch {
+				case s[i] == '[' && i+1 < len(s) && s[i+1] == ':':
+					end := strings.Index(string(s[i:]), ":]")
+					if end < 0 {
+						out.WriteString(`\[`)
+						i++
+						continue
+					}
+					name := string(s[i+2 : i+end])
+					if cls, ok := posixClasses[name]; ok {
+						out.WriteString(cls)
+					} else {
+						notes = append(notes, fmt.Sprintf("unknown character class [:%s:] dropped", name))
+					}
+					i += end + 2
+				case s[i] == '[' && i+1 < len(s) && (s[i+1] == '=' || s[i+1] == '.'):
+					// Equivalence classes and collating symbols read the same
+					// in nex.
+					end := i + 3
+					for end+1 < len(s) && (s[end] != s[i+1] || s[end+1] != ']') {
+						end++
+					}
+					if end+1 >= len(s) {
+						out.WriteString(`\[`)
+						i++
+						continue
+					}
+					out.WriteString(string(s[i : end+2]))
+					i = end + 2
+				case s[i] == '\\':
+					var r rune
+					r, i = flexEscape(s, i+1)
+					out.WriteString(nexLiteral(r))
+				case s[i] == '/' || s[i] == '[' || s[i] == ']' || s[i] == '\\':
+					out.WriteString(`\` + string(s[i]))
+					i++
+				default:
+					out.WriteRune(s[i])
+					i++
+				}
+			}
+			out.WriteRune(']')
+			i++
+		case c == '{' && i+1 < len(s) && ('0' <= s[i+1] && s[i+1] <= '9'):
+			// Counted repetitions read the same in nex.
+			end := strings.IndexRune(string(s[i:]), '}')
+			if end < 0 {
+				out.WriteString(`\{`)
+				i++
+				continue
+			}
+			out.WriteString(string(s[i : i+end+1]))
+			i += end + 1
+		case c == '{':
+			end := strings.IndexRune(string(s[i:]), '}')
+			if end < 0 {
+				out.WriteString(`\{`)
+				i++
+				continue
+			}
+			name := string(s[i+1 : i+end])
+			i += end + 1
+			def, ok := defs[name]
+			if !ok {
+				notes = append(notes, fmt.Sprintf("undefined definition {%s} dropped", name))
+				continue
+			}
+			out.WriteString("{" + def + "}")
+		case c == '\\':
+			var r rune
+			r, i = flexEscape(s, i+1)
+			out.WriteString(nexLiteral(r))
+		case c == '.':
+			// Unlike flex, nex's '.' matches newlines.
+			out.WriteString(`[^\n]`)
+			i++
+		case c == '/':
+			notes = append(notes, fmt.Sprintf("trailing context /%s dropped, as nex has none; the rule now matches whatever follows", string(s[i+1:])))
+			i = len(s)
+		case c == '^' && i == 0:
+			notes = append(notes, "beginning-of-line anchor ^ dropped")
+			i++
+		case c == '$' && i == len(s)-1:
+			notes = append(notes, "end-of-line anchor $ dropped, as nex has no trailing context; the rule now matches whatever follows")
+			i++
+		case strings.ContainsRune("()|*+?", c):
+			out.WriteRune(c)
+			i++
+		default:
+			out.WriteString(nexLiteral(c))
+			i++
+		}
+	}
+	return out.String(), notes
+}
+
+// startConditions splits the start conditions, such as <STRING,COMMENT>,
+// off the front of a flex pattern. It returns nil conditions if there are
+// none.
+func startConditions(pattern string) (conds []string, rest string) {
+	if strings.HasPrefix(pattern, "<") && !strings.HasPrefix(pattern, "<<EOF>>") {
+		if end := strings.Index(pattern, ">"); end > 0 {
+			return strings.Split(pattern[1:end], ","), pattern[end+1:]
+		}
+	}
+	return nil, pattern
+}
+
+// defineName returns the nex name of a flex definition, whose names may hold
+// dashes, which nex names may not.
+func defineName(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// splitFlexRule splits a line of the rules section into the pattern and the
+// start of the action, at the first whitespace outside quotes and brackets.
+func splitFlexRule(line string) (pattern, rest string) {
+	inQuote, inClass := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			i++
+		case inQuote:
+			inQuote = c != '"'
+		case inClass:
+			inClass = c != ']'
+		case c == '"':
+			inQuote = true
+		case c == '[':
+			inClass = true
+		case c == ' ' || c == '\t':
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+// ConvertFlex translates a flex specification into a nex spec. Definitions
+// become %define lines, and start conditions %family blocks holding the
+// rules active in them, the rules of INITIAL being the outermost ones, and
+// <<EOF>> rules %eof actions. Actions and user code are kept as comments
+// marked TODO, since they are written in C. Whatever has no nex equivalent,
+// such as trailing context or %option lines, is dropped with a TODO note in
+// the spec and a warning, given to opts.Warn with code "flex"; the other
+// fields of opts but Filename are ignored.
+func ConvertFlex(w io.Writer, r io.Reader, opts Options) error {
+	filename := opts.Filename
+	if filename == "" {
+		filename = "<stdin>"
+	}
+	warn := func(line int, msg string) {
+		if opts.Warn != nil {
+			opts.Warn(&Error{filename, line, 1, "flex", errors.New(msg)})
+		}
+	}
+	in := bufio.NewScanner(r)
+	defs := make(map[string]string)    // The nex names of the definitions.
+	var defines []string               // The %define lines.
+	var condNames []string             // The start conditions, in order.
+	exclusive := make(map[string]bool) // Whether each condition is %x.
+	var defNotes, cCode []string
+	section := 0
+	lineno := 0
+	var scopes [][]string // The conditions of the open <SC>{ scopes.
+	var rules []flexRule
+	for in.Scan() {
+		line := in.Text()
+		lineno++
+		if strings.TrimSpace(line) == "%%" && section < 2 {
+			section++
+			continue
+		}
+		if section == 1 && len(scopes) > 0 {
+			// Rules in scopes may be indented.
+			if strings.TrimSpace(line) == "}" {
+				scopes = scopes[:len(scopes)-1]
+				continue
+			}
+			if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "/*") && !strings.HasPrefix(t, "%{") {
+				line = t
+			}
+		}
+		switch {
+		case section == 2:
+			cCode = append(cCode, line)
+		case strings.HasPrefix(line, "%{"):
+			for in.Scan() {
+				lineno++
+				if strings.HasPrefix(in.Text(), "%}") {
+					break
+				}
+				cCode = append(cCode, in.Text())
+			}
+		case strings.TrimSpace(line) == "":
+		case line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(line, "/*"):
+			cCode = append(cCode, line)
+		case section == 0 && line[0] == '%':
+			f := strings.Fields(line)
+			switch f[0] {
+			case "%s", "%x", "%start", "%exclusive":
+				for _, name := range f[1:] {
+					if _, ok := exclusive[name]; !ok {
+						condNames = append(condNames, name)
+					}
+					exclusive[name] = f[0] == "%x" || f[0] == "%exclusive"
+				}
+			default:
+				defNotes = append(defNotes, line)
+				warn(lineno, fmt.Sprintf("%s not translated", f[0]))
+			}
+		case section == 0:
+			f := strings.Fields(line)
+			if len(f) < 2 {
+				defNotes = append(defNotes, line)
+				warn(lineno, fmt.Sprintf("%q not translated", line))
+				continue
+			}
+			name := f[0]
+			_, def := splitFlexRule(line)
+			regex, notes := translateFlexPattern(def, defs)
+			defs[name] = defineName(name)
+			defines = append(defines, fmt.Sprintf("%%define %s %s", defs[name], regex))
+			for _, note := range notes {
+				defNotes = append(defNotes, fmt.Sprintf("{%s}: %s", name, note))
+				warn(lineno, note)
+			}
+		default:
+			start := lineno
+			pattern, action := splitFlexRule(line)
+			conds, pattern := startConditions(pattern)
+			if conds != nil && pattern == "{" && action == "" {
+				scopes = append(scopes, conds)
+				continue
+			}
+			if conds == nil && len(scopes) > 0 {
+				conds = scopes[len(scopes)-1]
+			}
+			if strings.HasPrefix(action, "{") || strings.HasPrefix(action, "%{") {
+				// Read up to the balancing brace.
+				depth := strings.Count(action, "{") - strings.Count(action, "}")
+				for depth > 0 && in.Scan() {
+					lineno++
+					action += "\n" + in.Text()
+					depth += strings.Count(in.Text(), "{") - strings.Count(in.Text(), "}")
+				}
+			}
+			for _, c := range conds {
+				if _, ok := exclusive[c]; !ok && c != "INITIAL" && c != "*" {
+					// Flex rejects this. Taking the condition as exclusive
+					// keeps the rule out of the others.
+					warn(start, fmt.Sprintf("undeclared start condition %s", c))
+					condNames = append(condNames, c)
+					exclusive[c] = true
+				}
+			}
+			rules = append(rules, flexRule{conds, pattern, action, start})
+		}
+	}
+	if err := in.Err(); err != nil {
+		return err
+	}
+	// active tells whether rule x is active in the condition named c. An
+	// <<EOF>> rule without conditions is for all those without one of their
+	// own.
+	hasEOF := make(map[string]bool)
+	for _, x := range rules {
+		if x.pattern == "<<EOF>>" && x.conds != nil {
+			for _, c := range x.conds {
+				hasEOF[c] = true
+			}
+		}
+	}
+	active := func(x flexRule, c string) bool {
+		if x.conds == nil && x.pattern == "<<EOF>>" {
+			return !hasEOF[c]
+		}
+		if x.conds == nil {
+			return c == "INITIAL" || !exclusive[c]
+		}
+		for _, d := range x.conds {
+			if d == c || d == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	// Notes are reported once, however many families a rule is copied to.
+	noted := make(map[int]bool)
+	out := bufio.NewWriter(w)
+	// The ^ prefix of flex matches at the start of every line.
+	for _, x := range rules {
+		if strings.HasPrefix(x.pattern, "^") {
+			out.WriteString("%option bol\n")
+			break
+		}
+	}
+	for _, d := range defines {
+		out.WriteString(d + "\n")
+	}
+	writeRules := func(c, indent string) {
+		for i, x := range rules {
+			if !active(x, c) {
+				continue
+			}
+			var notes []string
+			regex := "%eof"
+			if x.pattern != "<<EOF>>" {
+				pattern := x.pattern
+				anchor := ""
+				if strings.HasPrefix(pattern, "^") {
+					anchor, pattern = "^", pattern[1:]
+				}
+				regex, notes = translateFlexPattern(pattern, defs)
+				regex = delimitRegex([]rune(anchor + regex))
+			}
+			if !noted[i] {
+				noted[i] = true
+				for _, note := range notes {
+					warn(x.line, note)
+				}
+			}
+			action := x.action
+			for j := i + 1; action == "|" && j < len(rules); j++ {
+				action = rules[j].action
+			}
+			action = strings.TrimSpace(action)
+			action = strings.TrimSuffix(strings.TrimPrefix(action, "%{"), "%}")
+			if strings.HasPrefix(action, "{") && strings.HasSuffix(action, "}") {
+				action = strings.TrimSpace(action[1 : len(action)-1])
+			}
+			if action == ";" {
+				action = ""
+			}
+			if action == "" && len(notes) == 0 {
+				fmt.Fprintf(out, "%s%s {}\n", indent, regex)
+				continue
+			}
+			fmt.Fprintf(out, "%s%s {\n", indent, regex)
+			for _, note := range notes {
+				fmt.Fprintf(out, "%s  // TODO: %s.\n", indent, note)
+			}
+			if action != "" {
+				if strings.Contains(action, "BEGIN") {
+					fmt.Fprintf(out, "%s  // TODO: BEGIN switches start condition; call yylex.PushFamily with the\n", indent)
+					fmt.Fprintf(out, "%s  // family of the condition, or yylex.PopFamily to return to the last.\n", indent)
+				}
+				fmt.Fprintf(out, "%s  // TODO: port this C action to Go:\n", indent)
+				for _, l := range strings.Split(action, "\n") {
+					fmt.Fprintf(out, "%s  //   %s\n", indent, strings.TrimRight(l, " \t"))
+				}
+			}
+			fmt.Fprintf(out, "%s}\n", indent)
+		}
+	}
+	writeRules("INITIAL", "")
+	for _, c := range condNames {
+		fmt.Fprintf(out, "%%family %s <\n", c)
+		writeRules(c, "  ")
+		out.WriteString(">\n")
+	}
+	// Spec comments are only possible in the Go code.
+	out.WriteString("//\npackage main\n")
+	if len(defNotes) > 0 {
+		out.WriteString("\n// TODO: these flex directives and definitions were not translated:\n")
+		for _, note := range defNotes {
+			fmt.Fprintf(out, "//   %s\n", note)
+		}
+	}
+	if len(cCode) > 0 {
+		out.WriteString("\n// TODO: port this C code to Go:\n")
+		for _, l := range cCode {
+			fmt.Fprintf(out, "//   %s\n", strings.TrimRight(l, " \t"))
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,100 @@
+package nex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// foreignRegex returns re in the Perl-like syntax of the regexes of other
+// tools, such as .NET's or Oniguruma's, any being their way of matching any
+// rune, newlines included, like a nex '.'. ^ and $ match at the ends of the
+// input.
+func foreignRegex(re *Regex, any string) string {
+	var b strings.Builder
+	writeForeignRegex(&b, re, 0, any)
+	return b.String()
+}
+
+// writeForeignRegex writes re where it binds at the given level: 0 in an
+// alternation, 1 in a concatenation and 2 under a closure. Lower levels are
+// parenthesized.
+func writeForeignRegex(b *strings.Builder, re *Regex, level int, any string) {
+	switch re.Op {
+	case OpEmpty:
+		if level == 2 {
+			b.WriteString("(?:)")
+		}
+	case OpRune:
+		b.WriteString(foreignRune(re.Rune, `\.+*?()|[]{}^$#`))
+	case OpClass:
+		if len(re.Ranges) == 0 {
+			if re.Negate {
+				b.WriteString(any)
+			} else {
+				b.WriteString("(?!)")
+			}
+			return
+		}
+		b.WriteString("[")
+		if re.Negate {
+			b.WriteString("^")
+		}
+		for i := 0; i < len(re.Ranges); i += 2 {
+			b.WriteString(foreignRune(re.Ranges[i], `\]^-[`))
+			if re.Ranges[i+1] != re.Ranges[i] {
+				b.WriteString("-" + foreignRune(re.Ranges[i+1], `\]^-[`))
+			}
+		}
+		b.WriteString("]")
+	case OpAny:
+		b.WriteString(any)
+	case OpBegin:
+		b.WriteString(`\A`)
+	case OpEnd:
+		b.WriteString(`\z`)
+	case OpConcat, OpAlt:
+		sep, inner := "", 1
+		if re.Op == OpAlt {
+			sep, inner = "|", 0
+		}
+		if level > inner {
+			b.WriteString("(?:")
+		}
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteString(sep)
+			}
+			writeForeignRegex(b, sub, inner, any)
+		}
+		if level > inner {
+			b.WriteString(")")
+		}
+	case OpStar, OpPlus, OpQuest:
+		if level == 2 {
+			b.WriteString("(?:")
+		}
+		writeForeignRegex(b, re.Sub[0], 2, any)
+		b.WriteString(map[RegexOp]string{OpStar: "*", OpPlus: "+", OpQuest: "?"}[re.Op])
+		if level == 2 {
+			b.WriteString(")")
+		}
+	}
+}
+
+// foreignRune returns a regex matching r, escaping it if it is one of special
+// or a control character.
+func foreignRune(r rune, special string) string {
+	switch {
+	case strings.ContainsRune(special, r):
+		return `\` + string(r)
+	case r == '\n':
+		return `\n`
+	case r == '\t':
+		return `\t`
+	case r == '\r':
+		return `\r`
+	case r < 0x20 || r == 0x7f:
+		return fmt.Sprintf(`\x%02X`, r)
+	}
+	return string(r)
+}
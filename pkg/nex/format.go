@@ -0,0 +1,142 @@
+package nex
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatAction gofmts an action, indenting continuation lines by `indent`.
+// Actions that fail to format are returned unchanged.
+func formatAction(code, indent string) string {
+	const prefix = "package p\n\nfunc _() "
+	out, err := format.Source([]byte(prefix + code + "\n"))
+	if err != nil || !strings.HasPrefix(string(out), prefix) {
+		return code
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out[len(prefix):]), "\n"), "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			lines[i] = indent + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// delimitRegex surrounds a regex with slashes, escaping any slashes within.
+func delimitRegex(regex []rune) string {
+	var b strings.Builder
+	b.WriteByte('/')
+	for i := 0; i < len(regex); i++ {
+		switch regex[i] {
+		case '\\':
+			b.WriteRune('\\')
+			if i+1 < len(regex) {
+				i++
+				b.WriteRune(regex[i])
+			}
+		case '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteRune(regex[i])
+		}
+	}
+	b.WriteByte('/')
+	return b.String()
+}
+
+// formatRules writes the rules of a family, indented by `indent`, with the
+// actions aligned.
+func formatRules(w *bytes.Buffer, rules []*Rule, eof, indent string) {
+	if eof != "" {
+		w.WriteString(indent + "%eof " + formatAction(eof, indent) + "\n")
+	}
+	width := 0
+	for _, x := range rules {
+		if n := utf8.RuneCountInString(delimitRegex([]rune(x.Regex))); n > width {
+			width = n
+		}
+	}
+	for _, x := range rules {
+		re := delimitRegex([]rune(x.Regex))
+		pad := strings.Repeat(" ", width-utf8.RuneCountInString(re)+1)
+		w.WriteString(indent + re + pad)
+		if x.Priority != 0 {
+			fmt.Fprintf(w, "%%priority %d ", x.Priority)
+		}
+		if x.Token != "" {
+			w.WriteString(strings.TrimSpace(strings.Join([]string{"%type", x.Token, x.Field, x.Convert}, " ")))
+			if x.Action == "" {
+				w.WriteString("\n")
+				continue
+			}
+			w.WriteString(" ")
+		}
+		if x.StartAction == "" {
+			w.WriteString(formatAction(x.Action, indent) + "\n")
+			continue
+		}
+		w.WriteString("< " + formatAction(x.StartAction, indent) + "\n")
+		formatRules(w, x.Rules, x.EOFAction, indent+"  ")
+		w.WriteString(indent + "> " + formatAction(x.EndAction, indent) + "\n")
+	}
+}
+
+// formatFamilies writes the %family blocks of a spec, after its rules.
+func formatFamilies(w *bytes.Buffer, families []*Family, indent string) {
+	for _, f := range families {
+		w.WriteString(indent + "%family " + f.Name + " <\n")
+		formatRules(w, f.Rules, f.EOFAction, indent+"  ")
+		w.WriteString(indent + ">\n")
+	}
+}
+
+// formatSpec returns the canonical form of a spec: rules delimited by
+// slashes, nested families indented by two spaces, actions aligned and
+// gofmt'ed, followed by the gofmt'ed Go code.
+func formatSpec(sp *Spec) []byte {
+	var w bytes.Buffer
+	if len(sp.Options) > 0 {
+		w.WriteString("%option " + strings.Join(sp.Options, " ") + "\n")
+	}
+	if len(sp.Uses) > 0 {
+		w.WriteString("%use " + strings.Join(sp.Uses, " ") + "\n")
+	}
+	for _, d := range sp.Defines {
+		w.WriteString("%define " + d.Name + " " + d.Regex + "\n")
+	}
+	if sp.InvalidAction != "" {
+		w.WriteString("%invalid " + formatAction(sp.InvalidAction, "") + "\n")
+	}
+	if sp.StartAction != "" {
+		w.WriteString("< " + formatAction(sp.StartAction, "") + "\n")
+		formatRules(&w, sp.Rules, sp.EOFAction, "  ")
+		formatFamilies(&w, sp.Families, "  ")
+		w.WriteString("> " + formatAction(sp.EndAction, "") + "\n")
+	} else {
+		formatRules(&w, sp.Rules, sp.EOFAction, "")
+		formatFamilies(&w, sp.Families, "")
+		w.WriteString("//\n")
+	}
+	code, err := format.Source([]byte(sp.Code))
+	if err != nil {
+		code = []byte(sp.Code)
+	}
+	w.Write(code)
+	if len(code) > 0 && code[len(code)-1] != '\n' {
+		w.WriteByte('\n')
+	}
+	return w.Bytes()
+}
+
+// Format returns the canonical form of the spec src, as printed by nex fmt.
+// The filename names the spec in errors.
+func Format(src []byte, filename string) ([]byte, error) {
+	sp, err := ParseSpec(bytes.NewReader(src), filename)
+	if err != nil {
+		return nil, err
+	}
+	return formatSpec(sp), nil
+}
@@ -0,0 +1,638 @@
+// Package nex generates Go lexers from nex specs. It implements the nex
+// command, which is a thin wrapper around it.
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Options controls the generation of a lexer. The zero value gives the
+// defaults of the nex command.
+type Options struct {
+	// Filename names the spec in errors and warnings. It defaults to
+	// "<stdin>".
+	Filename string
+	// Prefix replaces "yy" in the names used by the generated code.
+	Prefix string
+	// Standalone replaces the NN_FUN macro in the Go code with the lexer
+	// instead of generating a Lex() method.
+	Standalone bool
+	// Main, with Standalone, adds a main function running the rules, as
+	// NN_FUN does, on each file named on the command line in turn, or on the
+	// standard input if none is. The Go code of the spec may then be left
+	// out, and fmt and os are imported for the actions.
+	Main bool
+	// CustomError omits the Error() method.
+	CustomError bool
+	// Strict makes rules that can match the empty string errors rather than
+	// warnings.
+	Strict bool
+	// Warn is called for each warning about the spec. Warnings are dropped
+	// if it is nil.
+	Warn func(*Error)
+	// NoMinimize keeps the DFAs as the subset construction builds them,
+	// rather than merging equivalent states, which is handy for debugging.
+	NoMinimize bool
+	// If MaxStates is positive, rules whose DFA has more states draw a
+	// warning.
+	MaxStates int
+	// If Lazy is set, no DFA is built: the Go lexer holds the NFAs of the
+	// rules, and builds the states of the DFA of each family as it first
+	// reaches them. Generation then grows with the size of the regexes
+	// rather than of their DFAs, but DFADot, DFAMermaid, MaxStates,
+	// ShardSize and the shadowing warnings have no DFA to work on,
+	// Program.DFAs returns nil, and Program.WriteFamilyDot and the json
+	// backend fail with ErrLazy.
+	Lazy bool
+	// ByteMode makes the Go lexer read bytes rather than UTF-8 encoded runes:
+	// the runes of the regexes stand for bytes, and must be below 256, and
+	// Column counts bytes. It is also set by %option bytemode in the spec.
+	ByteMode bool
+	// Caseless makes the rules match their runes and classes in any case,
+	// as if [Aa] were written for a, by the simple case folding of Unicode.
+	// Negated classes exclude every case of their runes. It is also set by
+	// %option caseless in the spec.
+	Caseless bool
+	// NoNewline makes negated classes match no newline, as if \n were
+	// listed in each, so that a rule like /"[^"]*"/ stops at the end of the
+	// line of an unterminated string rather than eating the rest of the
+	// input. It is also set by %option nonewline in the spec.
+	NoNewline bool
+	// BOL makes ^ match at the start of every line, as the ^ prefix of a
+	// flex rule does, rather than only at the start of the input: the Go
+	// lexer starts a match after a newline as it starts the input. Matches
+	// of the Go side, such as Tokenize, follow suit. It is also set by
+	// %option bol in the spec.
+	BOL bool
+	// Interactive makes the Go lexer end a match as soon as no longer one can
+	// follow, rather than on reading the rune after it, so that lexing a REPL
+	// or a network protocol never waits for input the current token does not
+	// need. It is also set by %option interactive in the spec.
+	Interactive bool
+	// InvalidUTF8 is what the Go lexer does with input that is not valid
+	// UTF-8: "replace" reads each invalid byte as U+FFFD, like ReadRune;
+	// "error" stops lexing at it, Lexer.Err then returning an
+	// *InvalidUTF8Error; "rule" passes each invalid byte, as the text of a
+	// token, to the %invalid action of the spec, which no other rule can
+	// match it. The default is "rule" if the spec has a %invalid action, and
+	// "replace" otherwise. It does not apply in byte mode.
+	InvalidUTF8 string
+	// BOM makes the Go lexer skip a byte order mark at the start of its
+	// input: "utf8" skips the UTF-8 one, as Windows editors write, and
+	// "utf16" also reads input starting with a UTF-16 one as UTF-16, in the
+	// byte order it gives. The default, "", skips nothing. It does not apply
+	// in byte mode.
+	BOM string
+	// CRLF makes the Go lexer read the line breaks "\r\n" of its input as
+	// "\n", so that the rules, Line and Column see Windows and Unix text
+	// alike. Offsets then count each "\r\n" as one byte. Split still sees
+	// the input as it is.
+	CRLF bool
+	// BufferSize is the size of the bufio.Reader NewLexer reads its input
+	// through, unless it is already one. The default is 4096 bytes, as for
+	// bufio.NewReader.
+	BufferSize int
+	// Pool adds to the Go lexer a Reset method, and GetLexer and PutLexer
+	// functions that reuse lexers through a sync.Pool.
+	Pool bool
+	// Split adds to the Go lexer a Split function returning a
+	// bufio.SplitFunc, which splits the input of a bufio.Scanner into the
+	// matches of the outermost rules without running their actions.
+	Split bool
+	// Incremental adds to the Go lexer a Tokens function lexing a string into
+	// the matches of the outermost rules without running their actions, and
+	// a Relex function updating these tokens after an edit of the string,
+	// lexing again only those the edit can change, for editors re-lexing a
+	// document on each keystroke.
+	Incremental bool
+	// Parallel adds to the Go lexer a ParallelTokens function lexing a string
+	// into the matches of the outermost rules, without running their
+	// actions, in chunks on concurrent goroutines, for inputs too large for
+	// a single one.
+	Parallel bool
+	// Semantic adds to the Go lexer a SemanticTokens function returning the
+	// LSP semantic tokens of a document, their types and modifiers being
+	// given by /*semantic:type.modifier...*/ comments in the actions of the
+	// rules, and the legend of these from SemanticTokenTypes and
+	// SemanticTokenModifiers.
+	Semantic bool
+	// Participle adds to the Go lexer ParticipleLexer, returning a
+	// lexer.Definition for parsers built with
+	// github.com/alecthomas/participle/v2, whose tokens are the matches of
+	// the rules whose actions have a /*participle:Type*/ comment, of the
+	// symbol Type. Actions are not run.
+	Participle bool
+	// Dump makes the Go output a program of its own, in package main,
+	// printing the matches of the rules in its standard input as JSON
+	// objects, one per line, rather than a lexer running the actions: the Go
+	// code of the spec is left out.
+	Dump bool
+	// Filter makes the Go output a program of its own, in package main,
+	// copying its standard input to its standard output with each match of
+	// the rules replaced by the string its action returns, or by nothing if
+	// it returns none. Text no rule matches is copied as it is. The Go code
+	// of the spec is kept, and must not declare main.
+	Filter bool
+	// Fast writes the transitions of the Go lexer as full tables, indexed by
+	// state and rune class, rather than compressing them the way lex does.
+	// The lexer then takes a single lookup per rune, but its tables, and the
+	// source and binary holding them, can be many times larger.
+	Fast bool
+	// If Tokens is not nil, it lists the tokens of the goyacc grammar the
+	// lexer feeds, as ParseTokens returns them, and a rule returning an
+	// identifier spelt like a token, in capitals, that is neither one of them
+	// nor declared by the Go code of the spec is an error. The Go lexer then
+	// gets a TokenString function naming them.
+	Tokens []string
+	// If ShardSize is positive and WriteShard is set, the transitions of the
+	// outermost family are written to separate table files of at most
+	// ShardSize distinct rows of transitions each. They are never
+	// compressed.
+	// WriteShard receives the gofmt'ed source of the n-th file, counting
+	// from 1.
+	ShardSize  int
+	WriteShard func(n int, src []byte) error
+	// SourceMap marks the action of each rule in the Go lexer with comments,
+	// from which Program.SourceMap finds the lines holding it.
+	SourceMap bool
+	// Stamp, if not empty, is written to the Go lexer as a comment line
+	// after the header marking it generated, e.g. to record what it was
+	// generated from.
+	Stamp string
+	// Stats receives a table of the automaton sizes of each rule.
+	Stats io.Writer
+	// Report receives a summary of each family: its rules, the states of
+	// their DFAs before and after minimization, the states and rune classes
+	// of the family's combined DFA and the size of the code written for it,
+	// followed by the rules with the largest DFAs.
+	Report io.Writer
+	// HTML receives a self-contained page for reviewing the spec: the rules
+	// of each family, linked to drawings of their NFAs and DFAs laid out by
+	// the browser, and the summary written to Report.
+	HTML io.Writer
+	// NFADot and DFADot receive the NFA and DFA of each rule in DOT format,
+	// and NFAMermaid and DFAMermaid as Mermaid state diagrams. DFADot also
+	// receives the combined automaton of each family.
+	NFADot, DFADot         io.Writer
+	NFAMermaid, DFAMermaid io.Writer
+	// Dot controls how the graphs written to NFADot and DFADot are drawn.
+	Dot DotOptions
+	// Templates holds *.tmpl files redefining the templates that write the
+	// skeleton of the lexer, for custom runtimes. See templates/lexer.tmpl
+	// for the built-in ones.
+	Templates fs.FS
+}
+
+// A generator holds the state of the generation of one lexer.
+type generator struct {
+	opts        Options
+	filename    string
+	rep         *strings.Replacer // Applies the prefix.
+	invalid     string            // Options.InvalidUTF8, "" for "replace".
+	invalidCode string            // The %invalid action.
+	semantic    *semanticData     // Set by Options.Semantic.
+	participle  *participleData   // Set by Options.Participle.
+	families    []familyData      // The families, if the spec has %family blocks.
+	eof         bool              // Some family has a %eof action.
+	defs        map[string]*Regex // The regexes of the %define lines.
+	stats       []ruleStats
+	nfas        map[*rule]*NFA    // The NFAs of the rules, kept for Options.HTML.
+	ruleIndex   map[*rule]int     // The numbers of the rules, for Options.SourceMap.
+	pkgNames    map[string]string // The names of lexerPackages in the generated code.
+}
+
+func newGenerator(opts Options) *generator {
+	g := &generator{opts: opts, filename: opts.Filename, rep: strings.NewReplacer(), nfas: make(map[*rule]*NFA)}
+	if g.filename == "" {
+		g.filename = "<stdin>"
+	}
+	if opts.Prefix != "" {
+		g.rep = strings.NewReplacer("yy", opts.Prefix)
+	}
+	return g
+}
+
+// warn reports a warning at a position in the spec.
+func (g *generator) warn(line, col int, code, msg string) {
+	if g.opts.Warn != nil {
+		g.opts.Warn(&Error{g.filename, line, col, code, errors.New(msg)})
+	}
+}
+
+// A Program is a compiled spec: the DFAs of its rules, along with the Go
+// code surrounding the lexer.
+type Program struct {
+	g        *generator
+	root     rule
+	families []rule // The %family families, numbered from 1.
+	fset     *token.FileSet
+	file     *ast.File // The package clause and imports of the Go code.
+	code     string    // The rest of the Go code.
+}
+
+// Compile parses the spec read from src and builds the DFAs of its rules.
+// Errors in the spec are of type *Error.
+func Compile(src io.Reader, opts Options) (*Program, error) {
+	g := newGenerator(opts)
+	sp, err := ParseSpec(src, g.filename)
+	if err != nil {
+		return nil, err
+	}
+	return g.compile(sp)
+}
+
+// CompileSpec builds the DFAs of the rules of a parsed spec. Errors in the
+// spec are of type *Error.
+func CompileSpec(sp *Spec, opts Options) (*Program, error) {
+	return newGenerator(opts).compile(sp)
+}
+
+// newRule converts a rule of a spec, and the rules nested in it, to the form
+// the generator works on.
+func newRule(r *Rule) *rule {
+	x := &rule{
+		regex:      []rune(r.Regex),
+		code:       r.Action,
+		startCode:  r.StartAction,
+		endCode:    r.EndAction,
+		eofCode:    r.EOFAction,
+		id:         fmt.Sprint(r.ActionLine),
+		actionLine: r.ActionLine,
+		line:       r.Line,
+		col:        r.Col,
+	}
+	if r.Token != "" {
+		x.code = typedAction(r)
+	}
+	for _, kid := range byPriority(r.Rules) {
+		x.kid = append(x.kid, newRule(kid))
+	}
+	return x
+}
+
+// byPriority returns the rules of a family in the order they take
+// precedence: by decreasing priority, and as written among equal priorities.
+// The generated lexer numbers the rules in this order.
+func byPriority(rules []*Rule) []*Rule {
+	res := append([]*Rule(nil), rules...)
+	sort.SliceStable(res, func(a, b int) bool { return res[a].Priority > res[b].Priority })
+	return res
+}
+
+// compile builds the DFAs of the rules of a parsed spec.
+func (g *generator) compile(sp *Spec) (p *Program, err error) {
+	// Regex syntax errors are raised by panicking.
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(error)
+			if !ok {
+				panic(x)
+			}
+			err = e
+		}
+	}()
+	if g.opts.Main && (!g.opts.Standalone || g.opts.Filter || g.opts.Dump) {
+		return nil, errors.New("Main needs Standalone, and cannot be used with Filter or Dump")
+	}
+	if !g.lexerData().Lex {
+		rules := sp.Rules
+		for _, f := range sp.Families {
+			rules = append(rules[:len(rules):len(rules)], f.Rules...)
+		}
+		if r := typedRule(rules); r != nil {
+			return nil, &Error{g.filename, r.Line, r.Col, "type", errors.New("%type needs the Lex method, so cannot be used with Standalone, Filter or Dump")}
+		}
+	}
+	root := rule{startCode: sp.StartAction, endCode: sp.EndAction, eofCode: sp.EOFAction}
+	for _, r := range byPriority(sp.Rules) {
+		root.kid = append(root.kid, newRule(r))
+	}
+	var families []rule
+	g.families = []familyData{{"", 0}}
+	first := len(root.kid)
+	for _, f := range sp.Families {
+		fam := rule{eofCode: f.EOFAction}
+		for _, r := range byPriority(f.Rules) {
+			fam.kid = append(fam.kid, newRule(r))
+		}
+		families = append(families, fam)
+		g.families = append(g.families, familyData{f.Name, first})
+		first += len(fam.kid)
+	}
+	if len(families) == 0 {
+		g.families = nil
+	}
+	buf := []rune(sp.Code)
+	if g.opts.Main && strings.TrimSpace(sp.Code) == "" {
+		buf = []rune("package main\n")
+	}
+	codeLine, codeCol := sp.CodeLine, sp.CodeCol
+	fs := token.NewFileSet()
+	// Append a blank line to make things easier when there are only package and
+	// import declarations.
+	t, err := parser.ParseFile(fs, "", string(buf)+"\n", parser.ImportsOnly)
+	if err != nil {
+		if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+			// Report the position in the spec rather than in the code.
+			pos := list[0].Pos
+			if pos.Line == 1 {
+				pos.Column += codeCol - 1
+			}
+			return nil, &Error{g.filename, codeLine + pos.Line - 1, pos.Column, "code", errors.New(list[0].Msg)}
+		}
+		return nil, err
+	}
+	if g.opts.Dump {
+		g.pkgNames = packageNames(&ast.File{})
+	} else if f, _ := parser.ParseFile(token.NewFileSet(), "", string(buf), 0); f != nil {
+		g.pkgNames = packageNames(f)
+	} else {
+		g.pkgNames = packageNames(t)
+	}
+
+	var file *token.File
+	fs.Iterate(func(f *token.File) bool {
+		file = f
+		return true
+	})
+
+	// Skip over package and import declarations. This is why we appended a blank
+	// line above.
+	for m := file.LineCount(); m > 1; m-- {
+		i := 0
+		for '\n' != buf[i] {
+			i++
+		}
+		buf = buf[i+1:]
+	}
+
+	for _, name := range sp.Options {
+		switch name {
+		case "bytemode":
+			g.opts.ByteMode = true
+		case "bol":
+			g.opts.BOL = true
+		case "caseless":
+			g.opts.Caseless = true
+		case "interactive":
+			g.opts.Interactive = true
+		case "nonewline":
+			g.opts.NoNewline = true
+		}
+	}
+	if g.defs, err = parseDefines(specDefines(sp), g.filename); err != nil {
+		return nil, err
+	}
+	switch g.invalid = g.opts.InvalidUTF8; g.invalid {
+	case "":
+		if sp.InvalidAction != "" {
+			g.invalid = "rule"
+		}
+	case "replace":
+		g.invalid = ""
+	case "error", "rule":
+	default:
+		return nil, fmt.Errorf("unknown invalid UTF-8 policy %q", g.invalid)
+	}
+	if g.invalid == "rule" && sp.InvalidAction == "" {
+		return nil, ErrNoInvalidAction
+	}
+	switch g.opts.BOM {
+	case "", "utf8", "utf16":
+	default:
+		return nil, fmt.Errorf("unknown byte order mark handling %q", g.opts.BOM)
+	}
+	if g.opts.ByteMode {
+		g.invalid, g.opts.BOM = "", ""
+	}
+	g.invalidCode = sp.InvalidAction
+	if g.opts.Tokens != nil {
+		rules := sp.Rules
+		for _, f := range sp.Families {
+			rules = append(rules[:len(rules):len(rules)], f.Rules...)
+		}
+		if err := g.checkTokens(rules, sp.Code); err != nil {
+			return nil, err
+		}
+	}
+	all := root.kid
+	for _, fam := range families {
+		all = append(all[:len(all):len(all)], fam.kid...)
+		g.eof = g.eof || fam.eofCode != ""
+	}
+	g.eof = g.eof || root.eofCode != "" || hasEOF(all)
+	g.compileRules(all)
+	if g.opts.Semantic {
+		g.semantic = semantic(&root)
+	}
+	if g.opts.Participle {
+		g.participle = participle(&root)
+	}
+	if g.opts.DFADot != nil && !g.opts.Lazy {
+		writeFamilyDots(g.opts.DFADot, &root, "FAMILY", g.opts.Dot)
+	}
+	for _, fam := range append([]rule{root}, families...) {
+		if !g.opts.Lazy {
+			g.warnShadowed(&fam)
+		}
+		if err := g.checkNullable(&fam); err != nil {
+			return nil, err
+		}
+		if g.opts.MaxStates > 0 && !g.opts.Lazy {
+			g.warnLarge(&fam)
+		}
+	}
+	if g.opts.Stats != nil {
+		g.writeStats(g.opts.Stats)
+	}
+	// The summaries name the families, the outermost one being unnamed.
+	fams, names := append([]rule{root}, families...), []string{"(outermost)"}
+	for _, f := range sp.Families {
+		names = append(names, f.Name)
+	}
+	if g.opts.Report != nil {
+		g.writeReport(g.opts.Report, fams, names)
+	}
+	if g.opts.HTML != nil {
+		if err := g.writeHTML(g.opts.HTML, fams, names); err != nil {
+			return nil, err
+		}
+	}
+	return &Program{g, root, families, fs, t, string(buf)}, nil
+}
+
+// codeRoot returns the outermost family, followed by the rules of the
+// %family families, as the code running the rules numbers them.
+func (p *Program) codeRoot() rule {
+	root := p.root
+	eof := false
+	for _, fam := range p.families {
+		root.kid = append(root.kid[:len(root.kid):len(root.kid)], fam.kid...)
+		eof = eof || fam.eofCode != ""
+	}
+	if eof {
+		// The %eof action is that of the family in use.
+		code := p.g.rep.Replace("switch yylex.Family() {\n")
+		for i, fam := range append([]rule{p.root}, p.families...) {
+			if fam.eofCode != "" {
+				code += fmt.Sprintf("case %d:\n%s\n", i, fam.eofCode)
+			}
+		}
+		root.eofCode = code + "}"
+	}
+	return root
+}
+
+// Package returns the name of the package of the Go code.
+func (p *Program) Package() string {
+	return p.file.Name.Name
+}
+
+// WriteGo writes the Go source of the lexer to dst. The output is not
+// gofmt'ed.
+func (p *Program) WriteGo(dst io.Writer) error {
+	g := p.g
+	t, err := g.templates()
+	if err != nil {
+		return err
+	}
+	if g.opts.SourceMap && g.ruleIndex == nil {
+		g.ruleIndex = make(map[*rule]int)
+		rules, _ := p.ruleList()
+		for i, x := range rules {
+			g.ruleIndex[x] = i
+		}
+	}
+	// The code following the imports is written first, to find the
+	// packages it uses.
+	var body bytes.Buffer
+	w := bufio.NewWriter(&body)
+	if err := p.writeBody(w, t); err != nil {
+		return err
+	}
+	w.Flush()
+	out := bufio.NewWriter(dst)
+	out.WriteString(generatedHeader())
+	if g.opts.Stamp != "" {
+		out.WriteString("// " + g.opts.Stamp + "\n\n")
+	}
+	if g.opts.Dump {
+		f := g.dumpFile()
+		g.addImports(f, g.usedPackages(body.Bytes()))
+		printer.Fprint(out, token.NewFileSet(), f)
+	} else {
+		g.addImports(p.file, g.usedPackages(body.Bytes()))
+		printer.Fprint(out, p.fset, p.file)
+	}
+	out.Write(body.Bytes())
+	return out.Flush()
+}
+
+// writeBody writes the Go source of the lexer following the package clause
+// and imports.
+func (p *Program) writeBody(out *bufio.Writer, t *template.Template) error {
+	g := p.g
+	if err := t.ExecuteTemplate(out, "lexer", g.lexerData()); err != nil {
+		return err
+	}
+
+	if g.opts.Lazy {
+		g.writeLazyFamily(out, p.root.kid)
+		out.WriteString("}\n")
+	} else if g.opts.ShardSize > 0 && g.opts.WriteShard != nil {
+		var rows [][]int
+		g.writeFamilyTable(out, p.root.kid, &rows)
+		out.WriteString("}\n")
+		if err := g.writeShards(out, p.file.Name.Name, rows); err != nil {
+			return err
+		}
+	} else {
+		g.writeFamilyTable(out, p.root.kid, nil)
+		out.WriteString("}\n")
+	}
+	if len(p.families) > 0 {
+		g.rep.WriteString(out, "yyModesVal = []*family{yyTablesVal,\n")
+		for _, fam := range p.families {
+			out.WriteString("&family{")
+			if g.opts.Lazy {
+				g.writeLazyFamily(out, fam.kid)
+			} else {
+				g.writeFamilyTable(out, fam.kid, nil)
+			}
+			out.WriteString("},\n")
+		}
+		out.WriteString("}\n")
+	}
+	if err := t.ExecuteTemplate(out, "methods", g.lexerData()); err != nil {
+		return err
+	}
+	if g.opts.Dump {
+		data := g.lexerData()
+		data.Body = dumpTable(&p.root)
+		if err := t.ExecuteTemplate(out, "dump", data); err != nil {
+			return err
+		}
+		return nil
+	}
+	buf := []rune(p.code)
+	if g.opts.Filter {
+		if err := g.executeFamily(out, t, "filter", p.codeRoot()); err != nil {
+			return err
+		}
+		out.WriteString(string(buf))
+		return nil
+	}
+	if !g.opts.Standalone {
+		if err := g.executeFamily(out, t, "lex", p.codeRoot()); err != nil {
+			return err
+		}
+		out.WriteString(string(buf))
+		return nil
+	}
+	m := 0
+	const funmac = "NN_FUN"
+	for m < len(buf) {
+		m++
+		if funmac[:m] != string(buf[:m]) {
+			out.WriteString(string(buf[:m]))
+			buf = buf[m:]
+			m = 0
+		} else if funmac == string(buf[:m]) {
+			if err := g.executeFamily(out, t, "nnfun", p.codeRoot()); err != nil {
+				return err
+			}
+			buf = buf[m:]
+			m = 0
+		}
+	}
+	out.WriteString(string(buf))
+	if g.opts.Main {
+		if err := g.executeFamily(out, t, "main", p.codeRoot()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generate compiles the spec read from src and writes the Go source of the
+// lexer to dst. Errors in the spec are of type *Error.
+func Generate(dst io.Writer, src io.Reader, opts Options) error {
+	p, err := Compile(src, opts)
+	if err != nil {
+		return err
+	}
+	return p.WriteGo(dst)
+}
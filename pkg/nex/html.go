@@ -0,0 +1,87 @@
+package nex
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"io"
+)
+
+//go:embed templates/report.html
+var reportHTML string
+
+// An htmlGraph is an automaton as the page of Options.HTML draws it. The
+// states are numbered from 0, the start state, in the order walkGraph visits
+// them.
+type htmlGraph struct {
+	Accept []bool     `json:"accept"`
+	Edges  []htmlEdge `json:"edges"`
+}
+
+type htmlEdge struct {
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Label string `json:"label"`
+}
+
+// htmlRule is a rule of the page of Options.HTML.
+type htmlRule struct {
+	ID     string     `json:"id"`
+	Family string     `json:"family"`
+	Depth  int        `json:"depth"` // Levels of nesting inside a rule of the family.
+	Regex  string     `json:"regex"`
+	Action string     `json:"action"`
+	NFA    *htmlGraph `json:"nfa"`
+	DFA    *htmlGraph `json:"dfa"` // Nil in lazy mode.
+}
+
+// newHTMLGraph describes the automaton starting at start.
+func newHTMLGraph(start *node) *htmlGraph {
+	g := &htmlGraph{}
+	index := make(map[*node]int)
+	walkGraph(start, func(u *node) {
+		if u.n != -1 {
+			index[u] = len(g.Accept)
+			g.Accept = append(g.Accept, u.accept)
+		}
+	}, func(*node, *edge) {})
+	walkGraph(start, func(*node) {}, func(u *node, e *edge) {
+		g.Edges = append(g.Edges, htmlEdge{index[u], index[e.dst], edgeLabel(e)})
+	})
+	return g
+}
+
+// writeHTML writes the page of Options.HTML for the given families, named by
+// names.
+func (g *generator) writeHTML(w io.Writer, families []rule, names []string) error {
+	t, err := template.New("report").Parse(reportHTML)
+	if err != nil {
+		return err
+	}
+	var report bytes.Buffer
+	g.writeReport(&report, families, names)
+	var rules []htmlRule
+	var walk func(name string, depth int, kids []*rule)
+	walk = func(name string, depth int, kids []*rule) {
+		for _, x := range kids {
+			r := htmlRule{ID: x.id, Family: name, Depth: depth, Regex: string(x.regex), Action: x.code}
+			if nfa := g.nfas[x]; nfa != nil {
+				r.NFA = newHTMLGraph(nfa.states[0])
+			}
+			if x.dfa != nil {
+				r.DFA = newHTMLGraph(x.dfa)
+			}
+			rules = append(rules, r)
+			walk(name, depth+1, x.kid)
+		}
+	}
+	for i, fam := range families {
+		walk(names[i], 0, fam.kid)
+	}
+	return t.Execute(w, struct {
+		File     string
+		Families []string
+		Rules    []htmlRule
+		Report   string
+	}{g.filename, names, rules, report.String()})
+}
@@ -0,0 +1,149 @@
+package nex
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lexerPackages lists the packages the templates may use. The generated code
+// imports those it refers to.
+var lexerPackages = []string{"bufio", "encoding/json", "fmt", "go/token", "io", "os", "runtime", "strconv", "strings", "sync", "text/scanner", "unicode/utf8", "unsafe", participleImport}
+
+// packageNames returns the names the generated code refers to the packages of
+// lexerPackages by, given f, the Go code of the spec. A package f imports is
+// referred to by the name f gives it. Otherwise its own name is used, unless
+// f declares that name or imports another package under it, in which case
+// the name is prefixed with "nex".
+func packageNames(f *ast.File) map[string]string {
+	names := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, spec := range f.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := path.Base(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+		taken[name] = true
+		if _, ok := names[p]; !ok {
+			names[p] = name
+		}
+	}
+	if f.Scope != nil {
+		for name := range f.Scope.Objects {
+			taken[name] = true
+		}
+	}
+	for _, p := range lexerPackages {
+		if _, ok := names[p]; ok {
+			continue
+		}
+		name := path.Base(p)
+		local := name
+		for i := 1; taken[local]; i++ {
+			local = "nex" + strings.ToUpper(name[:1]) + name[1:]
+			if i > 1 {
+				local += strconv.Itoa(i)
+			}
+		}
+		taken[local] = true
+		names[p] = local
+	}
+	return names
+}
+
+// renamePackages rewrites the references of the template src to the packages
+// of lexerPackages to use the names of g.pkgNames.
+func (g *generator) renamePackages(src string) string {
+	for _, p := range lexerPackages {
+		name, local := path.Base(p), g.pkgNames[p]
+		if local == "" || local == name {
+			continue
+		}
+		re := regexp.MustCompile(`(^|[^.\w])` + name + `\.`)
+		src = re.ReplaceAllString(src, "${1}"+local+".")
+	}
+	return src
+}
+
+// usedPackages returns the packages of lexerPackages that src, the generated
+// code following the imports, refers to, in order.
+func (g *generator) usedPackages(src []byte) []string {
+	byName := make(map[string]string)
+	for _, p := range lexerPackages {
+		byName[g.pkgNames[p]] = p
+	}
+	used := make(map[string]bool)
+	f, err := parser.ParseFile(token.NewFileSet(), "", append([]byte("package p\n"), src...), 0)
+	if err != nil {
+		// gofmt reports the error; import whatever seems used meanwhile.
+		for name, p := range byName {
+			used[p] = used[p] || bytes.Contains(src, []byte(name+"."))
+		}
+	} else {
+		for _, id := range f.Unresolved {
+			if p, ok := byName[id.Name]; ok {
+				used[p] = true
+			}
+		}
+	}
+	var paths []string
+	for p, ok := range used {
+		if ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// addImports adds the given packages to the import declarations of f, under
+// the names of g.pkgNames, unless f already imports them under any name. This
+// avoids duplicate imports when the user's code needs the same packages as
+// the lexer.
+func (g *generator) addImports(f *ast.File, paths []string) {
+	have := make(map[string]bool)
+	for _, spec := range f.Imports {
+		if spec.Name == nil || spec.Name.Name != "_" && spec.Name.Name != "." {
+			p, err := strconv.Unquote(spec.Path.Value)
+			if err == nil {
+				have[p] = true
+			}
+		}
+	}
+	var decl *ast.GenDecl
+	for _, d := range f.Decls {
+		if g, ok := d.(*ast.GenDecl); ok && g.Tok == token.IMPORT {
+			decl = g
+			break
+		}
+	}
+	if decl == nil {
+		decl = &ast.GenDecl{Tok: token.IMPORT}
+		f.Decls = append([]ast.Decl{decl}, f.Decls...)
+	}
+	for _, p := range paths {
+		if have[p] {
+			continue
+		}
+		spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(p)}}
+		if local := g.pkgNames[p]; local != path.Base(p) {
+			spec.Name = ast.NewIdent(local)
+		}
+		decl.Specs = append(decl.Specs, spec)
+		f.Imports = append(f.Imports, spec)
+		have[p] = true
+	}
+}
@@ -0,0 +1,89 @@
+package nex
+
+import "sort"
+
+// An intervalSet gathers ranges of runes, given as pairs of inclusive limits,
+// to merge or split them all at once: adding ranges costs no more than
+// appending them, and the work is done in O(n log n) when the result is
+// asked for. Merging ranges added in sorted order, as those of Unicode range
+// tables are, takes O(n).
+type intervalSet struct {
+	ranges []rune
+	sorted bool // Whether the lower limits of ranges are in order.
+}
+
+func newIntervalSet() *intervalSet {
+	return &intervalSet{sorted: true}
+}
+
+// add adds ranges, given as pairs of inclusive limits.
+func (s *intervalSet) add(ranges ...rune) *intervalSet {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if n := len(s.ranges); n > 0 && ranges[i] < s.ranges[n-2] {
+			s.sorted = false
+		}
+		s.ranges = append(s.ranges, ranges[i], ranges[i+1])
+	}
+	return s
+}
+
+// sort sorts the ranges by lower limit.
+func (s *intervalSet) sort() {
+	if s.sorted {
+		return
+	}
+	pairs := make([][2]rune, len(s.ranges)/2)
+	for i := range pairs {
+		pairs[i] = [2]rune{s.ranges[2*i], s.ranges[2*i+1]}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	for i, p := range pairs {
+		s.ranges[2*i], s.ranges[2*i+1] = p[0], p[1]
+	}
+	s.sorted = true
+}
+
+// union returns the runes of the set as sorted ranges, merging those that
+// overlap or touch.
+func (s *intervalSet) union() []rune {
+	s.sort()
+	var res []rune
+	for i := 0; i < len(s.ranges); i += 2 {
+		l, r := s.ranges[i], s.ranges[i+1]
+		if n := len(res); n > 0 && l <= res[n-1]+1 {
+			if r > res[n-1] {
+				res[n-1] = r
+			}
+			continue
+		}
+		res = append(res, l, r)
+	}
+	return res
+}
+
+// pieces returns the runes of the set split into sorted ranges at the limits
+// of every range added, so that each range added is a union of pieces.
+func (s *intervalSet) pieces() []rune {
+	// A piece starts at every lower limit and after every upper limit.
+	type event struct {
+		at    rune
+		delta int
+	}
+	var events []event
+	for i := 0; i < len(s.ranges); i += 2 {
+		events = append(events, event{s.ranges[i], 1}, event{s.ranges[i+1] + 1, -1})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].at < events[j].at })
+	var res []rune
+	depth := 0
+	for i := 0; i < len(events); {
+		at := events[i].at
+		for ; i < len(events) && events[i].at == at; i++ {
+			depth += events[i].delta
+		}
+		if depth > 0 && i < len(events) {
+			res = append(res, at, events[i].at-1)
+		}
+	}
+	return res
+}
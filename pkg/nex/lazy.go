@@ -0,0 +1,123 @@
+package nex
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+)
+
+// ErrLazy is returned by the methods of a Program compiled with
+// Options.Lazy that need the DFAs of its rules.
+var ErrLazy = errors.New("DFAs are not built in lazy mode")
+
+// reads reports whether an edge of an NFA can be taken on reading r.
+func reads(e *edge, r rune) bool {
+	switch e.kind {
+	case kRune:
+		return e.r == r
+	case kWild:
+		return true
+	case kClass:
+		return e.negate != inClass(r, e.lim)
+	}
+	return false
+}
+
+// writeLazyFamily emits the fields of a family for lazy mode: its rune
+// classes and the NFAs of its rules, numbered one after the other, from which
+// the lexer builds the states of its DFA.
+func (g *generator) writeLazyFamily(out *bufio.Writer, kids []*rule) {
+	var starts []*node
+	var edges []*edge
+	offset := make([]int, len(kids))
+	n := 0
+	for i, x := range kids {
+		offset[i] = n
+		n += len(x.nfa.states)
+		starts = append(starts, x.nfa.states[0])
+		for _, v := range x.nfa.states {
+			for _, e := range v.e {
+				if e.kind == kRune || e.kind == kWild || e.kind == kClass {
+					edges = append(edges, e)
+				}
+			}
+		}
+	}
+	// Runes the edges all read alike form a class.
+	alphabet := alphabetOf(starts)
+	class := make([]int, len(alphabet))
+	nclass := 1
+	for _, e := range edges {
+		class, nclass = refine(class, func(i int) int {
+			if reads(e, alphabet[i]) {
+				return 1
+			}
+			return 0
+		})
+	}
+	rc := mergeClasses(alphabet, class, nclass)
+	out.WriteString("classes: ")
+	g.writeClasses(out, rc)
+
+	var accept []int
+	fmt.Fprintf(out, ",\nnfa: &nfa{classes: %d, starts: ", nclass)
+	writeInts(out, offset)
+	for i, x := range kids {
+		for _, v := range x.nfa.states {
+			if v.accept {
+				accept = append(accept, i)
+			} else {
+				accept = append(accept, -1)
+			}
+		}
+	}
+	out.WriteString(",\naccept: ")
+	writeInts(out, accept)
+	for _, f := range []struct {
+		name string
+		kind int
+	}{{"eps", kNil}, {"begin", kStart}, {"end", kEnd}} {
+		fmt.Fprintf(out, ",\n%s: [][]int{\n", f.name)
+		for i, x := range kids {
+			for _, v := range x.nfa.states {
+				var dst []int
+				for _, e := range v.e {
+					if e.kind == f.kind {
+						dst = append(dst, offset[i]+e.dst.n)
+					}
+				}
+				writeInts(out, dst)
+				out.WriteString(",\n")
+			}
+		}
+		out.WriteString("}")
+	}
+	out.WriteString(",\nedges: [][]nfaEdge{\n")
+	for i, x := range kids {
+		for _, v := range x.nfa.states {
+			out.WriteString("{")
+			for _, e := range v.e {
+				if !(e.kind == kRune || e.kind == kWild || e.kind == kClass) {
+					continue
+				}
+				// The classes of the runes read, in order.
+				in := make([]bool, nclass)
+				for k, r := range alphabet {
+					in[class[k]] = in[class[k]] || reads(e, r)
+				}
+				var cs []int
+				for c, ok := range in {
+					if ok {
+						cs = append(cs, c)
+					}
+				}
+				fmt.Fprintf(out, "{%d, ", offset[i]+e.dst.n)
+				writeInts(out, cs)
+				out.WriteString("}, ")
+			}
+			out.WriteString("},\n")
+		}
+	}
+	out.WriteString("}},\nnest: ")
+	writeNest(out, kids, func(kids []*rule) { g.writeLazyFamily(out, kids) })
+}
@@ -0,0 +1,32 @@
+package nex
+
+// octet matches a decimal number from 0 to 255, without leading zeros.
+const octet = `(25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])`
+
+// libraries holds the definitions %use lines bring in, by library name, as
+// %define lines would give them.
+var libraries = map[string][][2]string{
+	"core": {
+		{"C_IDENT", `[A-Za-z_][A-Za-z0-9_]*`},
+		{"DEC_INT", `0|[1-9][0-9]*`},
+		{"HEX_INT", `0[xX][0-9a-fA-F]+`},
+		{"FLOAT", `([0-9]+\.[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?|[0-9]+[eE][+-]?[0-9]+`},
+		{"DQ_STRING", `"([^"\\\n]|\\[^\n])*"`},
+		{"LINE_COMMENT", `//[^\n]*`},
+		{"BLOCK_COMMENT", `/\*([^*]|\*+[^*/])*\*+/`},
+		{"ISO8601", `[0-9]{4}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])(T([01][0-9]|2[0-3]):[0-5][0-9](:([0-5][0-9]|60)(\.[0-9]+)?)?(Z|[+-]([01][0-9]|2[0-3]):?[0-5][0-9])?)?`},
+		{"IPV4", octet + `(\.` + octet + `){3}`},
+	},
+}
+
+// specDefines returns the definitions of the libraries a spec uses,
+// followed by its own.
+func specDefines(sp *Spec) []*Define {
+	var defines []*Define
+	for _, name := range sp.Uses {
+		for _, d := range libraries[name] {
+			defines = append(defines, &Define{Name: d[0], Regex: d[1]})
+		}
+	}
+	return append(defines, sp.Defines...)
+}
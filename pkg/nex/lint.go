@@ -0,0 +1,37 @@
+package nex
+
+import "sort"
+
+// DefaultMaxStates is the size past which Lint reports a DFA as oversized,
+// unless Options.MaxStates says otherwise.
+const DefaultMaxStates = 1000
+
+// Lint checks a spec for rules that are probably mistakes: rules that can
+// never fire because earlier rules shadow or duplicate them, rules matching
+// no string at all, rules that can match the empty string, and rules whose DFA
+// is oversized. It returns the problems found, ordered by position, with codes
+// "shadowed", "duplicate", "never-matches", "empty-match" and "large-dfa".
+// If the spec does not compile, it returns the error instead, which is not a
+// problem of the kind Lint looks for but a failure. Options.Warn and
+// Options.Strict are ignored.
+func Lint(sp *Spec, opts Options) ([]*Error, error) {
+	var found []*Error
+	opts.Warn = func(e *Error) {
+		found = append(found, e)
+	}
+	opts.Strict = false
+	if opts.MaxStates <= 0 {
+		opts.MaxStates = DefaultMaxStates
+	}
+	g := newGenerator(opts)
+	if _, err := g.compile(sp); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Line != found[j].Line {
+			return found[i].Line < found[j].Line
+		}
+		return found[i].Col < found[j].Col
+	})
+	return found, nil
+}
@@ -0,0 +1,151 @@
+package nex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// A Machine lexes input with a list of regexes interpreted at runtime, for
+// programs whose rules are only known when they run, such as log parsers
+// configured by their users. It uses the same DFAs as a generated lexer, so
+// it finds the same matches, but runs no actions.
+type Machine struct {
+	root rule
+}
+
+// CompileMachine builds the DFAs of the given rules, regexes written without
+// delimiters. It is not named Compile, which compiles specs. As in a spec,
+// the longest match wins, and the earliest rule wins ties. Errors in a rule
+// are of type *Error, with the number of the rule, counting from 1, as the
+// line, and 1 plus the offset in the rule as the column. Rules whose automata
+// would be too large, such as nested counts, are errors too.
+func CompileMachine(rules []string) (m *Machine, err error) {
+	// Regex syntax errors are raised by panicking.
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*Error)
+			if !ok {
+				panic(x)
+			}
+			m, err = nil, e
+		}
+	}()
+	g := newGenerator(Options{Filename: "<machine>"})
+	m = new(Machine)
+	for i, s := range rules {
+		x := &rule{regex: []rune(s), id: fmt.Sprint(i + 1), line: i + 1}
+		m.root.kid = append(m.root.kid, x)
+	}
+	g.compileRules(m.root.kid)
+	return m, nil
+}
+
+// A Match is a piece of input matched by a regex of a Machine, or a rune that
+// no regex matched.
+type Match struct {
+	Rule int // Index of the regex, or -1 if none matched.
+	Text string
+	Line int // Line of the start of the text, counting from 0.
+	Col  int // Column of the start of the text in runes, counting from 0.
+}
+
+// A Scanner splits the input read from an io.Reader into matches. Its
+// interface follows bufio.Scanner:
+//
+//	s := m.Scanner(r)
+//	for s.Scan() {
+//		fmt.Println(s.Match())
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+//
+// The input is read no further ahead than the DFAs need to find the longest
+// match.
+type Scanner struct {
+	m         *Machine
+	in        io.RuneReader
+	buf       []rune // Input read but not yet matched.
+	eof       bool
+	err       error
+	done      bool
+	atStart   bool
+	line, col int
+	match     Match
+}
+
+// Scanner returns a Scanner reading from r.
+func (m *Machine) Scanner(r io.Reader) *Scanner {
+	in, ok := r.(io.RuneReader)
+	if !ok {
+		in = bufio.NewReader(r)
+	}
+	return &Scanner{m: m, in: in, atStart: true}
+}
+
+// at returns the n-th rune of the unmatched input, reading more if needed.
+func (s *Scanner) at(n int) (rune, bool) {
+	for n >= len(s.buf) && !s.eof {
+		r, _, err := s.in.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			s.eof = true
+			break
+		}
+		s.buf = append(s.buf, r)
+	}
+	if n < len(s.buf) {
+		return s.buf[n], true
+	}
+	return 0, false
+}
+
+// Scan advances to the next match, which is then available through Match. It
+// returns false at the end of the input or on an error. As in the generated
+// lexer, a regex only matches the empty string through ^ at the start of the
+// input, or $ at its end, and then once.
+func (s *Scanner) Scan() bool {
+	if s.done {
+		return false
+	}
+	i, n := longestMatch(&s.m.root, s.at, s.atStart)
+	s.atStart = false
+	if s.err != nil {
+		s.done = true
+		return false
+	}
+	switch {
+	case n == -1 && len(s.buf) == 0:
+		s.done = true
+		return false
+	case n == -1:
+		i, n = -1, 1
+	case n == 0 && len(s.buf) == 0:
+		// An empty match at the end of the input is reported once.
+		s.done = true
+	}
+	s.match = Match{Rule: i, Text: string(s.buf[:n]), Line: s.line, Col: s.col}
+	for _, r := range s.buf[:n] {
+		if r == '\n' {
+			s.line++
+			s.col = 0
+		} else {
+			s.col++
+		}
+	}
+	s.buf = s.buf[n:]
+	return true
+}
+
+// Match returns the match found by the last call to Scan.
+func (s *Scanner) Match() Match {
+	return s.match
+}
+
+// Err returns the first error met by the Scanner, other than io.EOF.
+func (s *Scanner) Err() error {
+	return s.err
+}
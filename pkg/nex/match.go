@@ -0,0 +1,149 @@
+package nex
+
+import "errors"
+
+// longestMatch runs the DFAs of a family in parallel over the input as the
+// generated scanner does, and returns the index of the rule with the longest
+// match, the earliest rule winning ties, along with the match length. The
+// length is -1 if no rule matches. The input is read through at, which
+// returns the n-th rune, or false at the end of the input; it is called with
+// increasing n, and no further than the DFAs need. The ^ transitions are only
+// followed when atStart is set.
+func longestMatch(family *rule, at func(n int) (rune, bool), atStart bool) (int, int) {
+	type state struct {
+		i int
+		v *node
+	}
+	matchi, matchn := 0, -1
+	n := 0
+	checkAccept := func(s state) {
+		if s.v.accept && (matchn < n || matchi > s.i) {
+			matchi, matchn = s.i, n
+		}
+	}
+	// follow appends the states reached from s by repeatedly taking edges of
+	// the given kind, which is kStart or kEnd.
+	follow := func(states []state, s state, kind int) []state {
+		mark := make(map[*node]bool)
+		for !mark[s.v] {
+			mark[s.v] = true
+			var dst *node
+			for _, e := range s.v.e {
+				if e.kind == kind && e.dst.n != -1 {
+					dst = e.dst
+				}
+			}
+			if dst == nil {
+				break
+			}
+			s.v = dst
+			checkAccept(s)
+			states = append(states, s)
+		}
+		return states
+	}
+	var states []state
+	for i, x := range family.kid {
+		s := state{i, x.dfa}
+		states = append(states, s)
+		if atStart {
+			states = follow(states, s, kStart)
+		}
+	}
+	for len(states) > 0 {
+		r, ok := at(n)
+		if !ok {
+			break
+		}
+		n++
+		var next []state
+		for _, s := range states {
+			if s.v = step(s.v, r); s.v != nil {
+				next = append(next, s)
+				checkAccept(s)
+			}
+		}
+		states = next
+	}
+	// Handle $.
+	for _, s := range states {
+		follow(nil, s, kEnd)
+	}
+	return matchi, matchn
+}
+
+// runesAt returns a function reading buf for longestMatch.
+func runesAt(buf []rune) func(int) (rune, bool) {
+	return func(n int) (rune, bool) {
+		if n < len(buf) {
+			return buf[n], true
+		}
+		return 0, false
+	}
+}
+
+// ErrEmptyLoop is returned by Tokenize when a rule matches the empty string
+// at a point where the generated lexer would loop forever.
+var ErrEmptyLoop = errors.New("empty match; the generated lexer would loop forever here")
+
+// lexFamily splits buf into tokens with the rules of a family, descending
+// into nested families, and calls emit for each token. Runes that no rule
+// matches are passed to emit with a nil rule. The offset of buf in the
+// input is given by col. If bol is set, ^ also matches after a newline.
+func lexFamily(family *rule, buf []rune, col, depth int, bol bool, emit func(x *rule, i int, text string, col, depth int)) error {
+	atStart := true
+	for {
+		i, n := longestMatch(family, runesAt(buf), atStart)
+		atStart = false
+		if n == -1 {
+			if len(buf) == 0 {
+				return nil
+			}
+			emit(nil, -1, string(buf[:1]), col, depth)
+			atStart = bol && buf[0] == '\n'
+			buf = buf[1:]
+			col++
+			continue
+		}
+		x := family.kid[i]
+		emit(x, i, string(buf[:n]), col, depth)
+		if len(x.kid) > 0 {
+			if err := lexFamily(x, buf[:n], col, depth+1, bol, emit); err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			if len(buf) == 0 {
+				return nil
+			}
+			return ErrEmptyLoop
+		}
+		atStart = bol && buf[n-1] == '\n'
+		buf = buf[n:]
+		col += n
+	}
+}
+
+// A Token is a piece of input matched by a rule, or a rune that no rule
+// matched.
+type Token struct {
+	Rule  int    // Index of the rule in its family, or -1 if none matched.
+	Line  int    // Spec line of the rule.
+	Regex string // Regex of the rule.
+	Text  string
+	Col   int // Offset of the text in the input, in runes.
+	Depth int // Nesting level of the family of the rule.
+}
+
+// Tokenize splits input into tokens as the generated lexer would, without
+// running any actions, and calls emit on each one. The tokens of a rule with
+// nested rules are followed by the tokens the nested rules find in its text.
+func (p *Program) Tokenize(input string, emit func(Token)) error {
+	return lexFamily(&p.root, []rune(input), 0, 0, p.g.opts.BOL, func(x *rule, i int, text string, col, depth int) {
+		t := Token{Rule: i, Text: text, Col: col, Depth: depth}
+		if x != nil {
+			t.Line, t.Regex = x.line, string(x.regex)
+		}
+		emit(t)
+	})
+}
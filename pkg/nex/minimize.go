@@ -0,0 +1,195 @@
+package nex
+
+// Minimize returns a DFA with the fewest states that accepts the same
+// strings as d, taking ^ and $ the same way. States from which no accepting
+// state can be reached are merged into the dead state. The states are
+// renumbered, with the start state still 0, and d is left unchanged.
+func Minimize(d *DFA) *DFA {
+	states := dfaStates(d.start)
+	n := len(states)
+	// Every state of a DFA built by Determinize has its edges in the same
+	// order, one per element of the alphabet. Index n stands for the dead
+	// state.
+	m := len(d.start.e)
+	dst := func(i, j int) int {
+		if i == n || states[i].e[j].dst.n == -1 {
+			return n
+		}
+		return states[i].e[j].dst.n
+	}
+	class := make([]int, n+1)
+	for i, v := range states {
+		if v.accept {
+			class[i] = 1
+		}
+	}
+	count := hopcroft(n+1, m, dst, class)
+
+	dead := &node{n: -1}
+	nodes := make([]*node, count)
+	for i := 0; i < n; i++ {
+		// The start state must exist even if nothing is ever accepted.
+		if (i == 0 || class[i] != class[n]) && nodes[class[i]] == nil {
+			nodes[class[i]] = new(node)
+		}
+	}
+	target := func(c int) *node {
+		if c == class[n] {
+			return dead
+		}
+		return nodes[c]
+	}
+	start := nodes[class[0]]
+	done := make([]bool, count)
+	for i, v := range states {
+		u := nodes[class[i]]
+		if u == nil || done[class[i]] {
+			continue
+		}
+		done[class[i]] = true
+		u.accept = v.accept
+		for j, e := range v.e {
+			u.e = append(u.e, &edge{
+				kind:   e.kind,
+				r:      e.r,
+				lim:    append([]rune(nil), e.lim...),
+				negate: e.negate,
+				dst:    target(class[dst(i, j)]),
+			})
+		}
+	}
+	res := &DFA{start: start}
+	walkGraph(start, func(u *node) {
+		if u != dead {
+			u.n = res.n
+			res.n++
+		}
+	}, func(*node, *edge) {})
+	return res
+}
+
+// Equivalent reports whether two DFAs accept the same strings, taking ^ and
+// $ the same way.
+func Equivalent(a, b *DFA) bool {
+	alphabet := alphabetOf([]*node{a.start, b.start})
+	type pair [2]*node
+	seen := map[pair]bool{{a.start, b.start}: true}
+	todo := []pair{{a.start, b.start}}
+	for len(todo) > 0 {
+		p := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if (p[0] != nil && p[0].accept) != (p[1] != nil && p[1].accept) {
+			return false
+		}
+		var next []pair
+		for _, r := range alphabet {
+			next = append(next, pair{step(p[0], r), step(p[1], r)})
+		}
+		for _, kind := range []int{kStart, kEnd} {
+			next = append(next, pair{stepAnchor(p[0], kind), stepAnchor(p[1], kind)})
+		}
+		for _, q := range next {
+			if !seen[q] {
+				seen[q] = true
+				todo = append(todo, q)
+			}
+		}
+	}
+	return true
+}
+
+// hopcroft refines a partition of the states 0 to n-1 of an automaton until
+// states in the same block go to the same blocks on each of the m symbols,
+// dst(i, j) being the state i goes to on symbol j. On entry, class holds the
+// block of each state, as any ints; on return it holds the refined blocks,
+// numbered from 0, and the number of blocks is returned.
+func hopcroft(n, m int, dst func(i, j int) int, class []int) int {
+	// pred[j][t] lists the states going to t on symbol j.
+	pred := make([][][]int, m)
+	for j := range pred {
+		pred[j] = make([][]int, n)
+		for i := 0; i < n; i++ {
+			t := dst(i, j)
+			pred[j][t] = append(pred[j][t], i)
+		}
+	}
+	var blocks [][]int
+	ids := make(map[int]int)
+	for i, c := range class {
+		b, ok := ids[c]
+		if !ok {
+			b = len(blocks)
+			ids[c] = b
+			blocks = append(blocks, nil)
+		}
+		blocks[b] = append(blocks[b], i)
+		class[i] = b
+	}
+	// The work list holds the splitters: pairs of a block and a symbol. All
+	// the blocks but the largest start on it, and only the smaller half of a
+	// split block needs to be added.
+	type splitter struct{ b, j int }
+	var work []splitter
+	largest := 0
+	for b := range blocks {
+		if len(blocks[b]) > len(blocks[largest]) {
+			largest = b
+		}
+	}
+	for b := range blocks {
+		if b == largest {
+			continue
+		}
+		for j := 0; j < m; j++ {
+			work = append(work, splitter{b, j})
+		}
+	}
+	marked := make([]bool, n)
+	for len(work) > 0 {
+		sp := work[len(work)-1]
+		work = work[:len(work)-1]
+		// Mark the states going into the block, and the blocks they are in.
+		var touched, seen []int
+		hits := make(map[int]int)
+		for _, t := range blocks[sp.b] {
+			for _, i := range pred[sp.j][t] {
+				if !marked[i] {
+					marked[i] = true
+					seen = append(seen, i)
+					if hits[class[i]] == 0 {
+						touched = append(touched, class[i])
+					}
+					hits[class[i]]++
+				}
+			}
+		}
+		for _, b := range touched {
+			if hits[b] < len(blocks[b]) {
+				var in, out []int
+				for _, i := range blocks[b] {
+					if marked[i] {
+						in = append(in, i)
+					} else {
+						out = append(out, i)
+					}
+				}
+				if len(in) > len(out) {
+					in, out = out, in
+				}
+				blocks[b] = out
+				nb := len(blocks)
+				blocks = append(blocks, in)
+				for _, i := range in {
+					class[i] = nb
+				}
+				for j := 0; j < m; j++ {
+					work = append(work, splitter{nb, j})
+				}
+			}
+		}
+		for _, i := range seen {
+			marked[i] = false
+		}
+	}
+	return len(blocks)
+}
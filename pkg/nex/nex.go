@@ -0,0 +1,1102 @@
+// Substantial copy-and-paste from src/pkg/regexp.
+package nex
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+import (
+	"go/parser"
+	"go/scanner"
+	"go/token"
+)
+
+type rule struct {
+	regex      []rune
+	code       string
+	startCode  string
+	endCode    string
+	eofCode    string // Run when the input of the family of kid runs out.
+	kid        []*rule
+	id         string
+	line, col  int   // Position of the opening delimiter of the regex.
+	actionLine int   // Line of the action.
+	dfa        *node // Start state of the DFA built by compileRule().
+	nfa        *NFA  // The NFA of the regex, kept instead in lazy mode.
+	nullable   bool  // True if the regex matches the empty string.
+}
+
+var (
+	ErrInternal            = errors.New("internal error")
+	ErrUnmatchedLpar       = errors.New("unmatched '('")
+	ErrUnmatchedRpar       = errors.New("unmatched ')'")
+	ErrUnmatchedLbkt       = errors.New("unmatched '['")
+	ErrUnmatchedRbkt       = errors.New("unmatched ']'")
+	ErrBadRange            = errors.New("bad range in character class")
+	ErrExtraneousBackslash = errors.New("extraneous backslash")
+	ErrBareClosure         = errors.New("closure applies to nothing")
+	ErrBadBackslash        = errors.New("illegal backslash escape")
+	ErrExpectedLBrace      = errors.New("expected '{'")
+	ErrUnmatchedLBrace     = errors.New("unmatched '{'")
+	ErrUnexpectedEOF       = errors.New("unexpected EOF")
+	ErrUnexpectedNewline   = errors.New("unexpected newline")
+	ErrUnexpectedLAngle    = errors.New("unexpected '<'")
+	ErrUnmatchedLAngle     = errors.New("unmatched '<'")
+	ErrUnmatchedRAngle     = errors.New("unmatched '>'")
+	ErrUnknownOption       = errors.New("unknown option")
+	ErrBadFamily           = errors.New("expected family name followed by '<'")
+	ErrDuplicateFamily     = errors.New("duplicate family")
+	ErrDuplicateEOF        = errors.New("duplicate %eof action")
+	ErrBadPriority         = errors.New("expected integer after %priority")
+	ErrBadType             = errors.New("expected token, then optionally field and function, after %type")
+	ErrBadRepeat           = errors.New("bad repetition count")
+	ErrRegexTooLarge       = errors.New("regex too large once repetitions are expanded")
+	ErrUnknownClass        = errors.New("unknown Unicode class")
+	ErrUnknownPOSIXClass   = errors.New("unknown POSIX class")
+	ErrBadCollating        = errors.New("collating element is not a single rune")
+	ErrUndefinedName       = errors.New("undefined definition")
+	ErrBadDefine           = errors.New("expected name and regex after %define")
+	ErrDuplicateDefine     = errors.New("duplicate definition")
+	ErrUnknownLibrary      = errors.New("unknown library")
+	ErrNotByte             = errors.New("rune above 255 in byte mode")
+	ErrNoInvalidAction     = errors.New(`invalid UTF-8 policy "rule" needs a %invalid action`)
+)
+
+// An Error is an error at a position in a spec. The code classifies it, e.g.
+// "syntax", "regex" or "action".
+type Error struct {
+	File      string
+	Line, Col int
+	Code      string
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Col, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func ispunct(c rune) bool {
+	for _, r := range "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~" {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
+
+var escapes = []rune("abfnrtv")
+var escaped = []rune("\a\b\f\n\r\t\v")
+
+func escape(c rune) rune {
+	for i, b := range escapes {
+		if b == c {
+			return escaped[i]
+		}
+	}
+	return -1
+}
+
+const (
+	kNil = iota
+	kRune
+	kClass
+	kWild
+	kStart
+	kEnd
+)
+
+type edge struct {
+	kind   int    // Rune/Class/Wild/Nil.
+	r      rune   // Rune for rune edges.
+	lim    []rune // Pairs of limits for character class edges.
+	negate bool   // True if the character class is negated.
+	dst    *node  // Destination node.
+}
+type node struct {
+	e      edges // Outedges.
+	n      int   // Index number. Scoped to a family.
+	accept bool  // True if this is an accepting state.
+	set    []int // The NFA nodes represented by a DFA node.
+}
+
+type edges []*edge
+
+func (e edges) Len() int {
+	return len(e)
+}
+func (e edges) Less(i, j int) bool {
+	return e[i].r < e[j].r
+}
+
+func (e edges) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+type runeSlice []rune
+
+func (p runeSlice) Len() int           { return len(p) }
+func (p runeSlice) Less(i, j int) bool { return p[i] < p[j] }
+func (p runeSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// walkGraph calls nodeFn on every node reachable from start, and edgeFn on
+// each of its out-edges. Edges to the dead end node of a DFA are skipped.
+func walkGraph(start *node, nodeFn func(*node), edgeFn func(u *node, e *edge)) {
+	done := make(map[*node]bool)
+	show := func(u *node) {
+		nodeFn(u)
+		done[u] = true
+		for _, e := range u.e {
+			// We use -1 to denote the dead end node in DFAs.
+			if e.dst.n == -1 {
+				continue
+			}
+			edgeFn(u, e)
+		}
+	}
+	// The nodes are visited depth first, in the order of their edges. The
+	// stack holds the nodes being visited, with the next edge to follow, as
+	// machine-generated patterns can nest too deep for recursion.
+	type frame struct {
+		u *node
+		i int
+	}
+	show(start)
+	stack := []frame{{start, 0}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.i == len(f.u.e) {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		v := f.u.e[f.i].dst
+		f.i++
+		if !done[v] {
+			show(v)
+			stack = append(stack, frame{v, 0})
+		}
+	}
+}
+
+func runeToDot(r rune) string {
+	if strconv.IsPrint(r) {
+		return fmt.Sprintf("%v", string(r))
+	}
+	return fmt.Sprintf("U+%X", int(r))
+}
+
+// classLabel describes the character class of a class edge, e.g. "[^a-z_]".
+func classLabel(e *edge) string {
+	label := "["
+	if e.negate {
+		label += "^"
+	}
+	for i := 0; i < len(e.lim); i += 2 {
+		label += runeToDot(e.lim[i])
+		if e.lim[i] != e.lim[i+1] {
+			label += "-" + runeToDot(e.lim[i+1])
+		}
+	}
+	return label + "]"
+}
+
+// Print a graph in DOT format given the start node.
+//
+//  $ dot -Tps input.dot -o output.ps
+func writeDotGraph(outf io.Writer, start *node, id string, opts DotOptions) {
+	opts.writeHeader(outf, id)
+	walkGraph(start, func(u *node) {
+		if u.accept {
+			fmt.Fprintf(outf, "  %v[style=filled,color=%v];\n", u.n, opts.acceptColor(-1))
+		}
+	}, func(u *node, e *edge) {
+		label := ""
+		switch e.kind {
+		case kRune:
+			label = fmt.Sprintf("[label=%q]", runeToDot(e.r))
+		case kWild:
+			label = "[color=blue]"
+		case kClass:
+			label = "[label=\"" + classLabel(e) + "\"]"
+		}
+		if opts.NoLabels && e.kind != kWild {
+			label = ""
+		}
+		fmt.Fprintf(outf, "  %v -> %v%v;\n", u.n, e.dst.n, label)
+	})
+	fmt.Fprintln(outf, "}")
+}
+
+// mermaidEscape replaces characters that Mermaid treats specially in
+// transition labels with entity codes.
+func mermaidEscape(s string) string {
+	var out []rune
+	for _, r := range s {
+		if strings.ContainsRune(" \"#:;<>{}", r) {
+			out = append(out, []rune(fmt.Sprintf("#%d;", r))...)
+		} else {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+// Print a graph as a composite state of a Mermaid state diagram given the
+// start node. The caller writes the "stateDiagram-v2" header.
+func writeMermaidGraph(outf io.Writer, start *node, id string) {
+	fmt.Fprintf(outf, "  state %v {\n    [*] --> %v_0\n", id, id)
+	walkGraph(start, func(u *node) {
+		if u.accept {
+			fmt.Fprintf(outf, "    %v_%v --> [*]\n", id, u.n)
+		}
+	}, func(u *node, e *edge) {
+		fmt.Fprintf(outf, "    %v_%v --> %v_%v : %v\n", id, u.n, id, e.dst.n, mermaidEscape(edgeLabel(e)))
+	})
+	fmt.Fprintln(outf, "  }")
+}
+
+// edgeLabel returns the label of a transition in the graphs that label them
+// all: the rune or class taken on, "." for the wild edge, "ε" for empty
+// transitions, and "^" or "$" for the start and end of the input.
+func edgeLabel(e *edge) string {
+	switch e.kind {
+	case kRune:
+		return runeToDot(e.r)
+	case kWild:
+		return "."
+	case kClass:
+		return classLabel(e)
+	case kNil:
+		return "ε"
+	case kStart:
+		return "^"
+	case kEnd:
+		return "$"
+	}
+	return ""
+}
+
+// inClass reports whether r is in one of the ranges of lim, which are sorted
+// and disjoint, as those of the edges of automata are.
+func inClass(r rune, lim []rune) bool {
+	// Find the first range ending at or after r.
+	i, j := 0, len(lim)/2
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if lim[2*h+1] < r {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i < len(lim)/2 && lim[2*i] <= r
+}
+
+// compileRule builds the DFA of a rule, and of the rules nested in it, or
+// only their NFAs in lazy mode.
+func (g *generator) compileRule(x *rule) {
+	g.compileRules([]*rule{x})
+}
+
+// automata holds what buildAutomata makes of the regex of a rule.
+type automata struct {
+	nfa    *NFA
+	dfa    *DFA // Nil in lazy mode.
+	subset int  // Number of states of the DFA before minimization.
+	err    *Error
+}
+
+// buildAutomata builds the automata of a rule, touching nothing shared, so
+// that rules can be built in parallel.
+func (g *generator) buildAutomata(x *rule) automata {
+	re, pos, err := parseRegex(x.regex, g.defs)
+	if err != nil {
+		return automata{err: &Error{g.filename, x.line, x.col + 1 + pos, "regex", err}}
+	}
+	if g.opts.ByteMode {
+		if r := maxRune(re); r > 255 {
+			pos := 0
+			for pos < len(x.regex) && x.regex[pos] != r {
+				pos++
+			}
+			return automata{err: &Error{g.filename, x.line, x.col + 1 + pos, "regex", fmt.Errorf("%w: %q", ErrNotByte, r)}}
+		}
+	}
+	if g.opts.Caseless {
+		max := rune(unicode.MaxRune)
+		if g.opts.ByteMode {
+			max = 255
+		}
+		re = foldCase(re, max)
+	}
+	if g.opts.NoNewline {
+		re = excludeNewline(re)
+	}
+	a := automata{nfa: BuildNFA(re)}
+	if !g.opts.Lazy {
+		a.dfa = Determinize(a.nfa)
+		a.subset = a.dfa.n
+		if !g.opts.NoMinimize {
+			a.dfa = Minimize(a.dfa)
+		}
+	}
+	return a
+}
+
+// compileRules does the work of compileRule for several rules. The automata
+// of all the rules, nested or not, are built by GOMAXPROCS workers, while the
+// graphs, statistics and errors are written in the order of the rules in the
+// spec, so the output does not depend on scheduling.
+func (g *generator) compileRules(rules []*rule) {
+	var all []*rule
+	var collect func([]*rule)
+	collect = func(rules []*rule) {
+		for _, x := range rules {
+			all = append(all, x)
+			collect(x.kid)
+		}
+	}
+	collect(rules)
+	built := make([]automata, len(all))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0) && w < len(all); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				built[i] = g.buildAutomata(all[i])
+			}
+		}()
+	}
+	for i := range all {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, x := range all {
+		a := built[i]
+		if a.err != nil {
+			panic(a.err)
+		}
+		nfa := a.nfa
+		x.nullable = nfa.nullable
+		if g.opts.NFADot != nil {
+			writeDotGraph(g.opts.NFADot, nfa.states[0], "NFA_"+x.id, g.opts.Dot)
+		}
+		if g.opts.NFAMermaid != nil {
+			writeMermaidGraph(g.opts.NFAMermaid, nfa.states[0], "NFA_"+x.id)
+		}
+		if g.opts.HTML != nil {
+			g.nfas[x] = nfa
+		}
+		if g.opts.Lazy {
+			g.stats = append(g.stats, ruleStats{x, len(nfa.states), 0, 0, nfa.alphabetSize()})
+			x.nfa = nfa
+			continue
+		}
+		dfa := a.dfa
+		g.stats = append(g.stats, ruleStats{x, len(nfa.states), dfa.n, a.subset, nfa.alphabetSize()})
+
+		x.dfa = dfa.start
+		if g.opts.DFADot != nil {
+			writeDotGraph(g.opts.DFADot, dfa.start, "DFA_"+x.id, g.opts.Dot)
+		}
+		if g.opts.DFAMermaid != nil {
+			writeMermaidGraph(g.opts.DFAMermaid, dfa.start, "DFA_"+x.id)
+		}
+	}
+}
+
+// dfaStates returns the states of a DFA other than the dead state, indexed
+// by number.
+func dfaStates(start *node) []*node {
+	var sorted []*node
+	walkGraph(start, func(u *node) {
+		if u.n < 0 {
+			return
+		}
+		for len(sorted) <= u.n {
+			sorted = append(sorted, nil)
+		}
+		sorted[u.n] = u
+	}, func(*node, *edge) {})
+	return sorted
+}
+
+// writeFamilyTable emits the table of a family: the classes of its runes,
+// the product of the DFAs of its rules, and the families nested in them. If
+// rows is nil, all the transitions are written, compressed unless
+// Options.Fast is set; otherwise they are left for shards, and rows receives
+// them.
+func (g *generator) writeFamilyTable(out *bufio.Writer, kids []*rule, rows *[][]int) {
+	f := g.combine(kids)
+	g.writeClasses(out, f.rc)
+	out.WriteString(", ")
+	writeInts(out, f.acc)
+	out.WriteString(", ")
+	writeInts(out, f.endAcc)
+	comb := rows == nil && !g.opts.Fast
+	if rows != nil {
+		*rows = f.next
+		out.WriteString(", nil")
+	} else if comb {
+		out.WriteString(", nil")
+	} else {
+		// Identical rows of transitions, common among states that can only
+		// fail or fall back to the same states, are written once.
+		distinct, row := dedupRows(f.next)
+		out.WriteString(", unpackRows([][]int{  // Transitions\n")
+		for _, r := range distinct {
+			writeInts(out, r)
+			out.WriteString(",\n")
+		}
+		out.WriteString("}, ")
+		writeInts(out, row)
+		out.WriteString(")")
+	}
+	fmt.Fprintf(out, ", %d, %d, ", f.begin, f.beginAcc)
+	writeNest(out, kids, func(kids []*rule) { g.writeFamilyTable(out, kids, nil) })
+	out.WriteString(", ")
+	if comb {
+		writeComb(out, compress(f.next))
+	} else {
+		out.WriteString("nil")
+	}
+	if g.opts.Interactive {
+		out.WriteString(", ")
+		writeBools(out, f.stops())
+	}
+}
+
+// writeNest emits the families nested in the rules of a family, the fields
+// of each being written by `write`.
+func writeNest(out *bufio.Writer, kids []*rule, write func([]*rule)) {
+	writeNested(out, kids, "family", write)
+}
+
+// writeNested emits the values of type *typ describing the families nested
+// in the rules of a family, the fields of each being written by `write`.
+func writeNested(out *bufio.Writer, kids []*rule, typ string, write func([]*rule)) {
+	if !hasNest(kids) {
+		out.WriteString("nil")
+		return
+	}
+	fmt.Fprintf(out, "[]*%s{\n", typ)
+	for _, x := range kids {
+		if len(x.kid) == 0 {
+			out.WriteString("nil,\n")
+			continue
+		}
+		fmt.Fprintf(out, "// %v\n&%s{", string(x.regex), typ)
+		write(x.kid)
+		out.WriteString("},\n")
+	}
+	out.WriteString("}")
+}
+
+// writeInts emits a literal of type []int.
+func writeInts(out *bufio.Writer, v []int) {
+	out.WriteString("[]int{")
+	for i, n := range v {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprint(out, n)
+	}
+	out.WriteString("}")
+}
+
+func writeBools(out *bufio.Writer, v []bool) {
+	out.WriteString("[]bool{")
+	for i, b := range v {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprint(out, b)
+	}
+	out.WriteString("}")
+}
+
+// dedupRows returns the distinct rows of next, in order of appearance, and
+// the index among them of each row of next.
+func dedupRows(next [][]int) (rows [][]int, index []int) {
+	seen := make(map[string]int)
+	for _, r := range next {
+		k := fmt.Sprint(r)
+		i, ok := seen[k]
+		if !ok {
+			i = len(rows)
+			seen[k] = i
+			rows = append(rows, r)
+		}
+		index = append(index, i)
+	}
+	return rows, index
+}
+
+// writeClasses emits the classMap of rune classes.
+func (g *generator) writeClasses(out *bufio.Writer, rc *runeClasses) {
+	out.WriteString("newClassMap([]rune{")
+	for i, r := range rc.lo {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprint(out, r)
+	}
+	out.WriteString("}, []int{")
+	for i, c := range rc.class {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprint(out, c)
+	}
+	out.WriteString("})")
+}
+
+func (g *generator) writeFamily(out *bufio.Writer, node *rule, lvl int) {
+	tab := func() {
+		for i := 0; i <= lvl; i++ {
+			out.WriteByte('\t')
+		}
+	}
+	if node.startCode != "" {
+		tab()
+		g.rep.WriteString(out, "if !yylex.stale {\n")
+		tab()
+		out.WriteString("\t" + node.startCode + "\n")
+		tab()
+		out.WriteString("}\n")
+	}
+	tab()
+	fmt.Fprintf(out, "OUTER%s%d:\n", node.id, lvl)
+	tab()
+	g.rep.WriteString(out,
+		fmt.Sprintf("for { switch yylex.next(%v) {\n", lvl))
+	for i, x := range node.kid {
+		tab()
+		fmt.Fprintf(out, "\tcase %d:\n", i)
+		lvl++
+		if x.kid != nil {
+			g.writeFamily(out, x, lvl)
+		} else if i, ok := g.ruleIndex[x]; ok {
+			// Marked for Program.SourceMap.
+			tab()
+			fmt.Fprintf(out, "\t%s%d\n", actionMark, i)
+			tab()
+			out.WriteString("\t" + x.code + "\n")
+			tab()
+			out.WriteString("\t" + endMark + "\n")
+		} else {
+			tab()
+			out.WriteString("\t" + x.code + "\n")
+		}
+		lvl--
+	}
+	if lvl == 0 && g.invalid == "rule" {
+		// Invalid bytes, which only the outermost scan reads.
+		out.WriteString("\tcase -2:\n")
+		out.WriteString("\t" + g.invalidCode + "\n")
+	}
+	if g.opts.Filter {
+		// Text no rule matches, which filters copy.
+		tab()
+		out.WriteString("\tcase -3:\n")
+		tab()
+		g.rep.WriteString(out, "\t\treturn yylex.Text()\n")
+	}
+	tab()
+	out.WriteString("\tdefault:\n")
+	tab()
+	fmt.Fprintf(out, "\t\t break OUTER%s%d\n", node.id, lvl)
+	tab()
+	out.WriteString("\t}\n")
+	tab()
+	out.WriteString("\tcontinue\n")
+	tab()
+	out.WriteString("}\n")
+	if node.eofCode != "" {
+		// The frame ending the input is marked as seen, so that the action
+		// runs once even if it returns.
+		tab()
+		g.rep.WriteString(out, fmt.Sprintf("if yylex.stack[%d].i == -1 {\n", lvl))
+		tab()
+		g.rep.WriteString(out, fmt.Sprintf("\tyylex.stack[%d].i = -4\n", lvl))
+		tab()
+		out.WriteString("\t" + node.eofCode + "\n")
+		tab()
+		out.WriteString("}\n")
+	}
+	tab()
+	g.rep.WriteString(out, "yylex.pop()\n")
+	tab()
+	out.WriteString(node.endCode + "\n")
+}
+
+// specOptions lists the names %option lines accept.
+var specOptions = map[string]bool{
+	"bol":         true, // Options.BOL.
+	"bytemode":    true, // Options.ByteMode.
+	"caseless":    true, // Options.Caseless.
+	"interactive": true, // Options.Interactive.
+	"nonewline":   true, // Options.NoNewline.
+}
+
+// A Spec is the syntax tree of a spec, as returned by ParseSpec.
+type Spec struct {
+	Options       []string  // Names given on %option lines.
+	Uses          []string  // Libraries named on %use lines.
+	Defines       []*Define // The %define lines, in order.
+	InvalidAction string    // The %invalid action, run on invalid UTF-8.
+	Rules         []*Rule   // The outermost family.
+	StartAction   string    // The '<' action before the outermost family, if any.
+	EndAction     string    // The '>' action after it.
+	EOFAction     string    // The %eof action of the outermost family.
+	Families      []*Family // The %family blocks, in order.
+	Code          string    // The Go code following the rules.
+	CodeLine      int       // Position of the code in the file.
+	CodeCol       int
+}
+
+// A Define is a %define line, naming a regex that rules, and the
+// definitions that follow, write {Name} for.
+type Define struct {
+	Name, Regex string
+	Line, Col   int // Position of the regex.
+}
+
+// A Rule is a rule of a spec. Actions are Go blocks, braces included.
+// Positions are used in errors and warnings, and the line of the action also
+// names the rule in the generated code.
+type Rule struct {
+	Regex       string  // Without delimiters.
+	Action      string  // Run on a match, for rules without nested rules.
+	StartAction string  // The '<' action of a rule with nested rules.
+	EndAction   string  // The '>' action of a rule with nested rules.
+	EOFAction   string  // The %eof action of the nested rules, if any.
+	Rules       []*Rule // The nested family, if any.
+	Priority    int     // Set by %priority; higher wins ties, 0 by default.
+	Token       string  // Set by %type: returned after the action, if any.
+	Field       string  // Set by %type: the field of lval the text is stored in.
+	Convert     string  // Set by %type: the function converting the text first.
+	Line, Col   int     // Position of the opening delimiter of the regex.
+	ActionLine  int     // Line of the action, or of the '<' action.
+}
+
+// A Family is a family of rules declared with %family, which actions switch
+// the lexing of the rest of the input to with PushFamily.
+type Family struct {
+	Name      string
+	Rules     []*Rule
+	EOFAction string
+	Line, Col int // Position of the '%'.
+}
+
+// ParseSpec reads a spec, named filename in errors. Action code is checked
+// for syntax errors. Errors are of type *Error.
+func ParseSpec(input io.Reader, filename string) (sp *Spec, err error) {
+	// lineno and colno give the position of the last rune read. A newline
+	// ends its line, the line count going up only with the rune after it.
+	lineno, colno := 1, 0
+	newline := false
+	// Errors are raised by panicking. Those lacking a position occurred at
+	// the last rune read.
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(error)
+			if !ok {
+				panic(x)
+			}
+			if _, ok := e.(*Error); !ok {
+				e = &Error{filename, lineno, colno, "syntax", e}
+			}
+			err = e
+		}
+	}()
+	in := bufio.NewReader(input)
+	var r rune
+	read := func() bool {
+		var err error
+		r, _, err = in.ReadRune()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			panic(err)
+		}
+		if newline {
+			lineno++
+			colno = 0
+		}
+		newline = r == '\n'
+		colno++
+		return false
+	}
+	// directive reports whether the '%' read is followed by the name, as a
+	// whole word.
+	directive := func(name string) bool {
+		b, _ := in.Peek(len(name) + 1)
+		if len(b) < len(name) || string(b[:len(name)]) != name {
+			return false
+		}
+		return len(b) == len(name) || !unicode.IsLetter(rune(b[len(name)]))
+	}
+	skipws := func() bool {
+		for !read() {
+			if strings.IndexRune(" \n\t\r", r) == -1 {
+				return false
+			}
+		}
+		return true
+	}
+	var buf []rune
+	// readCode reads an action, and checks it parses as a Go block. The
+	// argument describes the action in error messages.
+	readCode := func(what string) string {
+		if '{' != r {
+			panic(ErrExpectedLBrace)
+		}
+		line, col := lineno, colno
+		buf = []rune{r}
+		nesting := 1
+		for {
+			if read() {
+				panic(&Error{filename, line, col, "syntax", ErrUnmatchedLBrace})
+			}
+			buf = append(buf, r)
+			if '{' == r {
+				nesting++
+			} else if '}' == r {
+				nesting--
+				if 0 == nesting {
+					break
+				}
+			}
+		}
+		if err := checkAction(string(buf), filename, line, col); err != nil {
+			err.Err = fmt.Errorf("%s: %v", what, err.Err)
+			panic(err)
+		}
+		return string(buf)
+	}
+	var root Rule
+	var options []string
+	var uses []string
+	var defines []*Define
+	var invalid string
+	var families []*Family
+	// The rules of a family are parsed as nested rules of a rule that has
+	// no actions.
+	isFamily := make(map[*Rule]bool)
+	needRootRAngle := false
+	var parse func(*Rule) error
+	parse = func(node *Rule) error {
+		for {
+			panicIf(skipws, ErrUnexpectedEOF)
+			// Any family can have a %eof action, run when its input runs
+			// out.
+			if '%' == r {
+				if directive("eof") {
+					line, col := lineno, colno
+					for i := 0; i < len("eof"); i++ {
+						read()
+					}
+					panicIf(skipws, ErrUnexpectedEOF)
+					if node.EOFAction != "" {
+						panic(&Error{filename, line, col, "syntax", ErrDuplicateEOF})
+					}
+					node.EOFAction = readCode("%eof action")
+					continue
+				}
+			}
+			if '%' == r && node == &root {
+				if directive("family") {
+					line, col := lineno, colno
+					for i := 0; i < len("family"); i++ {
+						read()
+					}
+					panicIf(skipws, ErrUnexpectedEOF)
+					var name []rune
+					for r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) && len(name) > 0 {
+						name = append(name, r)
+						panicIf(read, ErrUnexpectedEOF)
+					}
+					if strings.IndexRune(" \n\t\r", r) != -1 {
+						panicIf(skipws, ErrUnexpectedEOF)
+					}
+					if len(name) == 0 || r != '<' {
+						panic(ErrBadFamily)
+					}
+					for _, f := range families {
+						if f.Name == string(name) {
+							panic(&Error{filename, line, col, "syntax", fmt.Errorf("%w %s", ErrDuplicateFamily, string(name))})
+						}
+					}
+					x := &Rule{}
+					isFamily[x] = true
+					if err := parse(x); err != nil {
+						return err
+					}
+					families = append(families, &Family{string(name), x.Rules, x.EOFAction, line, col})
+					continue
+				}
+			}
+			// %option, %use and %define lines, as in lex, and the
+			// %invalid action can only come first.
+			if '%' == r && node == &root && len(node.Rules) == 0 && !needRootRAngle {
+				if directive("invalid") {
+					for i := 0; i < len("invalid"); i++ {
+						read()
+					}
+					panicIf(skipws, ErrUnexpectedEOF)
+					invalid = readCode("%invalid action")
+					continue
+				}
+				if directive("option") {
+					line, col := lineno, colno
+					var text []rune
+					for !read() && r != '\n' {
+						text = append(text, r)
+					}
+					for _, name := range strings.Fields(string(text[len("option"):])) {
+						if !specOptions[name] {
+							panic(&Error{filename, line, col, "syntax", fmt.Errorf("%w %q", ErrUnknownOption, name)})
+						}
+						options = append(options, name)
+					}
+					continue
+				}
+				if directive("use") {
+					line, col := lineno, colno
+					var text []rune
+					for !read() && r != '\n' {
+						text = append(text, r)
+					}
+					for _, name := range strings.Fields(string(text[len("use"):])) {
+						if libraries[name] == nil {
+							panic(&Error{filename, line, col, "syntax", fmt.Errorf("%w %q", ErrUnknownLibrary, name)})
+						}
+						uses = append(uses, name)
+					}
+					continue
+				}
+				if directive("define") {
+					line, col := lineno, colno
+					var text []rune
+					for !read() && r != '\n' {
+						text = append(text, r)
+					}
+					// The name is followed by the regex, without delimiters,
+					// up to the end of the line.
+					i := len("define")
+					for i < len(text) && unicode.IsSpace(text[i]) {
+						i++
+					}
+					j := i
+					for j < len(text) && !unicode.IsSpace(text[j]) {
+						j++
+					}
+					name := string(text[i:j])
+					for j < len(text) && unicode.IsSpace(text[j]) {
+						j++
+					}
+					regex := strings.TrimRightFunc(string(text[j:]), unicode.IsSpace)
+					if !isName(name) || regex == "" {
+						panic(&Error{filename, line, col, "syntax", ErrBadDefine})
+					}
+					for _, d := range defines {
+						if d.Name == name {
+							panic(&Error{filename, line, col, "syntax", fmt.Errorf("%w %s", ErrDuplicateDefine, name)})
+						}
+					}
+					defines = append(defines, &Define{name, regex, line, col + 1 + j})
+					continue
+				}
+			}
+			if '<' == r {
+				if node != &root || len(node.Rules) > 0 {
+					panic(ErrUnexpectedLAngle)
+				}
+				panicIf(skipws, ErrUnexpectedEOF)
+				node.StartAction = readCode("'<' action")
+				needRootRAngle = true
+				continue
+			} else if '>' == r {
+				if isFamily[node] {
+					return nil
+				}
+				if node == &root {
+					if !needRootRAngle {
+						panic(ErrUnmatchedRAngle)
+					}
+				}
+				if skipws() {
+					return ErrUnexpectedEOF
+				}
+				node.EndAction = readCode("'>' action")
+				return nil
+			}
+			delim := r
+			line, col := lineno, colno
+			panicIf(read, ErrUnexpectedEOF)
+			var regex []rune
+			for {
+				if r == delim && (len(regex) == 0 || regex[len(regex)-1] != '\\') {
+					break
+				}
+				if '\n' == r {
+					return ErrUnexpectedNewline
+				}
+				regex = append(regex, r)
+				panicIf(read, ErrUnexpectedEOF)
+			}
+			if "" == string(regex) {
+				break
+			}
+			panicIf(skipws, ErrUnexpectedEOF)
+			x := &Rule{Regex: string(regex), Line: line, Col: col}
+			// A %priority annotation between the regex and the action
+			// overrides the order of the rules when breaking ties. Any
+			// directive there but %type is taken for a misspelt one.
+			if '%' == r && !directive("type") {
+				line, col := lineno, colno
+				if !directive("priority") {
+					panic(&Error{filename, line, col, "syntax", ErrBadPriority})
+				}
+				for i := 0; i < len("priority"); i++ {
+					read()
+				}
+				panicIf(skipws, ErrUnexpectedEOF)
+				var num []rune
+				for r == '-' && len(num) == 0 || '0' <= r && r <= '9' {
+					num = append(num, r)
+					panicIf(read, ErrUnexpectedEOF)
+				}
+				n, err := strconv.Atoi(string(num))
+				if err != nil {
+					panic(&Error{filename, line, col, "syntax", ErrBadPriority})
+				}
+				x.Priority = n
+				if strings.IndexRune(" \n\t\r", r) != -1 {
+					panicIf(skipws, ErrUnexpectedEOF)
+				}
+			}
+			x.ActionLine = lineno
+			node.Rules = append(node.Rules, x)
+			// A %type annotation, up to the action or the end of the line,
+			// makes the rule store its text in lval and return a token, so
+			// that the action is optional.
+			if '%' == r {
+				if directive("type") {
+					for i := 0; i < len("type"); i++ {
+						read()
+					}
+					// The words are read one at a time, a rune literal
+					// whole, so that the token may be '{'.
+					var words []string
+					eof := read()
+					for !eof && r != '\n' && r != '{' {
+						if ' ' == r || '\t' == r || '\r' == r {
+							eof = read()
+							continue
+						}
+						var word []rune
+						if '\'' == r {
+							for {
+								word = append(word, r)
+								if eof = read(); eof || r == '\n' {
+									panic(ErrBadType)
+								}
+								if r == '\'' {
+									break
+								}
+								if r == '\\' {
+									word = append(word, r)
+									panicIf(read, ErrBadType)
+								}
+							}
+							word = append(word, r)
+							eof = read()
+						} else {
+							for !eof && strings.IndexRune(" \t\r\n{", r) == -1 {
+								word = append(word, r)
+								eof = read()
+							}
+						}
+						words = append(words, string(word))
+					}
+					if len(words) == 0 || len(words) > 3 || !isToken(words[0]) || len(words) > 1 && !isName(words[1]) || len(words) > 2 && !isFunc(words[2]) {
+						panic(ErrBadType)
+					}
+					words = append(words, "", "")
+					x.Token, x.Field, x.Convert = words[0], words[1], words[2]
+					if '{' != r {
+						// The action may still follow on the next line.
+						// Otherwise what follows is read again as the
+						// next rule.
+						panicIf(skipws, ErrUnexpectedEOF)
+						if '{' != r {
+							in.UnreadRune()
+							colno--
+							continue
+						}
+					}
+					x.ActionLine = lineno
+				}
+			}
+			if '<' == r {
+				panicIf(skipws, ErrUnexpectedEOF)
+				x.StartAction = readCode("'<' action of /" + string(regex) + "/")
+				parse(x)
+			} else {
+				x.Action = readCode("action of /" + string(regex) + "/")
+			}
+		}
+		return nil
+	}
+	if err := parse(&root); err != nil {
+		return nil, &Error{filename, lineno, colno, "syntax", err}
+	}
+
+	buf = nil
+	done := skipws()
+	codeLine, codeCol := lineno, colno
+	for ; !done; done = read() {
+		buf = append(buf, r)
+	}
+	return &Spec{options, uses, defines, invalid, root.Rules, root.StartAction, root.EndAction, root.EOFAction, families, string(buf), codeLine, codeCol}, nil
+}
+
+// checkAction parses the action `code`, which begins at the given line and
+// column of the spec, as a Go block. It returns the first syntax error found,
+// positioned in the spec.
+func checkAction(code, filename string, line, col int) *Error {
+	const prefix = "package p; func _() "
+	_, err := parser.ParseFile(token.NewFileSet(), "", prefix+code, 0)
+	list, ok := err.(scanner.ErrorList)
+	if !ok || len(list) == 0 {
+		return nil
+	}
+	pos := list[0].Pos
+	if pos.Line == 1 {
+		pos.Column += col - 1 - len(prefix)
+	}
+	return &Error{filename, line + pos.Line - 1, pos.Column, "action", errors.New(list[0].Msg)}
+}
+
+func panicIf(f func() bool, err error) {
+	if f() {
+		panic(err)
+	}
+}
@@ -0,0 +1,1237 @@
+package nex
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testinput = `
+/a|A/ { return A }
+//
+package main
+`
+
+func TestGenStable(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var out bytes.Buffer
+
+		Generate(&out, bytes.NewBufferString(testinput), Options{})
+		e := "a2755da702af9900ee97ef355daa032e"
+		if x := fmt.Sprintf("%x", md5.Sum(out.Bytes())); x != e {
+			t.Errorf("got: %s wanted: %s", x, e)
+		}
+	}
+}
+
+func TestNoDuplicateImports(t *testing.T) {
+	var out bytes.Buffer
+	err := Generate(&out, bytes.NewBufferString(`/a/ { }
+//
+package main
+import ("io"; s "strings")
+func token(s string) string { return s }
+`), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", out.Bytes(), parser.ImportsOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := make(map[string]int)
+	names := make(map[string]string)
+	for _, spec := range f.Imports {
+		count[spec.Path.Value]++
+		if spec.Name != nil {
+			names[spec.Path.Value] = spec.Name.Name
+		}
+	}
+	for _, path := range []string{`"bufio"`, `"io"`, `"strings"`, `"sync"`} {
+		if count[path] != 1 {
+			t.Errorf("%s imported %d times", path, count[path])
+		}
+	}
+	// The lexer refers to strings by the name the spec gives it, and to
+	// go/token by another name than that of the function token.
+	if names[`"strings"`] != "s" || !strings.Contains(out.String(), " s.Reader") {
+		t.Errorf("strings not referred to as s")
+	}
+	if names[`"go/token"`] != "nexToken" || !strings.Contains(out.String(), "*nexToken.File") {
+		t.Errorf("go/token not referred to as nexToken")
+	}
+	// Packages the generated code does not use are not imported.
+	out.Reset()
+	if err := Generate(&out, strings.NewReader("/a/ { }\n//\npackage main\n"), Options{Standalone: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `"strconv"`) || strings.Contains(out.String(), `"runtime"`) {
+		t.Errorf("unused packages imported:\n%s", out.String()[:200])
+	}
+}
+
+func TestLongestMatch(t *testing.T) {
+	family := &rule{}
+	for _, regex := range []string{"^a", "a+", "if", "[a-z]+", "b$"} {
+		x := &rule{regex: []rune(regex)}
+		newGenerator(Options{}).compileRule(x)
+		family.kid = append(family.kid, x)
+	}
+	for _, x := range []struct {
+		in      string
+		atStart bool
+		i, n    int
+	}{
+		{"a", true, 0, 1},
+		{"a", false, 1, 1},
+		{"aaa", true, 1, 3},
+		{"if", false, 2, 2},
+		{"iffy", false, 3, 4},
+		{"b", false, 3, 1},
+		{"b ", false, 3, 1},
+		{"0", false, 0, -1},
+	} {
+		i, n := longestMatch(family, runesAt([]rune(x.in)), x.atStart)
+		if n != x.n || n != -1 && i != x.i {
+			t.Errorf("%q: got rule %d length %d, want rule %d length %d", x.in, i, n, x.i, x.n)
+		}
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	dfa := func(regex string) *node {
+		x := &rule{regex: []rune(regex)}
+		newGenerator(Options{}).compileRule(x)
+		return x.dfa
+	}
+	for _, x := range []struct {
+		earlier []string
+		later   string
+		want    bool
+	}{
+		{[]string{"[a-z]+"}, "if", true},
+		{[]string{"if"}, "[a-z]+", false},
+		{[]string{"[0-4]+", "[5-9]+"}, "[0-9]+", false},
+		{[]string{"[0-4]", "[5-9]"}, "[0-9]", true},
+		{[]string{"[^ ]*"}, ".", false},
+	} {
+		var earlier []*node
+		for _, s := range x.earlier {
+			earlier = append(earlier, dfa(s))
+		}
+		if got, _ := covered(earlier, dfa(x.later)); got != x.want {
+			t.Errorf("%v shadows /%s/: got %v, want %v", x.earlier, x.later, got, x.want)
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	for _, x := range []struct{ spec, want string }{
+		{"/(a/ {}\n//\npackage x\n", "<stdin>:1:4: unmatched '('"},
+		{"/a/ {}\n  /[b-a]/ {}\n//\npackage x\n", "<stdin>:2:7: bad range in character class"},
+		{"/a/ { x\n", "<stdin>:1:5: unmatched '{'"},
+		{"/a/ {}\n//\npakage x\n", "<stdin>:3:1: expected 'package', found pakage"},
+		{"/a/ { x := }\n//\npackage x\n", "<stdin>:1:12: action of /a/: expected operand, found '}'"},
+		{"/a/ {\n  if {\n}\n}\n//\npackage x\n", "<stdin>:2:6: action of /a/: missing condition in if statement"},
+	} {
+		err := Generate(ioutil.Discard, bytes.NewBufferString(x.spec), Options{})
+		if err == nil || err.Error() != x.want {
+			t.Errorf("%q: got %v, want %s", x.spec, err, x.want)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	src := "/[a-z]+/ { return 1 }\n/if/ %priority 2 { return 2 }\n/i[a-z]/ %priority -1 { return 3 }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.Rules[1].Priority != 2 || sp.Rules[2].Priority != -1 || sp.Rules[1].ActionLine != 2 {
+		t.Fatalf("got rules %+v %+v", sp.Rules[1], sp.Rules[2])
+	}
+	p, err := CompileSpec(sp, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rules are numbered in the order they take precedence.
+	for _, x := range []struct {
+		in   string
+		i, n int
+	}{
+		{"if", 0, 2},
+		{"in", 1, 2},
+		{"ifs", 1, 3},
+	} {
+		if i, n := longestMatch(&p.root, runesAt([]rune(x.in)), false); i != x.i || n != x.n {
+			t.Errorf("%q: got rule %d length %d, want rule %d length %d", x.in, i, n, x.i, x.n)
+		}
+	}
+	out, err := Format([]byte(src), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/[a-z]+/ { return 1 }\n/if/     %priority 2 { return 2 }\n/i[a-z]/ %priority -1 { return 3 }\n//\npackage main\n"
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+	for _, x := range []struct{ src, want string }{
+		{"/a/ %priority x {}\n", "<stdin>:1:5: expected integer after %priority"},
+		{"/a/ %prio {}\n", "<stdin>:1:5: expected integer after %priority"},
+		{"/b/ {}\n/a/ %priorityx 1 {}\n", "<stdin>:2:5: expected integer after %priority"},
+		{"/a\n/ {}\n", "<stdin>:1:3: unexpected newline"},
+	} {
+		if _, err := ParseSpec(strings.NewReader(x.src+"//\npackage main\n"), "<stdin>"); err == nil || err.Error() != x.want {
+			t.Errorf("%q: got %v, want %s", x.src, err, x.want)
+		}
+	}
+}
+
+func TestType(t *testing.T) {
+	src := "/[a-z]+/ %type IDENT s\n/[0-9]+/ %priority 1 %type NUM n strconv.Itoa\n{ n++ }\n/\\+/ %type '+' {}\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y, z := sp.Rules[0], sp.Rules[1], sp.Rules[2]
+	if x.Token != "IDENT" || x.Field != "s" || x.Convert != "" || x.Action != "" || x.ActionLine != 1 {
+		t.Errorf("got rule %+v", x)
+	}
+	if y.Token != "NUM" || y.Field != "n" || y.Convert != "strconv.Itoa" || y.Action != "{ n++ }" || y.ActionLine != 3 || y.Priority != 1 {
+		t.Errorf("got rule %+v", y)
+	}
+	if z.Token != "'+'" || z.Field != "" || z.Action != "{}" || z.Line != 4 {
+		t.Errorf("got rule %+v", z)
+	}
+	if got, want := typedAction(y), "{\nlval.n = strconv.Itoa(yylex.Text())\n{ n++ }\nreturn NUM\n}"; got != want {
+		t.Errorf("got action %q, want %q", got, want)
+	}
+	out, err := Format([]byte(src), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/[a-z]+/ %type IDENT s\n/[0-9]+/ %priority 1 %type NUM n strconv.Itoa { n++ }\n/\\+/     %type '+' {}\n//\npackage main\n"
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+	sp, err = ParseSpec(strings.NewReader("/{/ %type '{'\n/}/ %type '}' s{ n++ }\n/'/ %type '\\''\n//\npackage main\n"), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y, z = sp.Rules[0], sp.Rules[1], sp.Rules[2]
+	if x.Token != "'{'" || x.Field != "" || x.Action != "" {
+		t.Errorf("got rule %+v", x)
+	}
+	if y.Token != "'}'" || y.Field != "s" || y.Action != "{ n++ }" {
+		t.Errorf("got rule %+v", y)
+	}
+	if z.Token != `'\''` || z.Action != "" {
+		t.Errorf("got rule %+v", z)
+	}
+	for _, bad := range []string{"%type", "%type 1", "%type X f(", "%type X a b c d", "%type '{", "%type 'ab'"} {
+		if _, err := ParseSpec(strings.NewReader("/a/ "+bad+"\n//\npackage main\n"), "<stdin>"); !errors.Is(err, ErrBadType) {
+			t.Errorf("%q: got %v, want %v", bad, err, ErrBadType)
+		}
+	}
+	if _, err := Compile(strings.NewReader(src), Options{Standalone: true}); err == nil {
+		t.Error("compiled a typed rule with Standalone")
+	}
+	_, err = Compile(strings.NewReader("/a/ %type A\n//\npackage main\n"), Options{Filename: "x.nex", Tokens: []string{"B"}})
+	if got, want := fmt.Sprint(err), "x.nex:1:1: undeclared token A"; got != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestFormatSpec(t *testing.T) {
+	in := `|a/b|{x++}
+/[0-9]+/ <{ n++ }
+    /1/ {
+one()
+}
+ >{}
+//
+package main
+func main() {  }
+`
+	want := `/a\/b/   { x++ }
+/[0-9]+/ < { n++ }
+  /1/ {
+  	one()
+  }
+> {}
+//
+package main
+
+func main() {}
+`
+	out, err := Format([]byte(in), "<stdin>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder()
+	b.Rule(`[0-9]+`, "return 1")
+	b.Begin(`"[^"]*"`, "").Rule(`\\.`, "").End("")
+	b.Code("package calc")
+	var out bytes.Buffer
+	if err := b.Generate(&out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "", out.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		b    *Builder
+		want string
+	}{
+		{NewBuilder().Rule("a", "").Rule("[b-a]", "").Code("package p"), "<builder>:2:4: bad range in character class"},
+		{NewBuilder().Rule("a", "x :=").Code("package p"), "<builder>:1:8: action of /a/: expected operand, found '}'"},
+	} {
+		if err := x.b.Generate(ioutil.Discard, Options{}); err == nil || err.Error() != x.want {
+			t.Errorf("got %v, want %s", err, x.want)
+		}
+	}
+}
+
+func TestMachine(t *testing.T) {
+	m, err := CompileMachine([]string{`[a-z]+`, `if`, `[0-9]+`, `\n`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.Scanner(strings.NewReader("if iff\n42!"))
+	var got []Match
+	for s.Scan() {
+		got = append(got, s.Match())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Match{
+		{0, "if", 0, 0}, {-1, " ", 0, 2}, {0, "iff", 0, 3}, {3, "\n", 0, 6},
+		{2, "42", 1, 0}, {-1, "!", 1, 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := CompileMachine([]string{"a", "(b"}); err == nil || err.Error() != "<machine>:2:3: unmatched '('" {
+		t.Errorf("got %v", err)
+	}
+	if _, err := CompileMachine([]string{"a", "((a{1000}){1000}){1000}"}); err == nil || err.Error() != "<machine>:2:11: regex too large once repetitions are expanded" {
+		t.Errorf("got %v", err)
+	}
+	m, _ = CompileMachine([]string{"a*", "^", "$"})
+	s = m.Scanner(strings.NewReader("baa"))
+	got = nil
+	for s.Scan() {
+		got = append(got, s.Match())
+	}
+	want = []Match{{1, "", 0, 0}, {-1, "b", 0, 0}, {0, "aa", 0, 1}, {2, "", 0, 3}}
+	if !reflect.DeepEqual(got, want) || s.Err() != nil {
+		t.Errorf("got %v and %v, want %v", got, s.Err(), want)
+	}
+}
+
+func TestConvertFlex(t *testing.T) {
+	for _, x := range []struct {
+		flex, want string
+		warnings   []string
+	}{
+		// Definitions become %define lines.
+		{"D [0-9]\nHEX-DIG [0-9a-f]\n%%\n{D}{2}{HEX-DIG} ;\n", "%define D [0-9]\n%define HEX_DIG [0-9a-f]\n/{D}{2}{HEX_DIG}/ {}\n", nil},
+		// Exclusive conditions hold their own rules only, and inclusive ones
+		// those without conditions too.
+		{"%x S\n%%\na ;\n<S>b ;\n", "/a/ {}\n%family S <\n  /b/ {}\n>\n", nil},
+		{"%s S\n%%\na ;\n<S>b ;\n<INITIAL,S>c ;\n", "/a/ {}\n/c/ {}\n%family S <\n  /a/ {}\n  /b/ {}\n  /c/ {}\n>\n", nil},
+		{"%x S\n%%\n<*>a ;\n<S>{\n  b ;\n}\nc ;\n", "/a/ {}\n/c/ {}\n%family S <\n  /a/ {}\n  /b/ {}\n>\n", nil},
+		// <<EOF>> without conditions is for those without an <<EOF>> rule.
+		{"%x S T\n%%\n<S><<EOF>> ;\n<<EOF>> ;\n", "%eof {}\n%family S <\n  %eof {}\n>\n%family T <\n  %eof {}\n>\n", nil},
+		{"%%\n<S>a ;\n", "%family S <\n  /a/ {}\n>\n", []string{"x.l:2:1: undeclared start condition S"}},
+		{"%%\na/b ;\n", "/a/ {\n  // TODO: trailing context /b dropped, as nex has none; the rule now matches whatever follows.\n}\n",
+			[]string{"x.l:2:1: trailing context /b dropped, as nex has none; the rule now matches whatever follows"}},
+		{"%%\na$ ;\n", "/a/ {\n  // TODO: end-of-line anchor $ dropped, as nex has no trailing context; the rule now matches whatever follows.\n}\n",
+			[]string{"x.l:2:1: end-of-line anchor $ dropped, as nex has no trailing context; the rule now matches whatever follows"}},
+		{"%option noyywrap\n%%\n[[:digit:][:foo:]] ;\n", "/[0-9]/ {\n  // TODO: unknown character class [:foo:] dropped.\n}\n",
+			[]string{"x.l:1:1: %option not translated", "x.l:3:1: unknown character class [:foo:] dropped"}},
+	} {
+		var out bytes.Buffer
+		var warnings []string
+		err := ConvertFlex(&out, strings.NewReader(x.flex), Options{Filename: "x.l", Warn: func(e *Error) {
+			warnings = append(warnings, e.Error())
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec := out.String()
+		if i := strings.Index(spec, "//\npackage main\n"); i < 0 || spec[:i] != x.want {
+			t.Errorf("%q: got %q, want %q", x.flex, spec, x.want)
+		}
+		if !reflect.DeepEqual(warnings, x.warnings) {
+			t.Errorf("%q: got warnings %q, want %q", x.flex, warnings, x.warnings)
+		}
+		if _, err := Compile(strings.NewReader(spec), Options{}); err != nil {
+			t.Errorf("%q: %v", x.flex, err)
+		}
+	}
+}
+
+func TestAutomata(t *testing.T) {
+	re, err := ParseRegex(`[0-9]+(\.[0-9]*)?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.Op != OpConcat || len(re.Sub) != 2 || re.Sub[0].Op != OpPlus || re.Sub[1].Op != OpQuest {
+		t.Errorf("bad syntax tree %+v", re)
+	}
+	nfa := BuildNFA(re)
+	if nfa.Nullable() {
+		t.Error("NFA is nullable")
+	}
+	dfa := Determinize(nfa)
+	for s, want := range map[string]bool{"1": true, "12.": true, "1.5": true, ".5": false, "1.5.": false, "": false} {
+		if got := dfa.Match(s); got != want {
+			t.Errorf("Match(%q) = %v, want %v", s, got, want)
+		}
+	}
+	states := dfa.States()
+	if len(states) != 4 || states[0].Accept {
+		t.Errorf("bad DFA %+v", states)
+	}
+	if _, err := ParseRegex("a[b"); err == nil || err.Error() != "<regex>:1:4: unmatched '['" {
+		t.Errorf("got %v", err)
+	}
+	re, err = ParseRegex(`\0[^\0\x7f]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.Sub[0].Rune != 0 || !reflect.DeepEqual(re.Sub[1].Ranges, []rune{0, 0, 0x7f, 0x7f}) {
+		t.Errorf("bad syntax tree %+v %+v", re.Sub[0], re.Sub[1])
+	}
+	if _, err := ParseRegex(`\012`); !errors.Is(err, ErrBadBackslash) {
+		t.Errorf("got %v, want %v", err, ErrBadBackslash)
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	src := "/a/ { return 1 }\n/b+/ < { }\n  /b/\n    { n++ }\n> { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Spec{
+		Rules: []*Rule{
+			{Regex: "a", Action: "{ return 1 }", Line: 1, Col: 1, ActionLine: 1},
+			{Regex: "b+", StartAction: "{ }", EndAction: "{ }", Line: 2, Col: 1, ActionLine: 2, Rules: []*Rule{
+				{Regex: "b", Action: "{ n++ }", Line: 3, Col: 3, ActionLine: 4},
+			}},
+		},
+		Code:     "package main\n",
+		CodeLine: 7,
+		CodeCol:  1,
+	}
+	if !reflect.DeepEqual(sp, want) {
+		t.Errorf("got %+v, want %+v", sp, want)
+	}
+	sp.Rules[0].Regex = "[b-a]"
+	if _, err := CompileSpec(sp, Options{Filename: "x.nex"}); err == nil || err.Error() != "x.nex:1:5: bad range in character class" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestByteMode(t *testing.T) {
+	src := "%option bytemode\n/\\xff[a-z]/ { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sp.Options, []string{"bytemode"}) {
+		t.Errorf("got options %q", sp.Options)
+	}
+	if got, _ := Format([]byte(src), "x.nex"); !strings.HasPrefix(string(got), "%option bytemode\n") {
+		t.Errorf("got %q", got)
+	}
+	if _, err := CompileSpec(sp, Options{Filename: "x.nex"}); err != nil {
+		t.Error(err)
+	}
+	sp.Rules[0].Regex = "abéĀ"
+	if _, err := CompileSpec(sp, Options{Filename: "x.nex"}); err == nil || err.Error() != `x.nex:2:5: rune above 255 in byte mode: 'Ā'` {
+		t.Errorf("got %v", err)
+	}
+	if _, err := ParseSpec(strings.NewReader("%option bitmode\n"), "x.nex"); err == nil || err.Error() != `x.nex:1:1: unknown option "bitmode"` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCaseless(t *testing.T) {
+	p, err := Compile(strings.NewReader("%option caseless\n/select/ { }\n/[a-cé]+/ { }\n/[^xk]/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	p.Tokenize("SeLeCtAbÉ\u212aXxK", func(tok Token) {
+		got = append(got, fmt.Sprint(tok.Rule, tok.Text))
+	})
+	want := []string{"0SeLeCt", "1AbÉ", "-1\u212a", "-1X", "-1x", "-1K"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// In byte mode, runes above 255 are left out.
+	if _, err := Compile(strings.NewReader("%option bytemode caseless\n/k/ { }\n//\npackage main\n"), Options{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDefines(t *testing.T) {
+	src := "%define HEXDIG [0-9a-f]\n%define QUAD   {HEXDIG}{4}\n/{QUAD}(-{QUAD}){3}/ { }\n/x{2,3}/ { }\n/y{2,}z/ { }\n/{}/ { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Define{"QUAD", "{HEXDIG}{4}", 2, 16}); len(sp.Defines) != 2 || !reflect.DeepEqual(sp.Defines[1], want) {
+		t.Errorf("got %+v, want %+v", sp.Defines, want)
+	}
+	p, err := CompileSpec(sp, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	p.Tokenize("0a1b-2c3d-4e5f-6789xxxxyyyyz{}-yz", func(tok Token) {
+		got = append(got, fmt.Sprint(tok.Rule, tok.Text))
+	})
+	want := []string{"00a1b-2c3d-4e5f-6789", "1xxx", "-1x", "2yyyyz", "3{}", "-1-", "-1y", "-1z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if out, _ := Format([]byte(src), "x.nex"); !strings.HasPrefix(string(out), "%define HEXDIG [0-9a-f]\n%define QUAD {HEXDIG}{4}\n/") {
+		t.Errorf("got %q", out)
+	}
+	for _, x := range []struct{ spec, want string }{
+		{"/{HEX}/ { }\n//\npackage main\n", "x.nex:1:2: undefined definition {HEX}"},
+		{"/a{3,2}/ { }\n//\npackage main\n", "x.nex:1:3: bad repetition count"},
+		{"/((a{1000}){1000}){1000}/ { }\n//\npackage main\n", "x.nex:1:12: regex too large once repetitions are expanded"},
+		{"%define A a{1000}\n%define B {A}{1000}\n//\npackage main\n", "x.nex:2:14: regex too large once repetitions are expanded"},
+		{"%define A a{1000}\n/" + strings.Repeat("{A}", 101) + "/ { }\n//\npackage main\n", "x.nex:2:305: regex too large once repetitions are expanded"},
+		{"%define A a\n%define A b\n//\npackage main\n", "x.nex:2:1: duplicate definition A"},
+		{"%define 1A a\n//\npackage main\n", "x.nex:1:1: expected name and regex after %define"},
+		{"%define A (a\n//\npackage main\n", "x.nex:1:13: unmatched '('"},
+	} {
+		if _, err := Compile(strings.NewReader(x.spec), Options{Filename: "x.nex"}); err == nil || err.Error() != x.want {
+			t.Errorf("%q: got %v, want %s", x.spec, err, x.want)
+		}
+	}
+}
+
+func TestLibraries(t *testing.T) {
+	examples := map[string]struct{ match, reject []string }{
+		"C_IDENT":       {[]string{"x", "_a1", "Foo_Bar"}, []string{"", "1a", "a-b"}},
+		"DEC_INT":       {[]string{"0", "7", "1234"}, []string{"", "012", "-1", "1a"}},
+		"HEX_INT":       {[]string{"0x0", "0XfF", "0x1234abcd"}, []string{"0x", "x12", "0xg"}},
+		"FLOAT":         {[]string{"1.", ".5", "1.5", "1e9", "2.5E-3", "3.e+2"}, []string{"", "1", ".", "e9", "1e", "1.5.2"}},
+		"DQ_STRING":     {[]string{`""`, `"a b"`, `"a\"b"`, `"\\"`}, []string{`"`, `"a`, `"a\"`, "\"a\nb\"", `"a"b"`}},
+		"LINE_COMMENT":  {[]string{"//", "// x /* y */"}, []string{"/", "// x\n"}},
+		"BLOCK_COMMENT": {[]string{"/**/", "/* a */", "/* a\n * b **/", "/***/"}, []string{"/*/", "/* a */ */", "/* a", "/* */*/"}},
+		"ISO8601":       {[]string{"2024-02-29", "1999-12-31T23:59", "2024-01-01T00:00:60.5Z", "2024-06-01T12:00:00+05:30", "2024-06-01T12:00:00-0800"}, []string{"2024-13-01", "2024-00-10", "2024-01-32", "2024-01-01T24:00", "2024-01-01T12:60", "24-01-01", "2024-01-01T12"}},
+		"IPV4":          {[]string{"0.0.0.0", "127.0.0.1", "255.255.255.255", "10.200.49.9"}, []string{"256.0.0.1", "1.2.3", "1.2.3.4.5", "01.2.3.4", "1..2.3"}},
+	}
+	for lib, defines := range libraries {
+		defs, err := parseDefines(specDefines(&Spec{Uses: []string{lib}}), "<"+lib+">")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range defines {
+			x, ok := examples[d[0]]
+			if !ok {
+				t.Errorf("%s: no examples for %s", lib, d[0])
+				continue
+			}
+			dfa := Determinize(BuildNFA(defs[d[0]]))
+			for _, s := range x.match {
+				if !dfa.Match(s) {
+					t.Errorf("%s does not match %q", d[0], s)
+				}
+			}
+			for _, s := range x.reject {
+				if dfa.Match(s) {
+					t.Errorf("%s matches %q", d[0], s)
+				}
+			}
+		}
+	}
+	p, err := Compile(strings.NewReader("%use core\n/{C_IDENT}/ { }\n/{DEC_INT}/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	p.Tokenize("ab 12", func(tok Token) {
+		got = append(got, fmt.Sprint(tok.Rule, tok.Text))
+	})
+	if want := []string{"0ab", "-1 ", "112"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, x := range []struct{ spec, want string }{
+		{"%use fancy\n//\npackage main\n", `x.nex:1:1: unknown library "fancy"`},
+		{"%use core\n%define IPV4 x\n//\npackage main\n", "x.nex:2:14: duplicate definition IPV4"},
+	} {
+		if _, err := Compile(strings.NewReader(x.spec), Options{Filename: "x.nex"}); err == nil || err.Error() != x.want {
+			t.Errorf("%q: got %v, want %s", x.spec, err, x.want)
+		}
+	}
+}
+
+func TestUnicodeClasses(t *testing.T) {
+	p, err := Compile(strings.NewReader("/\\p{Han}+/ { }\n/\\p{Cyrillic}+/ { }\n/[\\p{Latin}0-9]+/ { }\n/\\pN/ { }\n/[^\\P{Greek}]/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	p.Tokenize("中文Жжab12\u0663β!", func(tok Token) {
+		got = append(got, fmt.Sprint(tok.Rule, tok.Text))
+	})
+	want := []string{"0中文", "1Жж", "2ab12", "3\u0663", "4β", "-1!"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, x := range []struct{ regex, want string }{
+		{`\p{Klingon}`, "<regex>:1:11: unknown Unicode class \\p{Klingon}"},
+		{`[a-\pL]`, "<regex>:1:6: bad range in character class"},
+		{`\p{Han`, "<regex>:1:3: illegal backslash escape"},
+	} {
+		if _, err := ParseRegex(x.regex); err == nil || err.Error() != x.want {
+			t.Errorf("%s: got %v, want %s", x.regex, err, x.want)
+		}
+	}
+}
+
+func TestBracketExpressions(t *testing.T) {
+	p, err := Compile(strings.NewReader("/[[=e=]]+/ { }\n/[[:digit:][.-.]]+/ { }\n/[[.a.]-[.c.]]+/ { }\n/[[:upper:]]+/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	p.Tokenize("eéĚ12-3abcÉZz", func(tok Token) {
+		got = append(got, fmt.Sprint(tok.Rule, tok.Text))
+	})
+	want := []string{"0eé", "-1Ě", "112-3", "2abc", "-1É", "3Z", "-1z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, x := range []struct{ regex, want string }{
+		{`[[.ch.]]`, "<regex>:1:7: collating element is not a single rune: \"ch\""},
+		{`[[:vowel:]]`, "<regex>:1:10: unknown POSIX class [:vowel:]"},
+		{`[a-[=e=]]`, "<regex>:1:8: bad range in character class"},
+	} {
+		if _, err := ParseRegex(x.regex); err == nil || err.Error() != x.want {
+			t.Errorf("%s: got %v, want %s", x.regex, err, x.want)
+		}
+	}
+}
+
+func TestNoNewline(t *testing.T) {
+	src := "/\"[^\"]*\"/ { }\n/[^]/ { }\n//\npackage main\n"
+	for _, x := range []struct {
+		opts Options
+		want []string
+	}{
+		{Options{}, []string{"0\"a\nb\"", "1c"}},
+		{Options{NoNewline: true}, []string{"1\"", "1a", "-1\n", "1b", "1\"", "1c"}},
+	} {
+		p, err := Compile(strings.NewReader(src), x.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		p.Tokenize("\"a\nb\"c", func(tok Token) {
+			got = append(got, fmt.Sprint(tok.Rule, tok.Text))
+		})
+		if !reflect.DeepEqual(got, x.want) {
+			t.Errorf("NoNewline %v: got %q, want %q", x.opts.NoNewline, got, x.want)
+		}
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	src := "%invalid { n++ }\n/a/ { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.InvalidAction != "{ n++ }" {
+		t.Errorf("got %q", sp.InvalidAction)
+	}
+	if got, _ := Format([]byte(src), "x.nex"); !strings.HasPrefix(string(got), "%invalid { n++ }\n/a/") {
+		t.Errorf("got %q", got)
+	}
+	var out bytes.Buffer
+	for _, policy := range []string{"", "replace", "error", "rule"} {
+		p, err := CompileSpec(sp, Options{InvalidUTF8: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		if err := p.WriteGo(&out); err != nil {
+			t.Fatal(err)
+		}
+		if want := policy == "" || policy == "rule"; strings.Contains(out.String(), "case -2:") != want {
+			t.Errorf("policy %q: %%invalid action written: %v", policy, !want)
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), "", out.Bytes(), 0); err != nil {
+			t.Errorf("policy %q: %v", policy, err)
+		}
+	}
+	sp.InvalidAction = ""
+	if _, err := CompileSpec(sp, Options{InvalidUTF8: "rule"}); err != ErrNoInvalidAction {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	custom := fstest.MapFS{"lex.tmpl": {Data: []byte(`{{define "lex"}}// Custom: yyLex.
+{{end}}`)}}
+	var out bytes.Buffer
+	if err := Generate(&out, strings.NewReader(testinput), Options{Prefix: "tok", Templates: custom}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "// Custom: tokLex.\n") || strings.Contains(out.String(), "func (toklex *Lexer) Lex(") {
+		t.Errorf("lex template not overridden:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "func NewLexer(") {
+		t.Error("methods template missing")
+	}
+}
+
+func TestLazy(t *testing.T) {
+	// The DFA of the first rule has over a million states.
+	src := "/.*a" + strings.Repeat(".", 20) + "/ { }\n/b/ < { }\n  /c/ { }\n> { }\n//\npackage main\n"
+	p, err := Compile(strings.NewReader(src), Options{Lazy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := p.WriteGo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "", out.Bytes(), 0); err != nil {
+		t.Errorf("%v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "yyTables().fresh()") {
+		t.Error("lexer does not build its DFAs")
+	}
+	if err := p.WriteFamilyDot(ioutil.Discard, DotOptions{}); err != ErrLazy {
+		t.Errorf("got %v, want ErrLazy", err)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	p, err := Compile(strings.NewReader(testinput), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := LookupBackend("json").Write(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Package string
+		Rules   []RuleDump
+	}
+	if err := json.Unmarshal(out.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Package != "main" || len(dump.Rules) != 1 || dump.Rules[0].Action != "{ return A }" {
+		t.Errorf("bad dump %+v", dump)
+	}
+	if LookupBackend("nope") != nil {
+		t.Error("found unregistered backend")
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	dfa := func(s string) *DFA {
+		re, err := ParseRegex(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Determinize(BuildNFA(re))
+	}
+	d := dfa("(a|b)*abb")
+	m := Minimize(d)
+	if got := len(m.States()); got != 4 {
+		t.Errorf("got %d states, want 4", got)
+	}
+	if !Equivalent(d, m) || !m.Match("babb") || m.Match("ab") {
+		t.Error("minimized DFA accepts different strings")
+	}
+	if !Equivalent(dfa("ab|ac"), dfa("a[bc]")) || Equivalent(dfa("a[bc]"), dfa("a[bcd]")) || Equivalent(dfa("^a"), dfa("a")) {
+		t.Error("Equivalent is wrong")
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	re, _ := ParseRegex("ab")
+	var out bytes.Buffer
+	if err := Determinize(BuildNFA(re)).WriteDot(&out, "G", DotOptions{RankDir: "LR", NoLabels: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "digraph G {\n  rankdir=LR;\n  0[shape=box];\n  0 -> 1;\n  1 -> 2;\n  2[style=filled,color=green];\n}\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	p, err := Compile(strings.NewReader("/a/ { }\n/b/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := p.WriteFamilyDot(&out, DotOptions{RuleColors: []string{"red"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := out.String(); !strings.Contains(s, "color=red,label=\"1\\nrule 0: /a/\"") || !strings.Contains(s, "color=green,label=\"2\\nrule 1: /b/\"") {
+		t.Errorf("rule colours missing:\n%s", s)
+	}
+}
+
+func TestDeepPattern(t *testing.T) {
+	// Walking the automata of this pattern with one call per node would
+	// overflow the stack, which is kept small here.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+	re, err := ParseRegex(strings.Repeat("a?", 1000) + strings.Repeat("b", 10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nfa := BuildNFA(re)
+	if err := nfa.WriteDot(ioutil.Discard, "G", DotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dfa := Determinize(nfa)
+	if err := dfa.WriteDot(ioutil.Discard, "G", DotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Repeat("a", 7) + strings.Repeat("b", 10000); !dfa.Match(s) || dfa.Match(s[1:]+"b") {
+		t.Error("bad DFA")
+	}
+}
+
+func TestHugeClass(t *testing.T) {
+	// Ranges given out of order, as [\x{4e20}-\x{4e21}\x{4e1c}-\x{4e1d}...],
+	// took quadratic time to split and look up.
+	var class strings.Builder
+	class.WriteString("[")
+	for r := 0x4e00 + 4*20000; r > 0x4e00; r -= 4 {
+		fmt.Fprintf(&class, "%c-%c", r, r+1)
+	}
+	class.WriteString("a-z]")
+	re, err := ParseRegex(class.String() + "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfa := Minimize(Determinize(BuildNFA(re)))
+	if !dfa.Match("q\u4e05\u4e08") || dfa.Match("\u4e06") || len(dfa.States()) != 2 {
+		t.Error("bad DFA")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	rows := [][]int{
+		{1, 2, -1, 3},
+		{1, 2, -1, 4},
+		{-1, -1, -1, -1},
+		{1, 2, 0, 4},
+		{-1, 5, -1, -1},
+		{0, 5, -1, -1},
+	}
+	c := compress(rows)
+	for st, row := range rows {
+		for k, want := range row {
+			got := -1
+			for s := st; s != -1; s = c.def[s] {
+				if i := c.base[s] + k; c.check[i] == s {
+					got = c.next[i]
+					break
+				}
+			}
+			if got != want {
+				t.Errorf("state %d, class %d: got %d, want %d", st, k, got, want)
+			}
+		}
+	}
+	if len(c.next) >= len(rows)*len(rows[0]) {
+		t.Errorf("next has %d entries", len(c.next))
+	}
+}
+
+func TestLint(t *testing.T) {
+	src := "/[a-z]+/ { }\n/if/ { }\n/[0-9]+/ { }\n/[0-9][0-9]*/ { }\n/x*/ { }\n/a[]b/ { }\n/[^\\pL\\PL]/ { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	problems, err := Lint(sp, Options{Filename: "x.nex", MaxStates: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range problems {
+		got = append(got, fmt.Sprintf("%d:%s", e.Line, e.Code))
+	}
+	want := []string{"2:shadowed", "2:large-dfa", "4:duplicate", "5:shadowed", "5:empty-match", "6:never-matches", "7:never-matches"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Errors compiling the spec are not problems.
+	sp, err = ParseSpec(strings.NewReader("/(a/ { }\n//\npackage main\n"), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := Lint(sp, Options{Filename: "x.nex"}); problems != nil || err == nil || err.Error() != "x.nex:1:4: unmatched '('" {
+		t.Errorf("got %v, %v", problems, err)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	p, err := Compile(strings.NewReader("/if/ { }\n/[a-z]+/ { }\n/^x/ { }\n/y$/ { }\n/[0-9]*z/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := p.g.combine(p.root.kid)
+	// run mimics the generated lexer on the first token of s.
+	run := func(s []rune, st, matchi, matchn int) (int, int) {
+		n := 0
+		for ; n < len(s) && st != -1; n++ {
+			c := 0
+			for k, lo := range f.rc.lo {
+				if lo <= s[n] {
+					c = f.rc.class[k]
+				}
+			}
+			if st = f.next[st][c]; st != -1 && f.acc[st] != -1 {
+				matchi, matchn = f.acc[st], n+1
+			}
+		}
+		if st != -1 && f.endAcc[st] != -1 && (matchn < n || matchi > f.endAcc[st]) {
+			matchi, matchn = f.endAcc[st], n
+		}
+		return matchi, matchn
+	}
+	for _, s := range []string{"if", "iffy", "x", "xy", "y", "zz", "12z", "12", "#"} {
+		for _, atStart := range []bool{false, true} {
+			in := []rune(s)
+			wanti, wantn := longestMatch(&p.root, runesAt(in), atStart)
+			st, i, n := 0, 0, -1
+			if atStart {
+				st = f.begin
+				if f.beginAcc != -1 {
+					i, n = f.beginAcc, 0
+				}
+			}
+			if i, n = run(in, st, i, n); n != wantn || (n != -1 && i != wanti) {
+				t.Errorf("%q at start %v: got rule %d length %d, want rule %d length %d", s, atStart, i, n, wanti, wantn)
+			}
+		}
+	}
+}
+
+func TestStops(t *testing.T) {
+	p, err := Compile(strings.NewReader("/ab;/ { }\n/[0-9]+/ { }\n/x$/ { }\n/x/ { }\n/q/ { }\n/q$/ { }\n//\npackage main\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := p.g.combine(p.root.kid)
+	stop := f.stops()
+	for s, want := range map[string]bool{"ab;": true, "ab": false, "12": false, "x": false, "q": true} {
+		st := 0
+		for _, r := range s {
+			c := 0
+			for k, lo := range f.rc.lo {
+				if lo <= r {
+					c = f.rc.class[k]
+				}
+			}
+			st = f.next[st][c]
+		}
+		if stop[st] != want {
+			t.Errorf("%q: got %v, want %v", s, stop[st], want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	grammar := `%{
+package main
+// %token NOT
+%}
+%union { n int; m struct{} }
+%token <n> NUM 300 /* NOPE */
+%token PLUS '+' MINUS
+%left TIMES
+%type <n> exp
+%%
+exp: NUM %prec TIMES
+`
+	tokens, err := ParseTokens(strings.NewReader(grammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(tokens), "[NUM PLUS MINUS TIMES]"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	for _, c := range []struct{ src, want string }{
+		{"/[0-9]+/ { return NUM }\n/x/ { X := 1; return X }\n/y/ { return EOF }\n//\npackage main\nconst EOF = 0\n", ""},
+		{"/a/ < { }\n  /b/ { return PLUS }\n  /c/ { return DIVIDE }\n> { }\n//\npackage main\n", "x.nex:3:3: undeclared token DIVIDE"},
+	} {
+		_, err := Compile(strings.NewReader(c.src), Options{Filename: "x.nex", Tokens: tokens})
+		if got := fmt.Sprint(err); c.want == "" && err != nil || c.want != "" && got != c.want {
+			t.Errorf("%q: got %v, want %q", c.src, err, c.want)
+		}
+	}
+	// The lexer names the tokens.
+	var out bytes.Buffer
+	if err := Generate(&out, strings.NewReader("/[0-9]+/ { return NUM }\n//\npackage main\n"), Options{Tokens: tokens}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "", out.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := "  case MINUS:\n    return \"MINUS\"\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("TokenString lacks %q", want)
+	}
+}
+
+func TestChroma(t *testing.T) {
+	src := "/if|[a-z]+/ { /*chroma:Keyword*/ }\n/\"[^\"\\n]*\"/ < { }\n  /\\\\./ { //chroma:LiteralStringEscape\n }\n> { }\n/((ab)*)?.$|^x+/ { }\n//\npackage main\n"
+	p, err := Compile(strings.NewReader(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := LookupBackend("chroma").Write(&out, p); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<rule pattern="if|[a-z]+">` + "\n        " + `<token type="Keyword"/>`,
+		`<rule pattern="&#34;[^&#34;\n]*&#34;">` + "\n        " + `<usingself state="rule2_1"/>`,
+		`<state name="rule2_1">` + "\n      " + `<rule pattern="\\(?s:.)">` + "\n        " + `<token type="LiteralStringEscape"/>`,
+		`<rule pattern="(?:(?:ab)*)?(?s:.)\z|\Ax+">` + "\n        " + `<token type="Text"/>`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestExportTMGrammar(t *testing.T) {
+	src := "/[a-z]+/ { /*scope:variable.x*/ }\n/\"[^\"]*\"/ < { //scope:string.x\n }\n  /\\\\./ { /*scope:constant.x*/ }\n> { }\n/./ { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ExportTMGrammar(&out, sp, "x", "source.x"); err != nil {
+		t.Fatal(err)
+	}
+	var g tmGrammar
+	if err := json.Unmarshal(out.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"x","scopeName":"source.x","patterns":[{"name":"variable.x","match":"[a-z]+"},` +
+		`{"match":"\"[^\"]*\"","captures":{"0":{"name":"string.x","patterns":[{"name":"constant.x","match":"\\\\[\\s\\S]"}]}}},` +
+		`{"match":"[\\s\\S]"}]}`
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestParticiple(t *testing.T) {
+	src := "/[a-z]+/ { /*participle:Ident*/ }\n/\"[^\"]*\"/ < { /*participle:String*/ }\n  /\\\\./ { //participle:Escape\n }\n  /[a-z]+/ { /*participle:Ident*/ }\n> { }\n/ / { }\n//\npackage main\n"
+	var out bytes.Buffer
+	if err := Generate(&out, strings.NewReader(src), Options{Participle: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"github.com/alecthomas/participle/v2/lexer"`,
+		`map[string]lexer.TokenType{"EOF": lexer.EOF, "Ident": -2, "Escape": -3}`,
+		"yyParticipleVal = &partFamily{[]int{0, -1, -1}, []*partFamily{\nnil,\n// \"[^\"]*\"\n&partFamily{[]int{1, 0}, nil},",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestFamilies(t *testing.T) {
+	src := "/a/ { }\n%family STR <\n  /b/ { }\n>\n/c/ { }\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sp.Rules) != 2 || len(sp.Families) != 1 || sp.Families[0].Name != "STR" || len(sp.Families[0].Rules) != 1 || sp.Families[0].Line != 2 {
+		t.Fatalf("got %+v", sp)
+	}
+	want := "/a/ {}\n/c/ {}\n%family STR <\n  /b/ {}\n>\n//\npackage main\n"
+	if got, err := Format([]byte(src), "x.nex"); err != nil || string(got) != want {
+		t.Errorf("Format: got %q, %v, want %q", got, err, want)
+	}
+	for _, bad := range []string{
+		"%family <\n/a/ { }\n>\n//\npackage main\n",
+		"%family A <\n>\n%family A <\n>\n//\npackage main\n",
+	} {
+		if _, err := ParseSpec(strings.NewReader(bad), "x.nex"); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func TestEOFAction(t *testing.T) {
+	src := "%eof { a() }\n/a/ < { }\n  %eof { b() }\n  /b/ { }\n> { }\n%family F <\n  %eof { c() }\n>\n//\npackage main\n"
+	sp, err := ParseSpec(strings.NewReader(src), "x.nex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.EOFAction != "{ a() }" || sp.Rules[0].EOFAction != "{ b() }" || sp.Families[0].EOFAction != "{ c() }" {
+		t.Fatalf("got %+v", sp)
+	}
+	want := "%eof { a() }\n/a/ < {}\n  %eof { b() }\n  /b/ {}\n> {}\n%family F <\n  %eof { c() }\n>\n//\npackage main\n"
+	if got, err := Format([]byte(src), "x.nex"); err != nil || string(got) != want {
+		t.Errorf("Format: got %q, %v, want %q", got, err, want)
+	}
+	if _, err := ParseSpec(strings.NewReader("%eof { }\n%eof { }\n//\npackage main\n"), "x.nex"); !errors.Is(err, ErrDuplicateEOF) {
+		t.Errorf("got %v, want %v", err, ErrDuplicateEOF)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var report bytes.Buffer
+	src := "/[a-z]+/ { return 1 }\n/\"/ { yylex.Push(1) }\n%family str <\n/[^\"]+/ { }\n/\"/ { yylex.Pop() }\n>\n//\npackage main\n"
+	if _, err := Compile(strings.NewReader(src), Options{Filename: "x.nex", Report: &report}); err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, line := range strings.Split(report.String(), "\n") {
+		got = append(got, strings.Fields(line))
+	}
+	for i, want := range [][]string{
+		{"spec:", "x.nex"},
+		{"rules:", "4"},
+		{"families:", "2"},
+		{},
+		{"family", "rules", "NFA", "unminimized", "DFA", "states", "classes", "table", "actions"},
+		{"(outermost)", "2", "5", "4", "4", "3", "3", "195", "29"},
+		{"str", "2", "5", "4", "4", "3", "2", "180", "18"},
+		{},
+		{"largest", "rules"},
+		{"line", "family", "NFA", "unminimized", "DFA", "alphabet", "regex"},
+		{"1", "(outermost)", "3", "2", "2", "2", "[a-z]+"},
+		{"4", "str", "3", "2", "2", "2", `[^"]+`},
+	} {
+		if i >= len(got) {
+			t.Fatalf("report ends at line %d\n%s", i, report.String())
+		}
+		if len(got[i])+len(want) > 0 && !reflect.DeepEqual(got[i], want) {
+			t.Fatalf("line %d: got %q, want %q\n%s", i+1, got[i], want, report.String())
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	var page bytes.Buffer
+	src := "/if/ { return 1 }\n/[a-z]+/ { return 2 }\n//\npackage main\n"
+	if _, err := Compile(strings.NewReader(src), Options{Filename: "x.nex", HTML: &page}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<a href="#rule-1" id="link-1" style="padding-left: 0em">2: /[a-z]&#43;/</a>`,
+		`<section id="rule-0">`,
+		`<button data-rule="1" data-kind="dfa">DFA</button>`,
+		`"dfa":{"accept":[false,true],"edges":[{"from":0,"to":1,"label":"[a-z]"},{"from":1,"to":1,"label":"[a-z]"}]}`,
+		"rules: 2\n",
+	} {
+		if !strings.Contains(page.String(), want) {
+			t.Errorf("page lacks %s", want)
+		}
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	src := "/if/ { return 1 }\n/\"/ < { }\n  /[^\"]+/ {\n    return 2\n  }\n> { }\n//\npackage main\n"
+	p, err := Compile(strings.NewReader(src), Options{Filename: "x.nex", SourceMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := p.WriteGo(&out); err != nil {
+		t.Fatal(err)
+	}
+	code, err := format.Source(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(code), "\n")
+	m := p.SourceMap("x.nn.go", code)
+	if len(m.Ranges) != 2 {
+		t.Fatalf("want 2 ranges, got %+v", m.Ranges)
+	}
+	for i, want := range []struct {
+		rule, line int
+		code       string
+	}{{0, 1, "{ return 1 }"}, {2, 3, "{ return 2 }"}} {
+		r := m.Ranges[i]
+		if r.Rule != want.rule || r.ActionLine != want.line {
+			t.Errorf("range %d: want rule %d at line %d, got %+v", i, want.rule, want.line, r)
+		}
+		got := strings.Join(strings.Fields(strings.Join(lines[r.Start-1:r.End], " ")), " ")
+		if got != want.code {
+			t.Errorf("range %d: want %q, got %q", i, want.code, got)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	compile := func(name, src string) *Program {
+		p, err := Compile(strings.NewReader(src+"//\npackage main\n"), Options{Filename: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	old := compile("old.nex", "/if/ { return IF }\n/[a-z]+/ { return ID }\n/[0-9]+/ { return NUM }\n/#.*/ { }\n/ / { }\n")
+	new := compile("new.nex", "/[a-z]+/ { return ID }\n/if/ { return IF }\n/[0-9][0-9]*/ { return NUM }\n/ / { return SPACE }\n/\\/\\/.*/ { }\n/[a-z_]+\\?/ { return ID }\n")
+	changes, err := Diff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range changes {
+		got = append(got, e.Error())
+	}
+	want := []string{
+		"old.nex:4:1: rule /#.*/ removed",
+		"new.nex:1:1: rule /[a-z]+/ now wins over /if/ at line 2 on \"if\"",
+		"new.nex:4:1: action of / / changed",
+		"new.nex:5:1: rule /\\/\\/.*/ added",
+		"new.nex:6:1: rule /[a-z_]+\\?/ added",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	changes, _ = Diff(compile("a.nex", "/[a-z]+/ { return ID }\n"), compile("b.nex", "/[a-z_]+/ { return ID }\n"))
+	if len(changes) != 1 || changes[0].Error() != "b.nex:1:1: rule /[a-z_]+/, formerly /[a-z]+/ at line 1, now matches \"_\"" {
+		t.Errorf("got %v", changes)
+	}
+}
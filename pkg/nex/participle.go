@@ -0,0 +1,62 @@
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+)
+
+// participleImport is the package of the interfaces of participle lexers.
+const participleImport = "github.com/alecthomas/participle/v2/lexer"
+
+// participleDirective finds the participle token type of a rule in its
+// action.
+var participleDirective = regexp.MustCompile(`(?://|/\*)participle:([A-Za-z_][A-Za-z0-9_]*)`)
+
+// participleData is the symbols of the participle tokens of a spec and the
+// table giving the token of each rule, for the templates.
+type participleData struct {
+	Symbols []participleSymbol
+	Table   string // The fields of the partFamily of the outermost family.
+}
+
+// A participleSymbol names a token type. Symbol i is of type -2-i, as EOF
+// is -1.
+type participleSymbol struct {
+	Name string
+	Type int
+}
+
+// participle gathers the token types given by the actions of the rules,
+// numbering them in order of appearance.
+func participle(root *rule) *participleData {
+	d := &participleData{}
+	index := make(map[string]int)
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	var write func(kids []*rule)
+	write = func(kids []*rule) {
+		// Rules without a token are of type -1.
+		var types []int
+		for _, x := range kids {
+			typ := -1
+			if m := participleDirective.FindStringSubmatch(x.code); m != nil && len(x.kid) == 0 {
+				i, ok := index[m[1]]
+				if !ok {
+					i = len(d.Symbols)
+					index[m[1]] = i
+					d.Symbols = append(d.Symbols, participleSymbol{m[1], -2 - i})
+				}
+				typ = i
+			}
+			types = append(types, typ)
+		}
+		writeInts(out, types)
+		out.WriteString(", ")
+		writeNested(out, kids, "partFamily", write)
+	}
+	write(root.kid)
+	out.Flush()
+	d.Table = buf.String()
+	return d
+}
@@ -0,0 +1,690 @@
+package nex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A RegexOp is the kind of a node in the syntax tree of a regex.
+type RegexOp int
+
+const (
+	OpEmpty  RegexOp = iota // Matches the empty string.
+	OpRune                  // Matches Rune.
+	OpClass                 // Matches a rune in Ranges, or not in them if Negate is set.
+	OpAny                   // Matches any rune: '.'.
+	OpBegin                 // Matches at the start of the input: '^'.
+	OpEnd                   // Matches at the end of the input: '$'.
+	OpConcat                // Matches the Sub in sequence.
+	OpAlt                   // Matches any of the Sub.
+	OpStar                  // Matches Sub[0] zero or more times.
+	OpPlus                  // Matches Sub[0] one or more times.
+	OpQuest                 // Matches Sub[0] zero or one time.
+)
+
+// A Regex is a node in the syntax tree of a regex, as returned by
+// ParseRegex.
+type Regex struct {
+	Op     RegexOp
+	Rune   rune     // For OpRune.
+	Ranges []rune   // For OpClass: pairs of inclusive limits, in the order written.
+	Negate bool     // For OpClass.
+	Sub    []*Regex // Operands.
+}
+
+// ParseRegex parses a regex written without delimiters. Syntax errors are of
+// type *Error, with line 1 and the column of the error. As there are no
+// definitions, {NAME} is an error.
+func ParseRegex(s string) (*Regex, error) {
+	re, pos, err := parseRegex([]rune(s), nil)
+	if err != nil {
+		return nil, &Error{"<regex>", 1, 1 + pos, "regex", err}
+	}
+	return re, nil
+}
+
+// parseRegex parses a regex, {NAME} standing for the regex defs maps NAME
+// to, and on error returns the offset at which it was found.
+func parseRegex(s []rune, defs map[string]*Regex) (re *Regex, pos int, err error) {
+	p := &regexParser{s: s, defs: defs}
+	// Syntax errors are raised by panicking.
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			re, pos, err = nil, p.pos, e
+		}
+	}()
+	if re = p.alt(); re == nil {
+		re = &Regex{Op: OpEmpty}
+	}
+	// Definitions may add up past the bound without any count doing so.
+	if p.size(re) > maxSize {
+		panic(ErrRegexTooLarge)
+	}
+	return re, 0, nil
+}
+
+// parseDefines parses the regexes of %define lines, each of which may use
+// the definitions before it, and returns them by name.
+func parseDefines(defines []*Define, filename string) (map[string]*Regex, error) {
+	defs := make(map[string]*Regex)
+	for _, d := range defines {
+		if defs[d.Name] != nil {
+			return nil, &Error{filename, d.Line, d.Col, "syntax", fmt.Errorf("%w %s", ErrDuplicateDefine, d.Name)}
+		}
+		re, pos, err := parseRegex([]rune(d.Regex), defs)
+		if err != nil {
+			return nil, &Error{filename, d.Line, d.Col + pos, "regex", err}
+		}
+		defs[d.Name] = re
+	}
+	return defs, nil
+}
+
+// A regexParser parses a regex by recursive descent. Its methods return nil
+// for an empty regex.
+type regexParser struct {
+	s        []rune
+	pos      int
+	isNested bool              // True within parentheses.
+	defs     map[string]*Regex // The regexes of the %define lines, by name.
+	sizes    map[*Regex]int    // The sizes of the nodes met, for size.
+}
+
+// maxRepeat bounds the counts of {n,m}, as each repetition is a copy of the
+// term in the automata.
+const maxRepeat = 1000
+
+// maxSize bounds the number of nodes of a regex once its repetitions and
+// definitions are expanded, which nested counts such as ((a{1000}){1000})
+// multiply.
+const maxSize = 100000
+
+// size returns the number of nodes of re once expanded, a node shared by
+// repetitions or definitions being counted each time it occurs, or
+// maxSize+1 if there are more than maxSize.
+func (p *regexParser) size(re *Regex) int {
+	if n, ok := p.sizes[re]; ok {
+		return n
+	}
+	n := 1
+	for _, sub := range re.Sub {
+		if n += p.size(sub); n > maxSize {
+			n = maxSize + 1
+			break
+		}
+	}
+	if p.sizes == nil {
+		p.sizes = make(map[*Regex]int)
+	}
+	p.sizes[re] = n
+	return n
+}
+
+// braced returns the contents of the braces at p.pos, if they close on the
+// same line, and the offset of the closing one, or -1.
+func (p *regexParser) braced() (string, int) {
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch p.s[i] {
+		case '}':
+			return string(p.s[p.pos+1 : i]), i
+		case '{', '\\':
+			return "", -1
+		}
+	}
+	return "", -1
+}
+
+// count parses the {n}, {n,} or {n,m} at p.pos, returning the bounds, hi
+// being -1 if there is none, and the offset of the closing brace, or -1 if
+// the braces hold no count.
+func (p *regexParser) count() (lo, hi, end int) {
+	text, end := p.braced()
+	if end == -1 || text == "" || text[0] < '0' || text[0] > '9' {
+		return 0, 0, -1
+	}
+	lo, hi = -1, -1
+	n, k := 0, 0
+	for _, c := range text + "}" {
+		switch {
+		case '0' <= c && c <= '9':
+			if n = 10*n + int(c-'0'); n > maxRepeat {
+				panic(ErrBadRepeat)
+			}
+			k++
+		case c == ',' && lo == -1:
+			lo, n, k = n, 0, 0
+		case c == '}':
+			if lo == -1 {
+				lo, hi = n, n
+			} else if k > 0 {
+				hi = n
+			}
+		default:
+			return 0, 0, -1
+		}
+	}
+	if hi != -1 && hi < lo {
+		panic(ErrBadRepeat)
+	}
+	return lo, hi, end
+}
+
+// isName tells whether s can name a definition: a letter or underscore
+// followed by letters, digits and underscores.
+func isName(s string) bool {
+	for i, c := range s {
+		if c != '_' && !unicode.IsLetter(c) && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (p *regexParser) maybeEscape() rune {
+	s := p.s
+	c := s[p.pos]
+	if '\\' == c {
+		p.pos++
+		if len(s) == p.pos {
+			panic(ErrExtraneousBackslash)
+		}
+		c = s[p.pos]
+		switch {
+		case ispunct(c):
+		case escape(c) >= 0:
+			c = escape(s[p.pos])
+		case '0' == c:
+			// \0 is NUL. As \012 is octal elsewhere, a digit may not follow.
+			if p.pos+1 < len(s) && '0' <= s[p.pos+1] && s[p.pos+1] <= '9' {
+				panic(ErrBadBackslash)
+			}
+			c = 0
+		case 'x' == c:
+			// \xNN is the rune, or in byte mode the byte, numbered NN.
+			if p.pos+2 >= len(s) {
+				panic(ErrBadBackslash)
+			}
+			n, err := strconv.ParseUint(string(s[p.pos+1:p.pos+3]), 16, 8)
+			if err != nil {
+				panic(ErrBadBackslash)
+			}
+			p.pos += 2
+			c = rune(n)
+		default:
+			panic(ErrBadBackslash)
+		}
+	}
+	return c
+}
+
+// property parses the \p{Name} or \P{Name} at p.pos, or their one-letter
+// forms such as \pL, returning the ranges of the runes of the Unicode
+// category, script or property named, or of all the others for \P, and
+// leaving p.pos on the last rune of the escape. It returns nil if there is
+// no such escape at p.pos.
+func (p *regexParser) property() []rune {
+	s := p.s
+	if p.pos+2 >= len(s) || s[p.pos] != '\\' || s[p.pos+1] != 'p' && s[p.pos+1] != 'P' {
+		return nil
+	}
+	negate := s[p.pos+1] == 'P'
+	p.pos += 2
+	name := string(s[p.pos])
+	if s[p.pos] == '{' {
+		end := p.pos
+		for end < len(s) && s[end] != '}' {
+			end++
+		}
+		if end == len(s) {
+			panic(ErrBadBackslash)
+		}
+		name, p.pos = string(s[p.pos+1:end]), end
+	}
+	table := unicode.Categories[name]
+	if table == nil {
+		table = unicode.Scripts[name]
+	}
+	if table == nil {
+		table = unicode.Properties[name]
+	}
+	if table == nil {
+		panic(fmt.Errorf("%w \\p{%s}", ErrUnknownClass, name))
+	}
+	set := newIntervalSet()
+	add := func(lo, hi, stride rune) {
+		if stride == 1 {
+			set.add(lo, hi)
+			return
+		}
+		for c := lo; c <= hi; c += stride {
+			set.add(c, c)
+		}
+	}
+	for _, r := range table.R16 {
+		add(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+	for _, r := range table.R32 {
+		add(rune(r.Lo), rune(r.Hi), rune(r.Stride))
+	}
+	ranges := set.union()
+	if !negate {
+		return ranges
+	}
+	res, lo := []rune{}, rune(0)
+	for i := 0; i < len(ranges); i += 2 {
+		if ranges[i] > lo {
+			res = append(res, lo, ranges[i]-1)
+		}
+		lo = ranges[i+1] + 1
+	}
+	if lo <= unicode.MaxRune {
+		res = append(res, lo, unicode.MaxRune)
+	}
+	return res
+}
+
+// bracket parses the bracket expression at the current position of a
+// character class, one of a POSIX class [:name:], an equivalence class [=c=]
+// and a collating symbol [.c.]. It returns the ':', '=' or '.' giving its
+// kind and what it encloses, leaving the position at its last rune, or 0 if
+// there is none; a '[' with no closing ":]", "=]" or ".]" is a literal.
+func (p *regexParser) bracket() (rune, []rune) {
+	s := p.s
+	if p.pos+1 >= len(s) || s[p.pos] != '[' {
+		return 0, nil
+	}
+	kind := s[p.pos+1]
+	if kind != ':' && kind != '=' && kind != '.' {
+		return 0, nil
+	}
+	for end := p.pos + 3; end+1 < len(s); end++ {
+		if s[end] == kind && s[end+1] == ']' {
+			elem := s[p.pos+2 : end]
+			p.pos = end + 1
+			return kind, elem
+		}
+	}
+	return 0, nil
+}
+
+// collatingRune returns the rune enclosed by [=c=] or [.c.]. Collating
+// elements of several runes, such as [.ch.], are locale-dependent and
+// unsupported.
+func collatingRune(elem []rune) rune {
+	if len(elem) != 1 {
+		panic(fmt.Errorf("%w: %q", ErrBadCollating, string(elem)))
+	}
+	return elem[0]
+}
+
+// posixRanges returns the ranges of the POSIX class [:name:].
+func posixRanges(name []rune) []rune {
+	cls, ok := posixClasses[string(name)]
+	if !ok {
+		panic(fmt.Errorf("%w [:%s:]", ErrUnknownPOSIXClass, string(name)))
+	}
+	return (&regexParser{s: []rune(cls)}).charClass().Ranges
+}
+
+// equivalenceClasses lists the letters of Latin-1 and Latin Extended-A
+// sharing a base letter, the primary weights a locale's collation would
+// give them being equal.
+var equivalenceClasses = []string{
+	"aàáâãäåāăą", "AÀÁÂÃÄÅĀĂĄ", "cçćĉċč", "CÇĆĈĊČ", "dďđ", "DĎĐ",
+	"eèéêëēĕėęě", "EÈÉÊËĒĔĖĘĚ", "gĝğġģ", "GĜĞĠĢ", "hĥħ", "HĤĦ",
+	"iìíîïĩīĭįı", "IÌÍÎÏĨĪĬĮİ", "jĵ", "JĴ", "kķ", "KĶ", "lĺļľŀł", "LĹĻĽĿŁ",
+	"nñńņňŉ", "NÑŃŅŇ", "oòóôõöøōŏő", "OÒÓÔÕÖØŌŎŐ", "rŕŗř", "RŔŖŘ",
+	"sśŝşš", "SŚŜŞŠ", "tţťŧ", "TŢŤŦ", "uùúûüũūŭůűų", "UÙÚÛÜŨŪŬŮŰŲ",
+	"wŵ", "WŴ", "yýÿŷ", "YÝŸŶ", "zźżž", "ZŹŻŽ",
+}
+
+// equivalents returns the ranges of the equivalence class [=c=]: the letters
+// sharing the base letter of c, or c alone.
+func equivalents(c rune) []rune {
+	for _, class := range equivalenceClasses {
+		if strings.ContainsRune(class, c) {
+			var ranges []rune
+			for _, r := range class {
+				ranges = append(ranges, r, r)
+			}
+			return ranges
+		}
+	}
+	return []rune{c, c}
+}
+
+func (p *regexParser) charClass() *Regex {
+	s := p.s
+	re := &Regex{Op: OpClass}
+	// Ranges consisting of a single element are a special case: the
+	// endpoints always come in pairs, so we give 'c' as the beginning and the
+	// end of the range.
+	singletonRange := func(c rune) {
+		re.Ranges = append(re.Ranges, c, c)
+	}
+	if len(s) > p.pos && '^' == s[p.pos] {
+		re.Negate = true
+		p.pos++
+	}
+	var left rune
+	leftLive := false
+	justSawDash := false
+	first := true
+	// Allow '-' at the beginning and end, and in ranges.
+	for p.pos < len(s) && s[p.pos] != ']' {
+		if ranges := p.property(); ranges != nil {
+			if justSawDash {
+				panic(ErrBadRange)
+			}
+			if leftLive {
+				singletonRange(left)
+				leftLive = false
+			}
+			re.Ranges = append(re.Ranges, ranges...)
+			first = false
+			p.pos++
+			continue
+		}
+		var c rune
+		switch kind, elem := p.bracket(); kind {
+		case ':', '=':
+			if justSawDash {
+				panic(ErrBadRange)
+			}
+			if leftLive {
+				singletonRange(left)
+				leftLive = false
+			}
+			if kind == ':' {
+				re.Ranges = append(re.Ranges, posixRanges(elem)...)
+			} else {
+				re.Ranges = append(re.Ranges, equivalents(collatingRune(elem))...)
+			}
+			first = false
+			p.pos++
+			continue
+		case '.':
+			c = collatingRune(elem)
+		default:
+			c = p.maybeEscape()
+		}
+		switch {
+		case c == '-' && s[p.pos] == '-':
+			if first {
+				singletonRange('-')
+				break
+			}
+			justSawDash = true
+		default:
+			if justSawDash {
+				if !leftLive || left > c {
+					panic(ErrBadRange)
+				}
+				re.Ranges = append(re.Ranges, left, c)
+				leftLive = false
+			} else {
+				if leftLive {
+					singletonRange(left)
+				}
+				left = c
+				leftLive = true
+			}
+			justSawDash = false
+		}
+		first = false
+		p.pos++
+	}
+	if leftLive {
+		singletonRange(left)
+	}
+	if justSawDash {
+		singletonRange('-')
+	}
+	return re
+}
+
+func (p *regexParser) term() (re *Regex) {
+	s := p.s
+	if len(s) == p.pos || s[p.pos] == '|' {
+		return nil
+	}
+	switch s[p.pos] {
+	case '*', '+', '?':
+		panic(ErrBareClosure)
+	case ')':
+		if !p.isNested {
+			panic(ErrUnmatchedRpar)
+		}
+		return nil
+	case '(':
+		p.pos++
+		oldIsNested := p.isNested
+		p.isNested = true
+		re = p.alt()
+		p.isNested = oldIsNested
+		if len(s) == p.pos || ')' != s[p.pos] {
+			panic(ErrUnmatchedLpar)
+		}
+	case '{':
+		// {NAME} is the regex of a definition, as a single term. Other
+		// braces match themselves.
+		name, end := p.braced()
+		if end == -1 || !isName(name) {
+			re = &Regex{Op: OpRune, Rune: '{'}
+			break
+		}
+		if re = p.defs[name]; re == nil {
+			panic(fmt.Errorf("%w {%s}", ErrUndefinedName, name))
+		}
+		p.pos = end
+	case '.':
+		re = &Regex{Op: OpAny}
+	case '^':
+		re = &Regex{Op: OpBegin}
+	case '$':
+		re = &Regex{Op: OpEnd}
+	case ']':
+		panic(ErrUnmatchedRbkt)
+	case '[':
+		p.pos++
+		re = p.charClass()
+		if len(s) == p.pos || ']' != s[p.pos] {
+			panic(ErrUnmatchedLbkt)
+		}
+	default:
+		if ranges := p.property(); ranges != nil {
+			re = &Regex{Op: OpClass, Ranges: ranges}
+			break
+		}
+		re = &Regex{Op: OpRune, Rune: p.maybeEscape()}
+	}
+	p.pos++
+	return re
+}
+
+func (p *regexParser) closure() *Regex {
+	re := p.term()
+	if re == nil || len(p.s) == p.pos {
+		return re
+	}
+	switch p.s[p.pos] {
+	case '*':
+		re = &Regex{Op: OpStar, Sub: []*Regex{re}}
+	case '+':
+		re = &Regex{Op: OpPlus, Sub: []*Regex{re}}
+	case '?':
+		re = &Regex{Op: OpQuest, Sub: []*Regex{re}}
+	case '{':
+		lo, hi, end := p.count()
+		if end == -1 {
+			return re
+		}
+		if re = repeat(re, lo, hi); p.size(re) > maxSize {
+			panic(ErrRegexTooLarge)
+		}
+		p.pos = end
+	default:
+		return re
+	}
+	p.pos++
+	return re
+}
+
+// repeat returns a regex matching re from lo to hi times, or at least lo
+// times if hi is -1.
+func repeat(re *Regex, lo, hi int) *Regex {
+	var sub []*Regex
+	for i := 0; i < lo; i++ {
+		sub = append(sub, re)
+	}
+	if hi == -1 {
+		sub = append(sub, &Regex{Op: OpStar, Sub: []*Regex{re}})
+	}
+	for i := lo; i < hi; i++ {
+		sub = append(sub, &Regex{Op: OpQuest, Sub: []*Regex{re}})
+	}
+	switch len(sub) {
+	case 0:
+		return &Regex{Op: OpEmpty}
+	case 1:
+		return sub[0]
+	}
+	return &Regex{Op: OpConcat, Sub: sub}
+}
+
+// concat parses terms up to the first empty one.
+func (p *regexParser) concat() *Regex {
+	var sub []*Regex
+	for {
+		re := p.closure()
+		if re == nil {
+			break
+		}
+		sub = append(sub, re)
+	}
+	switch len(sub) {
+	case 0:
+		return nil
+	case 1:
+		return sub[0]
+	}
+	return &Regex{Op: OpConcat, Sub: sub}
+}
+
+func (p *regexParser) alt() *Regex {
+	s := p.s
+	re := p.concat()
+	orEmpty := func(re *Regex) *Regex {
+		if re == nil {
+			return &Regex{Op: OpEmpty}
+		}
+		return re
+	}
+	isAlt := false
+	for p.pos < len(s) && s[p.pos] != ')' {
+		if s[p.pos] != '|' {
+			panic(ErrInternal)
+		}
+		p.pos++
+		next := orEmpty(p.concat())
+		if isAlt {
+			re.Sub = append(re.Sub, next)
+		} else {
+			re = &Regex{Op: OpAlt, Sub: []*Regex{orEmpty(re), next}}
+			isAlt = true
+		}
+	}
+	return re
+}
+
+// maxRune returns the largest rune a regex names, as a rune or as a limit of
+// a class, or -1 if it names none.
+func maxRune(re *Regex) rune {
+	max := rune(-1)
+	if re.Op == OpRune {
+		max = re.Rune
+	}
+	for _, r := range re.Ranges {
+		if r > max {
+			max = r
+		}
+	}
+	for _, sub := range re.Sub {
+		if r := maxRune(sub); r > max {
+			max = r
+		}
+	}
+	return max
+}
+
+// foldCase returns a copy of re matching its runes and classes in any case:
+// each rune also matches those the simple case folding of Unicode maps it
+// to, but for those above max.
+func foldCase(re *Regex, max rune) *Regex {
+	x := *re
+	switch re.Op {
+	case OpRune:
+		if ranges := foldRanges([]rune{re.Rune, re.Rune}, max); len(ranges) > 2 || ranges[0] != ranges[1] {
+			x = Regex{Op: OpClass, Ranges: ranges}
+		}
+	case OpClass:
+		// A negated class excludes the runes of every case.
+		x.Ranges = foldRanges(re.Ranges, max)
+	}
+	if re.Sub != nil {
+		x.Sub = make([]*Regex, len(re.Sub))
+		for i, sub := range re.Sub {
+			x.Sub[i] = foldCase(sub, max)
+		}
+	}
+	return &x
+}
+
+// excludeNewline returns a copy of re in which negated classes do not match
+// a newline either.
+func excludeNewline(re *Regex) *Regex {
+	x := *re
+	if re.Op == OpClass && re.Negate {
+		x.Ranges = append(re.Ranges[:len(re.Ranges):len(re.Ranges)], '\n', '\n')
+	}
+	if re.Sub != nil {
+		x.Sub = make([]*Regex, len(re.Sub))
+		for i, sub := range re.Sub {
+			x.Sub[i] = excludeNewline(sub)
+		}
+	}
+	return &x
+}
+
+// foldRanges returns the sorted ranges of the runes of ranges and of those
+// they fold to, up to max.
+func foldRanges(ranges []rune, max rune) []rune {
+	s := newIntervalSet().add(ranges...)
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		// Only runes with a case fold to others.
+		for _, c := range unicode.CaseRanges {
+			from, to := rune(c.Lo), rune(c.Hi)
+			if from < lo {
+				from = lo
+			}
+			if to > hi {
+				to = hi
+			}
+			for r := from; r <= to; r++ {
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					if f <= max {
+						s.add(f, f)
+					}
+				}
+			}
+		}
+	}
+	return s.union()
+}
@@ -0,0 +1,82 @@
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// semanticDirective finds the LSP semantic token type of a rule in its
+// action, followed by its modifiers, if any, e.g. variable.readonly.
+var semanticDirective = regexp.MustCompile(`(?://|/\*)semantic:([A-Za-z0-9_]+(?:\.[A-Za-z0-9_]+)*)`)
+
+// semanticData is the legend of the semantic tokens of a spec and the
+// table giving the token of each rule, for the templates.
+type semanticData struct {
+	Types, Modifiers []string
+	Table            string // The fields of the semFamily of the outermost family.
+}
+
+// semantic gathers the semantic tokens given by the actions of the rules,
+// numbering types and modifiers in order of appearance.
+func semantic(root *rule) *semanticData {
+	d := &semanticData{}
+	index := func(names *[]string, name string) int {
+		for i, s := range *names {
+			if s == name {
+				return i
+			}
+		}
+		*names = append(*names, name)
+		return len(*names) - 1
+	}
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	var write func(kids []*rule)
+	write = func(kids []*rule) {
+		// Rules without a token are of type -1.
+		var types, mods []int
+		for _, x := range kids {
+			typ, mod := -1, 0
+			if m := semanticDirective.FindStringSubmatch(x.code); m != nil && len(x.kid) == 0 {
+				names := strings.Split(m[1], ".")
+				typ = index(&d.Types, names[0])
+				for _, name := range names[1:] {
+					mod |= 1 << uint(index(&d.Modifiers, name))
+				}
+			}
+			types, mods = append(types, typ), append(mods, mod)
+		}
+		writeInts(out, types)
+		out.WriteString(", ")
+		writeInts(out, mods)
+		out.WriteString(", ")
+		writeNested(out, kids, "semFamily", write)
+	}
+	write(root.kid)
+	out.Flush()
+	d.Table = buf.String()
+	return d
+}
+
+// hasEOF reports whether any of the families nested in the rules of a family
+// has a %eof action.
+func hasEOF(kids []*rule) bool {
+	for _, x := range kids {
+		if x.eofCode != "" || hasEOF(x.kid) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNest reports whether any of the rules of a family has nested rules.
+func hasNest(kids []*rule) bool {
+	for _, x := range kids {
+		if len(x.kid) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+)
+
+// writeShards writes the transitions of the outermost family to table files
+// of at most ShardSize distinct rows each. Every table file defines a function
+// returning its rows; the calls gathering them into the table are written to
+// `out`, which keeps the public API in the main output file.
+func (g *generator) writeShards(out *bufio.Writer, pkg string, next [][]int) error {
+	rows, index := dedupRows(next)
+	out.WriteString("var rows [][]int\n")
+	for n := 1; len(rows) > 0; n++ {
+		m := g.opts.ShardSize
+		if m > len(rows) {
+			m = len(rows)
+		}
+		g.rep.WriteString(out, fmt.Sprintf("rows = append(rows, yyTables%d()...)\n", n))
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		w.WriteString(generatedHeader())
+		fmt.Fprintf(w, "package %s\n\n", pkg)
+		g.rep.WriteString(w, fmt.Sprintf("func yyTables%d() [][]int {\n  return [][]int{\n", n))
+		for _, row := range rows[:m] {
+			w.WriteString("{")
+			for i, t := range row {
+				if i > 0 {
+					w.WriteString(", ")
+				}
+				fmt.Fprint(w, t)
+			}
+			w.WriteString("},\n")
+		}
+		w.WriteString("}\n}\n")
+		w.Flush()
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := g.opts.WriteShard(n, src); err != nil {
+			return err
+		}
+		rows = rows[m:]
+	}
+	g.rep.WriteString(out, "yyTablesVal.next = unpackRows(rows, []int{")
+	for i, k := range index {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprint(out, k)
+	}
+	out.WriteString("})\n")
+	return nil
+}
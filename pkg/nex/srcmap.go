@@ -0,0 +1,94 @@
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A SourceMap relates lines of a Go lexer to the rules of its spec, so that
+// coverage tools and debuggers can attribute what the lexer does to the
+// grammar.
+type SourceMap struct {
+	File   string        `json:"file,omitempty"` // The Go file, if not standard output.
+	Spec   string        `json:"spec"`
+	Ranges []SourceRange `json:"ranges"`
+}
+
+// A SourceRange is a range of lines of the Go file, counting from 1, holding
+// the action of a rule. A rule whose code is written more than once, as when
+// NN_FUN appears several times, has a range for each.
+type SourceRange struct {
+	Start      int    `json:"start"`
+	End        int    `json:"end"` // Inclusive.
+	Rule       int    `json:"rule"`
+	Family     string `json:"family,omitempty"` // Empty for the outermost family.
+	Regex      string `json:"regex"`
+	Line       int    `json:"line"` // Position of the regex in the spec.
+	Col        int    `json:"col"`
+	ActionLine int    `json:"action_line"`
+}
+
+// The comments around each action when Options.SourceMap is set. Being
+// comments on lines of their own, they survive gofmt.
+const (
+	actionMark = "//nex:rule "
+	endMark    = "//nex:end"
+)
+
+// ruleList numbers the rules of the program, nested ones included, in the
+// order of the families and then as written, and records the family of each.
+func (p *Program) ruleList() ([]*rule, []string) {
+	var rules []*rule
+	var families []string
+	var walk func(name string, kids []*rule)
+	walk = func(name string, kids []*rule) {
+		for _, x := range kids {
+			rules = append(rules, x)
+			families = append(families, name)
+			walk(name, x.kid)
+		}
+	}
+	names, fams := p.familyList()
+	for i, fam := range fams {
+		walk(names[i], fam.kid)
+	}
+	return rules, families
+}
+
+// SourceMap finds the actions in src, the Go lexer written by WriteGo with
+// Options.SourceMap set, and perhaps gofmt'ed since, to be written to the
+// file named file. Rules are numbered across the families in order, each
+// followed by those nested in it.
+func (p *Program) SourceMap(file string, src []byte) *SourceMap {
+	rules, families := p.ruleList()
+	m := &SourceMap{File: file, Spec: p.g.filename, Ranges: []SourceRange{}}
+	in := bufio.NewScanner(bytes.NewReader(src))
+	in.Buffer(nil, len(src)+1)
+	start, i := 0, -1
+	for n := 1; in.Scan(); n++ {
+		line := strings.TrimSpace(in.Text())
+		switch {
+		case strings.HasPrefix(line, actionMark):
+			if _, err := fmt.Sscan(line[len(actionMark):], &i); err != nil || i < 0 || i >= len(rules) {
+				i = -1
+			}
+			start = n + 1
+		case line == endMark && i != -1:
+			x := rules[i]
+			m.Ranges = append(m.Ranges, SourceRange{
+				Start:      start,
+				End:        n - 1,
+				Rule:       i,
+				Family:     families[i],
+				Regex:      string(x.regex),
+				Line:       x.line,
+				Col:        x.col,
+				ActionLine: x.actionLine,
+			})
+			i = -1
+		}
+	}
+	return m
+}
@@ -0,0 +1,109 @@
+package nex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// ruleStats records the size of the automata built for a rule.
+type ruleStats struct {
+	x        *rule
+	nfa, dfa int // Number of NFA and DFA states.
+	subset   int // Number of DFA states before minimization.
+	alphabet int // Size of the alphabet computed for the regex.
+}
+
+// writeStats prints a table of the statistics of every rule compiled, in the
+// order of the rules in the spec, with totals.
+func (g *generator) writeStats(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "line\tNFA\tDFA\talphabet\t\x20regex\n")
+	var nfa, dfa int
+	for _, s := range g.stats {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\x20%s\n", s.x.id, s.nfa, s.dfa, s.alphabet, string(s.x.regex))
+		nfa += s.nfa
+		dfa += s.dfa
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t\t\x20%d rules\n", nfa, dfa, len(g.stats))
+	tw.Flush()
+}
+
+// reportTop is the number of rules listed by writeReport.
+const reportTop = 10
+
+// countWriter counts the bytes written to it.
+type countWriter int
+
+func (n *countWriter) Write(p []byte) (int, error) {
+	*n += countWriter(len(p))
+	return len(p), nil
+}
+
+// writeReport prints a summary of each family, named by names, and of the
+// rules with the largest DFAs, for deciding what to refactor in a big
+// grammar. A family counts the rules nested in its rules. Its table is the
+// size in bytes of the transition tables written for it, and its actions
+// that of the code of its rules, which together estimate its share of the
+// generated code.
+func (g *generator) writeReport(w io.Writer, families []rule, names []string) {
+	fmt.Fprintf(w, "spec: %s\nrules: %d\nfamilies: %d\n\n", g.filename, len(g.stats), len(families))
+	stats := make(map[*rule]ruleStats)
+	for _, s := range g.stats {
+		stats[s.x] = s
+	}
+	family := make(map[*rule]string)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "family\trules\tNFA\tunminimized\tDFA\tstates\tclasses\ttable\tactions\t\n")
+	for i, fam := range families {
+		var rules, nfa, subset, dfa, actions int
+		var walk func([]*rule)
+		walk = func(kids []*rule) {
+			for _, x := range kids {
+				s := stats[x]
+				rules++
+				nfa += s.nfa
+				subset += s.subset
+				dfa += s.dfa
+				actions += len(x.code) + len(x.startCode) + len(x.endCode)
+				family[x] = names[i]
+				walk(x.kid)
+			}
+		}
+		walk(fam.kid)
+		var table countWriter
+		out := bufio.NewWriter(&table)
+		states, classes := "-", "-"
+		if g.opts.Lazy {
+			g.writeLazyFamily(out, fam.kid)
+		} else {
+			f := g.combine(fam.kid)
+			states, classes = strconv.Itoa(len(f.next)), strconv.Itoa(f.rc.n)
+			g.writeFamilyTable(out, fam.kid, nil)
+		}
+		out.Flush()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%d\t%d\t\n", names[i], rules, nfa, subset, dfa, states, classes, table, actions)
+	}
+	tw.Flush()
+
+	top := append([]ruleStats(nil), g.stats...)
+	sort.SliceStable(top, func(i, j int) bool {
+		if top[i].dfa != top[j].dfa {
+			return top[i].dfa > top[j].dfa
+		}
+		return top[i].nfa > top[j].nfa
+	})
+	if len(top) > reportTop {
+		top = top[:reportTop]
+	}
+	fmt.Fprintf(w, "\nlargest rules\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "line\tfamily\tNFA\tunminimized\tDFA\talphabet\t\x20regex\n")
+	for _, s := range top {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t\x20%s\n", s.x.id, family[s.x], s.nfa, s.subset, s.dfa, s.alphabet, string(s.x.regex))
+	}
+	tw.Flush()
+}
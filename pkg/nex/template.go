@@ -0,0 +1,109 @@
+package nex
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"io"
+	"io/fs"
+	"text/template"
+)
+
+// The skeleton of the generated lexer is written by the templates in
+// templates/*.tmpl, which Options.Templates can override.
+//
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+// lexerData is the data the templates are executed with.
+type lexerData struct {
+	CustomError bool
+	Lex         bool            // Lex is written, returning tokens.
+	Lazy        bool            // The lexer builds its DFAs from NFAs as it runs.
+	Pool        bool            // GetLexer and PutLexer reuse lexers.
+	Split       bool            // Split returns a bufio.SplitFunc.
+	Incremental bool            // Tokens and Relex lex strings and their edits.
+	Parallel    bool            // ParallelTokens lexes strings in chunks.
+	Semantic    *semanticData   // SemanticTokens returns LSP semantic tokens.
+	Participle  *participleData // ParticipleLexer lexes for participle.
+	Filter      bool            // Unmatched text is passed on, for "filter".
+	Families    []familyData    // The families, if there are %family blocks.
+	EOF         bool            // Some family has a %eof action.
+	ByteMode    bool            // The lexer reads bytes rather than runes.
+	Interactive bool            // Matches end without reading past them.
+	BOL         bool            // ^ matches at the start of every line.
+	InvalidUTF8 string          // The policy for invalid UTF-8, "" for replacing it.
+	BOM         string          // The byte order marks skipped, if any.
+	CRLF        bool            // Line breaks "\r\n" are read as "\n".
+	BufferSize  int             // Size of the buffer of NewLexer.
+	Tokens      []string        // The tokens of the goyacc grammar, named by TokenString.
+	Body        string          // The code running the rules of the outermost family.
+}
+
+// familyData names a family, and numbers its first rule, the rules of the
+// families being numbered one after the other. The outermost family comes
+// first, unnamed.
+type familyData struct {
+	Name  string
+	First int
+}
+
+// lexerData returns the data the templates are executed with, but for the
+// body.
+func (g *generator) lexerData() lexerData {
+	size := g.opts.BufferSize
+	if size <= 0 {
+		size = 4096
+	}
+	return lexerData{CustomError: g.opts.CustomError, Lex: !g.opts.Standalone && !g.opts.Filter && !g.opts.Dump, Lazy: g.opts.Lazy, Pool: g.opts.Pool, Split: g.opts.Split, Incremental: g.opts.Incremental, Parallel: g.opts.Parallel, Semantic: g.semantic, Participle: g.participle, Filter: g.opts.Filter, Families: g.families, EOF: g.eof, ByteMode: g.opts.ByteMode, Interactive: g.opts.Interactive, BOL: g.opts.BOL, InvalidUTF8: g.invalid, BOM: g.opts.BOM, CRLF: g.opts.CRLF, BufferSize: size, Tokens: g.opts.Tokens}
+}
+
+// parseTemplates parses the *.tmpl files of fsys into t, applying the prefix
+// and the names of the packages first.
+func (g *generator) parseTemplates(t *template.Template, fsys fs.FS) error {
+	names, err := fs.Glob(fsys, "*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		src, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if _, err := t.New(name).Parse(g.renamePackages(g.rep.Replace(string(src)))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templates returns the built-in templates, redefined by those of
+// Options.Templates.
+func (g *generator) templates() (*template.Template, error) {
+	t := template.New("")
+	builtin, err := fs.Sub(builtinTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if err := g.parseTemplates(t, builtin); err != nil {
+		return nil, err
+	}
+	if g.opts.Templates != nil {
+		if err := g.parseTemplates(t, g.opts.Templates); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// executeFamily executes the template `name` with the code running the rules
+// of a family.
+func (g *generator) executeFamily(w io.Writer, t *template.Template, name string, root rule) error {
+	var body bytes.Buffer
+	out := bufio.NewWriter(&body)
+	g.writeFamily(out, &root, 0)
+	out.Flush()
+	data := g.lexerData()
+	data.Body = body.String()
+	return t.ExecuteTemplate(w, name, data)
+}
@@ -0,0 +1,102 @@
+package nex
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+)
+
+// scopeDirective finds the scope in an action.
+var scopeDirective = regexp.MustCompile(`(?://|/\*)scope:([A-Za-z0-9_.-]+)`)
+
+// A tmGrammar is a TextMate grammar, as read by TextMate and VS Code.
+type tmGrammar struct {
+	Name      string      `json:"name"`
+	ScopeName string      `json:"scopeName"`
+	Patterns  []tmPattern `json:"patterns"`
+}
+
+type tmPattern struct {
+	Name     string               `json:"name,omitempty"`
+	Match    string               `json:"match"`
+	Captures map[string]tmCapture `json:"captures,omitempty"`
+}
+
+type tmCapture struct {
+	Name     string      `json:"name,omitempty"`
+	Patterns []tmPattern `json:"patterns,omitempty"`
+}
+
+// ExportTMGrammar writes to w an approximation of the rules of a spec as a
+// TextMate grammar in JSON, named name, with the given scope name, such as
+// "source.calc". The scope of the matches of a rule is given by a
+// /*scope:NAME*/ or //scope:NAME comment in its action, e.g.
+// /*scope:keyword.control.calc*/; rules without one match unscoped text.
+// The rules nested in a rule are patterns of its whole match.
+//
+// The approximation is lossy: TextMate matches a line at a time, so rules
+// matching newlines only match them at the end of lines, and it takes the
+// first rule matching at the earliest position rather than the longest
+// match.
+func ExportTMGrammar(w io.Writer, sp *Spec, name, scopeName string) error {
+	var o tmOptions
+	for _, opt := range sp.Options {
+		o.caseless = o.caseless || opt == "caseless"
+		o.nonewline = o.nonewline || opt == "nonewline"
+	}
+	defs, err := parseDefines(specDefines(sp), "<spec>")
+	if err != nil {
+		return err
+	}
+	o.defs = defs
+	patterns, err := tmPatterns(sp.Rules, o)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tmGrammar{name, scopeName, patterns})
+}
+
+// tmOptions holds what of a spec applies to all its patterns.
+type tmOptions struct {
+	defs      map[string]*Regex // The regexes of the %define lines.
+	caseless  bool              // Set by %option caseless.
+	nonewline bool              // Set by %option nonewline.
+}
+
+// tmPatterns returns the patterns of rules.
+func tmPatterns(rules []*Rule, o tmOptions) ([]tmPattern, error) {
+	var patterns []tmPattern
+	for _, r := range byPriority(rules) {
+		re, pos, err := parseRegex([]rune(r.Regex), o.defs)
+		if err != nil {
+			return nil, &Error{"<spec>", r.Line, r.Col + 1 + pos, "regex", err}
+		}
+		if o.nonewline {
+			re = excludeNewline(re)
+		}
+		p := tmPattern{Match: foreignRegex(re, `[\s\S]`)}
+		if o.caseless {
+			p.Match = "(?i)" + p.Match
+		}
+		if r.Rules == nil {
+			if m := scopeDirective.FindStringSubmatch(r.Action); m != nil {
+				p.Name = m[1]
+			}
+		} else {
+			kids, err := tmPatterns(r.Rules, o)
+			if err != nil {
+				return nil, err
+			}
+			c := tmCapture{Patterns: kids}
+			if m := scopeDirective.FindStringSubmatch(r.StartAction); m != nil {
+				c.Name = m[1]
+			}
+			p.Captures = map[string]tmCapture{"0": c}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,32 @@
+package nex
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// modulePath is the path of the module providing this package.
+const modulePath = "github.com/blynn/nex"
+
+// Version returns the module version of nex as recorded by the Go toolchain
+// in the running binary, or "(devel)" when it is unknown, e.g. in GOPATH
+// builds.
+func Version() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			return info.Main.Version
+		}
+		for _, m := range info.Deps {
+			if m.Path == modulePath {
+				return m.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+// generatedHeader returns the comment that marks files written by nex as
+// generated, per https://golang.org/s/generatedcode.
+func generatedHeader() string {
+	return fmt.Sprintf("// Code generated by nex %s. DO NOT EDIT.\n\n", Version())
+}
@@ -0,0 +1,256 @@
+package nex
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseTokens returns the names of the tokens a goyacc grammar declares with
+// %token, %left, %right and %nonassoc, in order. goyacc declares a constant
+// for each of them in the package of the parser, which is that of the lexer.
+// Literal tokens such as '+' have no name and are left out.
+func ParseTokens(input io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	src := string(b)
+	var names []string
+	seen := make(map[string]bool)
+	declaring := false
+	i := 0
+	// skipTo skips past the next occurrence of end, failing if there is none.
+	skipTo := func(end string, what string) error {
+		for j := i; j+len(end) <= len(src); j++ {
+			if src[j:j+len(end)] == end {
+				i = j + len(end)
+				return nil
+			}
+		}
+		return fmt.Errorf("unterminated %s", what)
+	}
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '%' && i+1 < len(src) && src[i+1] == '%':
+			return names, nil
+		case c == '%' && i+1 < len(src) && src[i+1] == '{':
+			if err := skipTo("%}", "%{ block"); err != nil {
+				return nil, err
+			}
+		case c == '%':
+			j := i + 1
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			keyword := src[i+1 : j]
+			i = j
+			switch keyword {
+			case "token", "left", "right", "nonassoc":
+				declaring = true
+			default:
+				declaring = false
+			}
+			if keyword == "union" {
+				// Skip the Go struct fields, braces included.
+				if err := skipTo("{", "%union"); err != nil {
+					return nil, err
+				}
+				for depth := 1; depth > 0; i++ {
+					if i == len(src) {
+						return nil, errors.New("unterminated %union")
+					}
+					switch src[i] {
+					case '{':
+						depth++
+					case '}':
+						depth--
+					}
+				}
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			if err := skipTo("*/", "comment"); err != nil {
+				return nil, err
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			if err := skipTo("\n", "comment"); err != nil {
+				i = len(src)
+			}
+		case c == '<':
+			if err := skipTo(">", "type"); err != nil {
+				return nil, err
+			}
+		case c == '\'' || c == '"':
+			i++
+			for i < len(src) && src[i] != c && src[i] != '\n' {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+		case isIdentByte(c) && !('0' <= c && c <= '9'):
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			if name := src[i:j]; declaring && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			i = j
+		case '0' <= c && c <= '9':
+			// The value of the token before it.
+			for i < len(src) && isIdentByte(src[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+	return names, nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// looksLikeToken reports whether name is spelt like the names goyacc
+// grammars give their tokens: capitals, digits and underscores.
+func looksLikeToken(name string) bool {
+	upper := false
+	for _, r := range name {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case r == '_' || unicode.IsDigit(r):
+		default:
+			return false
+		}
+	}
+	return upper
+}
+
+// isToken tells whether s can be the token of a %type annotation: a name,
+// or a rune literal such as '+'.
+func isToken(s string) bool {
+	if strings.HasPrefix(s, "'") {
+		_, err := strconv.Unquote(s)
+		return err == nil
+	}
+	return isName(s)
+}
+
+// isFunc tells whether s can be the function of a %type annotation: a name,
+// perhaps qualified by that of a package.
+func isFunc(s string) bool {
+	parts := strings.Split(s, ".")
+	for _, part := range parts {
+		if !isName(part) {
+			return false
+		}
+	}
+	return len(parts) <= 2
+}
+
+// typedAction returns the code run on a match of a rule annotated with
+// %type: the text of the match is stored in lval, converted if need be, then
+// the action runs, and the token is returned.
+func typedAction(r *Rule) string {
+	var b strings.Builder
+	b.WriteString("{\n")
+	if r.Field != "" {
+		text := "yylex.Text()"
+		if r.Convert != "" {
+			text = r.Convert + "(" + text + ")"
+		}
+		b.WriteString("lval." + r.Field + " = " + text + "\n")
+	}
+	if r.Action != "" {
+		b.WriteString(r.Action + "\n")
+	}
+	b.WriteString("return " + r.Token + "\n}")
+	return b.String()
+}
+
+// typedRule returns the first of the rules, nested ones included, annotated
+// with %type, or nil if there is none.
+func typedRule(rules []*Rule) *Rule {
+	for _, r := range rules {
+		if r.Token != "" {
+			return r
+		}
+		if x := typedRule(r.Rules); x != nil {
+			return x
+		}
+	}
+	return nil
+}
+
+// checkTokens checks that the rules return no identifier spelt like a token
+// that is neither one of g.opts.Tokens nor declared by the Go code of the
+// spec.
+func (g *generator) checkTokens(rules []*Rule, code string) error {
+	declared := make(map[string]bool)
+	for _, name := range g.opts.Tokens {
+		declared[name] = true
+	}
+	if f, err := parser.ParseFile(token.NewFileSet(), "", code, 0); err == nil {
+		for name := range f.Scope.Objects {
+			declared[name] = true
+		}
+	}
+	var check func(rules []*Rule) error
+	check = func(rules []*Rule) error {
+		for _, r := range rules {
+			codes := []string{r.Action, r.StartAction, r.EndAction}
+			if r.Token != "" {
+				codes = append(codes, typedAction(r))
+			}
+			for _, code := range codes {
+				if name := undeclaredToken(code, declared); name != "" {
+					return &Error{g.filename, r.Line, r.Col, "token", fmt.Errorf("undeclared token %s", name)}
+				}
+			}
+			if err := check(r.Rules); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(rules)
+}
+
+// undeclaredToken returns the first identifier an action returns that is
+// spelt like a token but is neither declared nor a variable of the action,
+// or "" if there is none.
+func undeclaredToken(code string, declared map[string]bool) string {
+	if code == "" {
+		return ""
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p; func _() "+code, 0)
+	if err != nil {
+		return ""
+	}
+	found := ""
+	ast.Inspect(f, func(n ast.Node) bool {
+		ret, ok := n.(*ast.ReturnStmt)
+		if !ok || found != "" || len(ret.Results) != 1 {
+			return found == ""
+		}
+		// Identifiers the action declares have an Obj.
+		if id, ok := ret.Results[0].(*ast.Ident); ok && id.Obj == nil && looksLikeToken(id.Name) && !declared[id.Name] {
+			found = id.Name
+		}
+		return false
+	})
+	return found
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// cpuProfile and memProfile are set by the -cpuprofile and -memprofile flags.
+var cpuProfile, memProfile string
+
+// profiled returns run, profiled as the -cpuprofile and -memprofile flags
+// ask. With -watch, each run overwrites the profiles of the previous one.
+func profiled(run func(inputs []string) bool) func(inputs []string) bool {
+	if cpuProfile == "" && memProfile == "" {
+		return run
+	}
+	return func(inputs []string) bool {
+		if cpuProfile != "" {
+			f, err := os.Create(cpuProfile)
+			dieErr(err, "nex")
+			dieErr(pprof.StartCPUProfile(f), "nex")
+			defer func() {
+				pprof.StopCPUProfile()
+				dieErr(f.Close(), "nex")
+			}()
+		}
+		ok := run(inputs)
+		if memProfile != "" {
+			f, err := os.Create(memProfile)
+			dieErr(err, "nex")
+			// The allocations since the start are recorded as of the last
+			// garbage collection.
+			runtime.GC()
+			dieErr(pprof.Lookup("allocs").WriteTo(f, 0), "nex")
+			dieErr(f.Close(), "nex")
+		}
+		return ok
+	}
+}
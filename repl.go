@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// compileSpec compiles the spec `name` without generating any code.
+func compileSpec(name string) (*nex.Program, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	inFilename = name
+	return nex.Compile(f, nex.Options{Filename: name, Warn: warn})
+}
+
+// replMain implements `nex repl`, which lexes lines typed by the user with
+// the rules of a spec and shows the tokens found. It returns the status of
+// the failure that ends it, if any.
+func replMain(args []string) int {
+	fs := flag.NewFlagSet("nex repl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: nex repl spec.nex")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	p, err := compileSpec(fs.Arg(0))
+	if err != nil {
+		report(fs.Arg(0), err)
+		return exitStatus
+	}
+	prompt := ""
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		prompt = "> "
+		fmt.Printf("Each line is lexed as a whole input, including its newline.\n")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print(prompt)
+		line, err := in.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				report("", err)
+				return exitStatus
+			}
+			if prompt != "" {
+				fmt.Println()
+			}
+			return 0
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		err = p.Tokenize(line, func(t nex.Token) {
+			indent := strings.Repeat("  ", t.Depth)
+			end := t.Col + len([]rune(t.Text))
+			if t.Rule < 0 {
+				fmt.Fprintf(tw, "%s%d-%d\tno match\t%q\n", indent, t.Col, end, t.Text)
+				return
+			}
+			fmt.Fprintf(tw, "%s%d-%d\tline %d /%s/\t%q\n", indent, t.Col, end, t.Line, t.Regex, t.Text)
+		})
+		tw.Flush()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// specTokens lexes input with the rules of a spec, without running any
+// actions, and returns one line per token: the spec line of the rule that
+// matched, or "-" if none did, followed by the quoted text. The tokens of
+// nested families are indented by two spaces per level.
+func specTokens(p *nex.Program, input string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := p.Tokenize(input, func(t nex.Token) {
+		buf.WriteString(strings.Repeat("  ", t.Depth))
+		if t.Rule < 0 {
+			fmt.Fprintf(&buf, "- %q\n", t.Text)
+		} else {
+			fmt.Fprintf(&buf, "%d %q\n", t.Line, t.Text)
+		}
+	})
+	return buf.Bytes(), err
+}
+
+// testMain implements `nex test`, which checks the token streams of the
+// testdata/*.input files beside each spec against the *.want golden files.
+// These are not the *.tokens files of -gentest, which hold the values
+// returned by Lex() rather than the lines of rules.
+// Failing inputs are classed as errors in the spec, with status exitSpec.
+func testMain(args []string) int {
+	fs := flag.NewFlagSet("nex test", flag.ExitOnError)
+	update := fs.Bool("update", false, "rewrite the golden files instead of comparing against them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: nex test [-update] spec.nex...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	specs, err := expandInputs(fs.Args())
+	dieErr(err, "nex test")
+	for _, spec := range specs {
+		p, err := compileSpec(spec)
+		if err != nil {
+			report(spec, err)
+			continue
+		}
+		inputs, err := filepath.Glob(filepath.Join(filepath.Dir(spec), "testdata", "*.input"))
+		dieErr(err, "nex test")
+		if len(inputs) == 0 {
+			fmt.Printf("?    %s\t[no testdata/*.input files]\n", spec)
+			continue
+		}
+		failed := 0
+		for _, input := range inputs {
+			if err := testInput(p, input, *update); err != nil {
+				fmt.Printf("--- FAIL: %s\n%v\n", input, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			fmt.Printf("FAIL %s\t%d of %d inputs\n", spec, failed, len(inputs))
+			fail(exitSpec)
+		} else {
+			fmt.Printf("ok   %s\t%d inputs\n", spec, len(inputs))
+		}
+	}
+	return exitStatus
+}
+
+// testInput compares the tokens of the file `input` with its golden file,
+// or writes the golden file if update is set.
+func testInput(p *nex.Program, input string, update bool) error {
+	src, err := ioutil.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	got, err := specTokens(p, string(src))
+	if err != nil {
+		return err
+	}
+	golden := strings.TrimSuffix(input, ".input") + ".want"
+	if update {
+		return ioutil.WriteFile(golden, got, 0666)
+	}
+	want, err := ioutil.ReadFile(golden)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is missing; run nex test -update to create it", golden)
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	d, err := diffBytes(golden, want, got)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s", bytes.TrimSuffix(d, []byte("\n")))
+}
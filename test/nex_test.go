@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 var nexBin string
@@ -85,6 +91,10 @@ func TestNexPrograms(t *testing.T) {
 	for _, x := range []struct {
 		prog, in, out string
 	}{
+		{"bin.nex", "\xff\xfe\x01hi\x00\xc3\xa9\n", "magic\nstring \"\\x01hi\\x00\"\nhigh c3 at 6\nhigh a9 at 7\nbyte 0a\n"},
+
+		{"nul.nex", "\x00a\u00e9\x00\x01\x02\x00\n", "field \"\\x00a\u00e9\\x00\"\ncontrol \"\\x01\\x02\"\nrune \"\\x00\"\n"},
+		{"invalid.nex", "ab\xffc\u00e9\xc3 x", "word ab\ninvalid ff at 2\nword c\u00e9\ninvalid c3 at 5\nword x\n"},
 		{"lc.nex", "no newline", "0 10\n"},
 		{"lc.nex", "one two three\nfour five six\n", "2 28\n"},
 
@@ -260,196 +270,2204 @@ rect 11 12 16 17
 		{"peter2.nex", "###\n#\n####\n", "rect 1 4 1 2\nrect 1 2 2 3\nrect 1 5 3 4\n"},
 		{"u.nex", "١ + ٢ + ... + ١٨ = 一百五十三", "1 + 2 + ... + 18 = 153"},
 	} {
-		cmd := exec.Command(nexBin, "-r", "-s", x.prog)
-		cmd.Stdin = strings.NewReader(x.in)
-		got, err := cmd.CombinedOutput()
-		dieErr(t, err, x.prog+" "+string(got))
-		if string(got) != x.out {
-			t.Fatalf("program: %s\nwant %q, got %q", x.prog, x.out, string(got))
+		// Lazy lexers, and those with full tables, must behave the same.
+		// The warnings of TestStrict are silenced by -q.
+		for _, mode := range []string{"-lazy=false", "-lazy", "-fast"} {
+			cmd := exec.Command(nexBin, "-r", "-s", "-q", mode, x.prog)
+			cmd.Stdin = strings.NewReader(x.in)
+			got, err := cmd.CombinedOutput()
+			dieErr(t, err, x.prog+" "+mode+" "+string(got))
+			if string(got) != x.out {
+				t.Fatalf("program: %s %s\nwant %q, got %q", x.prog, mode, x.out, string(got))
+			}
 		}
 	}
 }
 
-// To save time, we combine several test cases into a single nex program.
-func TestGiantProgram(t *testing.T) {
+// runSpec writes spec to a file and runs it with nex -r, given the flags
+// args and the standard input in, and returns what it prints.
+func runSpec(t *testing.T, spec, in string, args ...string) string {
 	tmpdir, err := ioutil.TempDir("", "nex")
 	dieErr(t, err, "TempDir")
-	wd, err := os.Getwd()
-	dieErr(t, err, "Getwd")
-	dieErr(t, os.Chdir(tmpdir), "Chdir")
 	defer func() {
 		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
 	}()
-	defer func() {
-		dieErr(t, os.Chdir(wd), "Chdir")
-	}()
-	s := "package main\n"
-	body := ""
-	for i, x := range []struct {
-		prog, in, out string
+	name := filepath.Join(tmpdir, "spec.nex")
+	dieErr(t, ioutil.WriteFile(name, []byte(spec), 0666), "WriteFile")
+	cmd := exec.Command(nexBin, append(append([]string{"-r"}, args...), name)...)
+	cmd.Stdin = strings.NewReader(in)
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	return string(got)
+}
+
+// Test specs whose Go code exercises the features of the generated lexers.
+func TestSpecs(t *testing.T) {
+	for _, x := range []struct {
+		name          string
+		args          []string // Flags of nex.
+		modes         []string // Flags tried in turn, if any, which must agree.
+		spec, in, out string
 	}{
-		// Test parentheses and $.
-		{`
-/[a-z]*/ <  { *lval += "[" }
-  /a(($*|$$)($($)$$$))$($$$)*/ { *lval += "0" }
-  /(e$|f$)/ { *lval += "1" }
-  /(qux)*/  { *lval += "2" }
-  /$/       { *lval += "." }
->           { *lval += "]" }
-`, "a b c d e f g aaab aaaa eeeg fffe quxqux quxq quxe",
-			"[0][.][.][.][1][1][.][.][0][.][1][2][2][21]"},
-		// Exercise ^ and rule precedence.
-		{`
-/[a-z]*/ <  { *lval += "[" }
-  /((^*|^^)(^(^)^^^))^(^^^)*bar/ { *lval += "0" }
-  /(^foo)*/ { *lval += "1" }
-  /^fooo$/  { *lval += "2" }
-  /^f(oo)*/ { *lval += "3" }
-  /^foo*/   { *lval += "4" }
-  /^/       { *lval += "." }
->           { *lval += "]" }
-`, "foo bar foooo fooo fooooo fooof baz foofoo",
-			"[1][0][3][2][4][4][.][1]"},
-		// Anchored empty matches.
-		{`
-/^/ { *lval += "BEGIN" }
-/$/ { *lval += "END" }
-`, "", "BEGIN"},
+		// Test that pooled lexers can be put back before reaching the end of their
+		// input, and lex their next input from the start, and that they leave
+		// readers given to them alone.
+		{name: "pool", args: []string{"-s", "-pool"}, spec: `/[a-z]+/ { n++; if n == limit { return } }
+/./ { }
+//
+package main
 
-		{`
-/$/ { *lval += "END" }
-/^/ { *lval += "BEGIN" }
-`, "", "END"},
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
 
-		{`
-/^$/ { *lval += "BOTH" }
-/^/ { *lval += "BEGIN" }
-/$/ { *lval += "END" }
-`, "", "BOTH"},
-		// Built-in Line and Column counters.
-		// Ugly hack to import fmt.
-		{`"fmt"
-/\*/    { *lval += yySymType(fmt.Sprintf("[%d,%d]", yylex.Line(), yylex.Column())) }
+var n, limit int
+
+func count(in string, lim int) int {
+	n, limit = 0, lim
+	lx := GetLexer(strings.NewReader(in))
+	NN_FUN(lx)
+	PutLexer(lx)
+	return n
+}
+
+func main() {
+	for i := 0; i < 3; i++ {
+		fmt.Println(count("a b c d", 2), count("ab cd ef", -1))
+	}
+	br := bufio.NewReader(strings.NewReader("ab cd"))
+	n, limit = 0, 1
+	lx := GetLexer(br)
+	NN_FUN(lx)
+	PutLexer(lx)
+	_, err := br.ReadString('\n')
+	fmt.Println(n, err)
+	n, limit = 0, -1
+	NN_FUN(NewLexerReader(strings.NewReader("x y z")))
+	fmt.Println(n)
+}
 `,
-			`..*.
-**
-...
-...*.*
-*
-`, "[0,2][1,0][1,1][3,3][3,5][4,0]"},
-		// Patterns like awk's BEGIN and END.
-		{`
-<          { *lval += "[" }
-  /[0-9]*/ { *lval += "N" }
-  /;/      { *lval += ";" }
-  /./      { *lval += "." }
->          { *lval += "]\n" }
-`, "abc 123 xyz;a1b2c3;42", "[....N....;.N.N.N;N]\n"},
-		// A partial match regex has no effect on an immediately following match.
-		{`
-/abcd/ { *lval += "ABCD" }
-/\n/   { *lval += "\n" }
-`, "abcd\nbabcd\naabcd\nabcabcd\n", "ABCD\nABCD\nABCD\nABCD\n"},
+			out: "2 3\n2 3\n2 3\n1 EOF\n3\n"},
+		// Test that a pooled lexer forgets where the scans of its last input got
+		// stuck, so that abc is matched whole after ab.
+		{name: "poolreset", args: []string{"-pool"}, spec: `/[a-z]+/ < { }
+  /abc/ { return 3 }
+  /a/ { return 1 }
+  /b/ { return 2 }
+  /c/ { return 4 }
+> { }
+/./ { }
+//
+package main
 
-		// Nested regex test. The simplistic parser means we must use commented
-		// braces to balance out quoted braces.
-		// Sprinkle in a couple of return statements to check Lex() saves stack
-		// state correctly between calls.
-		{`
-/a[bcd]*e/ < { *lval += "[" }
-  /a/        { *lval += "A" }
-  /bcd/ <    { *lval += "(" }
-  /c/        { *lval += "X"; return 1 }
-  >          { *lval += ")" }
-  /e/        { *lval += "E" }
-  /ccc/ <    {
-    *lval += "{"
-    // }  [balance out the quoted left brace]
-  }
-  /./        { *lval += "?" }
-  >          {
-    // {  [balance out the quoted right brace]
-    *lval += "}"
-    return 2
-  }
->            { *lval += "]" }
-/\n/ { *lval += "\n" }
-/./ { *lval += "." }
-`, "abcdeabcabcdabcdddcccbbbcde", "[A(X)E].......[A(X){???}(X)E]"},
+import (
+	"fmt"
+	"strings"
+)
 
-		// Exercise hyphens in character classes.
-		{`
-/[a-z-]*/ < { *lval += "[" }
-  /[^-a-df-m]/ { *lval += "0" }
-  /./       { *lval += "1" }
->           { *lval += "]" }
-/\n/ { *lval += "\n" }
-/./ { *lval += "." }
-`, "-azb-ycx@d--w-e-", "[11011010].[1110101]"},
+type yySymType struct{}
 
-		// Overlapping character classes.
-		{`
-/[a-e]+[d-h]+/ { *lval += "0" }
-/[m-n]+[k-p]+[^k-r]+[o-p]+/ { *lval += "1" }
-/./ { *(*string)(lval) += yylex.Text() }
-`, "abcdefghijmnopabcoq", "0ij1q"},
-	} {
-		id := fmt.Sprintf("%v", i)
-		s += `import "./nex_test` + id + "\"\n"
-		dieErr(t, os.Mkdir("nex_test"+id, 0777), "Mkdir")
-		// Ugly hack to import packages.
-		prog := x.prog
-		importLine := ""
-		if prog[0] != '\n' {
-			v := strings.SplitN(prog, "\n", 2)
-			prog = v[1]
-			importLine = "import " + v[0]
-		}
-		dieErr(t, ioutil.WriteFile(id+".nex", []byte(prog+`//
-package nex_test`+id+`
+func lex(in string) {
+	lx := GetLexer(strings.NewReader(in))
+	for t := lx.Lex(nil); t != 0; t = lx.Lex(nil) {
+		fmt.Print(t, " ")
+	}
+	fmt.Println()
+	PutLexer(lx)
+}
 
-`+importLine+`
+func main() {
+	lex("ab")
+	lex("abc")
+	lex("ab abc")
+}
+`,
+			out: "1 2 \n3 \n1 2 3 \n"},
+		// Test that a nested scan failing at the end of its input, as /abc/ does
+		// on ab, leaves no failures behind for the next nested scan, which must
+		// still match abc whole.
+		{name: "failures", args: []string{"-s"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/[a-z]+/ < { }
+  /abc/ { fmt.Print("abc ") }
+  /a/ { fmt.Print("a ") }
+  /b/ { fmt.Print("b ") }
+  /c/ { fmt.Print("c ") }
+> { }
+/./ { }
+//
+package main
 
-type yySymType string
+import (
+	"fmt"
+	"os"
+)
 
-func Go() {
-  x := NewLexer(bufio.NewReader(strings.NewReader(`+"`"+x.in+"`"+`)))
-  lval := new(yySymType)
-  for x.Lex(lval) != 0 { }
-  s := string(*lval)
-  if s != `+"`"+x.out+"`"+`{
-    panic(`+"`"+x.prog+": want "+x.out+", got ` + s"+`)
-  }
+func main() {
+	NN_FUN(NewLexer(os.Stdin))
+	fmt.Println()
 }
-`), 0777), "WriteFile")
-		_, cerr := exec.Command(nexBin, "-o", filepath.Join("nex_test"+id, "tmp.go"), id+".nex").CombinedOutput()
-		dieErr(t, cerr, "nex: "+s)
-		body += "nex_test" + id + ".Go()\n"
+`,
+			in: "ab abc", out: "a b abc \n"},
+		// Test that the runes left over when a rule fails at the end of the
+		// input, as /xyzw/ does on xyz, are all lexed again.
+		{name: "eofrescan", args: []string{"-s"}, modes: []string{"-lazy=false", "-lazy", "-fast"}, spec: `/./ { fmt.Printf("%q ", yylex.Text()) }
+/xyzw/ { fmt.Print("xyzw ") }
+//
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	NN_FUN(NewLexer(os.Stdin))
+	fmt.Println()
+	NN_FUN(NewLexerString("xyz"))
+	fmt.Println()
+}
+`,
+			in: "xyz", out: "\"x\" \"y\" \"z\" \n\"x\" \"y\" \"z\" \n"},
+		// Test that the texts of lexers reading strings and byte slices, nested ones
+		// included, are slices of their input.
+		{name: "string", args: []string{"-s"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/[^\n]*\n/ < { }
+  /[a-zé]+/ { show(yylex.Text()) }
+  /./ { }
+> { }
+//
+package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+var in string
+
+// show prints text and where it starts in the input, -1 if it is a copy.
+func show(text string) {
+	at := int(uintptr(unsafe.Pointer(unsafe.StringData(text))) - uintptr(unsafe.Pointer(unsafe.StringData(in))))
+	if at < 0 || at >= len(in) {
+		at = -1
 	}
-	s += "func main() {\n" + body + "}\n"
-	err = ioutil.WriteFile("tmp.go", []byte(s), 0777)
-	dieErr(t, err, "WriteFile")
-	output, err := exec.Command("go", "run", "tmp.go").CombinedOutput()
-	dieErr(t, err, string(output))
+	fmt.Printf("%s %d ", text, at)
 }
 
-func copy(dst, src string) error {
-	s, err := os.Open(src)
-	if err != nil {
-		return err
+func main() {
+	in = "ab,\xffcd\nété f\n"
+	NN_FUN(NewLexerString(in))
+	fmt.Println()
+	b := []byte("gh ij\n")
+	in = unsafe.String(&b[0], len(b))
+	NN_FUN(NewLexerBytes(b))
+	fmt.Println()
+}
+`,
+			out: "ab 0 cd 4 été 7 f 13 \ngh 0 ij 3 \n"},
+		// Test that Position gives the positions of matches, nested ones included,
+		// as text/scanner does.
+		{name: "position", args: []string{"-s"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/[^\n]*\n/ < { }
+  /[a-zé]+/ { p := yylex.Position(); fmt.Println(yylex.Text(), p, p.Offset) }
+  /./ { }
+> { }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	for _, in := range []string{"ab été\ncd\n", "été x\n"} {
+		lx := NewLexer(strings.NewReader(in))
+		lx.Filename = "in"
+		NN_FUN(lx)
+		lx = NewLexerString(in)
+		NN_FUN(lx)
 	}
-	defer s.Close()
-	d, err := os.Create(dst)
-	if err != nil {
-		return err
+}
+`,
+			out: `ab in:1:1 0
+été in:1:4 3
+cd in:2:1 9
+ab <input>:1:1 0
+été <input>:1:4 3
+cd <input>:2:1 9
+été in:1:1 0
+x in:1:5 6
+été <input>:1:1 0
+x <input>:1:5 6
+`},
+		// Test that TokenPos gives positions in a token.FileSet, whose line table
+		// the lexer fills in.
+		{name: "tokenpos", args: []string{"-s"}, spec: `/[a-z]+/ { fmt.Println(yylex.Text(), fset.Position(yylex.TokenPos())) }
+/"[^"]*"/ { }
+/[ \n]/ { }
+//
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+var fset = token.NewFileSet()
+
+func main() {
+	fset.AddFile("skip.go", -1, 10)
+	for _, in := range []string{"ab\n\"\n\n\" cd\nef\n", "x\n\ny"} {
+		lx := NewLexer(strings.NewReader(in))
+		lx.SetFile(fset.AddFile("in.go", -1, len(in)))
+		NN_FUN(lx)
 	}
-	if _, err := io.Copy(d, s); err != nil {
-		d.Close()
-		return err
+}
+`,
+			out: "ab in.go:1:1\ncd in.go:4:3\nef in.go:5:1\nx in.go:1:1\ny in.go:3:1\n"},
+		// Test that Split splits the input of a bufio.Scanner into the matches of
+		// the outermost rules, even when they straddle the reads of the Scanner.
+		{name: "split", args: []string{"-s", "-split"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/^#[^\n]*/ { }
+/[a-zé]+/ < { }
+  /a/ { }
+> { }
+/[0-9]+/ { }
+/=+$/ { }
+/ / { }
+//
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing/iotest"
+)
+
+func main() {
+	in := "#x ab\n#y 12 été== 3 == =="
+	sc := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(in)))
+	sc.Split(Split())
+	for sc.Scan() {
+		fmt.Printf("%q ", sc.Text())
 	}
-	return d.Close()
+	fmt.Println(sc.Err())
 }
+`,
+			out: `"#x ab" "y" " " "12" " " "été" " " "3" " " " " "==" <nil>` + "\n"},
+		// Test that Relex gives the tokens Tokens gives for the edited text, and
+		// only lexes again those the edit can change.
+		{name: "relex", args: []string{"-s", "-incremental"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/^#[^\n]*/ { }
+/a*b/ { }
+/a/ { }
+/"[^"]*"/ { }
+/[0-9]+/ { }
+/[ \n]+/ { }
+/z$/ { }
+//
+package main
 
-func copyToDir(dst, src string) error {
-	return copy(filepath.Join(dst, filepath.Base(src)), src)
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+)
+
+func main() {
+	src := "#x\n12 \"ab\" aaab aa 7"
+	toks := Tokens(src)
+	// Growing 12 lexes it again, and no other token.
+	next := src[:5] + "3" + src[5:]
+	toks, from, to := Relex(toks, next, 5, 5, 6)
+	fmt.Println(from, to, len(toks))
+	src = next
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		start := rnd.Intn(len(src) + 1)
+		end := start + rnd.Intn(len(src)-start+1)
+		if end-start > 3 {
+			end = start + 3
+		}
+		ins := ""
+		for k := rnd.Intn(4); k > 0; k-- {
+			ins += string("ab 1\"\n#z"[rnd.Intn(8)])
+		}
+		next := src[:start] + ins + src[end:]
+		if len(next) > 60 {
+			next = src[:start] + src[end:]
+			ins = ""
+		}
+		got, _, _ := Relex(toks, next, start, end, start+len(ins))
+		if want := Tokens(next); !reflect.DeepEqual(got, want) {
+			fmt.Printf("%q to %q: got %v, want %v\n", src, next, got, want)
+			return
+		}
+		src, toks = next, got
+	}
+	fmt.Println("ok")
+}
+`,
+			out: "2 3 12\nok\n"},
+		// Test that ParallelTokens gives the tokens a single goroutine does, however
+		// the chunks are cut.
+		{name: "parallel", args: []string{"-s", "-parallel"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/^#[^\n]*/ { }
+/a*b/ { }
+/a/ { }
+/"[^"]*"/ { }
+/[0-9]+/ { }
+/[ \n]+/ { }
+/é+/ { }
+/z$/ { }
+//
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+func main() {
+	src := strings.Repeat("#x\n12 \"a b\nc\" aaab aa 7 éé\n", 20) + "aaaz"
+	want := ParallelTokens(src, "", 1)
+	for _, sep := range []string{"", "\n", " ", "a", "é", "\"", "#x"} {
+		for n := 0; n < 40; n++ {
+			if got := ParallelTokens(src, sep, n); !reflect.DeepEqual(got, want) {
+				fmt.Printf("%q in %d chunks: got %v, want %v\n", sep, n, got, want)
+				return
+			}
+		}
+	}
+	fmt.Println(len(want), want[len(want)-1].Rule)
+}
+`,
+			out: "323 7\n"},
+		// Test that SemanticTokens gives the LSP semantic tokens of the rules, in
+		// UTF-16 code units, a line at a time.
+		{name: "semantic", args: []string{"-s", "-semantic"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/if|else/ { /*semantic:keyword*/ }
+/[a-zé😀]+/ { /*semantic:variable.readonly.static*/ }
+/"[^"]*"/ < { }
+  /\\./ { /*semantic:regexp.static*/ }
+  /[^\\]+/ { /*semantic:string*/ }
+> { }
+/./ { }
+//
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(SemanticTokenTypes(), SemanticTokenModifiers())
+	fmt.Println(SemanticTokens("if é😀x\n else \"a\\n\nb\""))
+}
+`,
+			out: "[keyword variable regexp string] [readonly static]\n" +
+				"[0 0 2 0 0 0 3 4 1 3 1 1 4 0 0 0 5 2 3 0 0 2 2 2 2 1 0 2 3 0]\n"},
+		// Test that the end actions of rules get what their nested rules yield.
+		{name: "yield", args: []string{"-s"}, spec: `/{[^}]*}/ < { }
+  /\[[^\]]*\]/ < { }
+    /[0-9]+/ { n, _ := strconv.Atoi(yylex.Text()); yylex.Yield(n) }
+  > { vs, _ := yylex.Nested(); yylex.Yield(vs) }
+  /x/ { yylex.YieldError(errors.New("bad x")) }
+> { vs, err := yylex.Nested(); fmt.Println(vs, err) }
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	NN_FUN(NewLexer(strings.NewReader("{[1 2] x [3] x} {} {[4]}")))
+}
+`,
+			out: "[[1 2] [3]] bad x\n[] <nil>\n[[4]] <nil>\n"},
+		// Test that actions can switch the rules lexing the rest of the input.
+		{name: "families", args: []string{"-s"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/<<\n/ { yylex.PushFamily(HEREDOC) }
+/[a-z]+/ { fmt.Printf("word %s\n", yylex.Text()) }
+%family HEREDOC <
+  /END\n/ { yylex.PopFamily() }
+  /[^\n]*\n/ < { }
+    /[a-z]+/ { fmt.Printf("line %s\n", yylex.Text()) }
+  > { }
+>
+//
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	NN_FUN(NewLexer(os.Stdin))
+}
+`,
+			in:  "ab <<\ncd <<\nEND\nef",
+			out: "word ab\nline cd\nword ef\n"},
+		// Test that %eof actions run as the input of their family runs out, once
+		// even if they return.
+		{name: "eof", modes: []string{"-lazy=false", "-lazy"}, spec: `%eof { fmt.Println("eof", yylex.Position()) }
+/\(/ { yylex.PushFamily(COMMENT) }
+/"[^"]*"?/ < { }
+  %eof { return 1 }
+  /"$/ { fmt.Println("closed") }
+> { fmt.Println("string") }
+/[a-z]+/ { return 2 }
+%family COMMENT <
+  %eof { fmt.Println("unterminated comment") }
+  /\)/ { yylex.PopFamily() }
+>
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type yySymType struct{}
+
+func main() {
+	for _, in := range []string{"ab \"c\" d", "(x) \"", "e (f"} {
+		lx := NewLexer(strings.NewReader(in))
+		for tok := lx.Lex(nil); tok != 0; tok = lx.Lex(nil) {
+			fmt.Print(tok, " ")
+		}
+	}
+}
+`,
+			out: "2 closed\n1 string\n2 eof <input>:1:9\nclosed\n1 string\neof <input>:1:6\n2 unterminated comment\n"},
+		// Test that the hooks of Lex see, drop and change the tokens.
+		{name: "hooks", spec: `/[a-z]+/ { lval.s = yylex.Text(); return WORD }
+/[0-9]+/ { return NUM }
+/ +/ { return SPACE }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/scanner"
+)
+
+const (
+	WORD = iota + 1
+	NUM
+	SPACE
+	KEYWORD
+)
+
+type yySymType struct{ s string }
+
+func main() {
+	lx := NewLexer(strings.NewReader("ab  12 if"))
+	lx.FilterTokens(func(kind int, text string, lval *yySymType) (int, bool) {
+		if kind == WORD && lval.s == "if" {
+			return KEYWORD, true
+		}
+		return kind, kind != SPACE
+	})
+	lx.OnToken(func(kind int, text string, pos scanner.Position) {
+		fmt.Printf("%d %q %v\n", kind, text, pos)
+	})
+	var lval yySymType
+	for lx.Lex(&lval) != 0 {
+	}
+}
+`,
+			out: "1 \"ab\" <input>:1:1\n2 \"12\" <input>:1:5\n4 \"if\" <input>:1:8\n0 \"\" <input>:1:1\n"},
+		// Test that Error records errors with their positions for Errors.
+		{name: "errors", spec: `/[a-z]+/ { return WORD }
+/[0-9]+/ { return NUM }
+/[ \n]+/ { }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	WORD = iota + 1
+	NUM
+)
+
+type yySymType struct{}
+
+func main() {
+	lx := NewLexer(strings.NewReader("ab 12\ncd 3"))
+	var lval yySymType
+	for kind := lx.Lex(&lval); kind != 0; kind = lx.Lex(&lval) {
+		if kind == NUM {
+			lx.Error("unexpected number")
+		}
+	}
+	for _, e := range lx.Errors() {
+		fmt.Println(e)
+	}
+}
+`,
+			out: "<input>:1:4: unexpected number\n<input>:2:4: unexpected number\n"},
+		{name: "type", spec: `/[a-z]+/ %type WORD s
+/[0-9]+/ %priority 1 %type NUM n atoi { nums++ }
+/\+/     %type '+'
+/[ \n]+/ { }
+//
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	WORD = iota + 1
+	NUM
+)
+
+type yySymType struct {
+	s string
+	n int
+}
+
+var nums int
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func main() {
+	lx := NewLexer(strings.NewReader("ab 12+cd 3"))
+	var lval yySymType
+	for kind := lx.Lex(&lval); kind != 0; kind = lx.Lex(&lval) {
+		fmt.Println(kind, lval.s, lval.n)
+	}
+	fmt.Println(nums)
+}
+`,
+			out: "1 ab 0\n2 ab 12\n43 ab 12\n1 cd 12\n2 cd 3\n2\n"},
+		// Test that -dump writes a program printing the matches of the rules in its
+		// input, nested ones included, as JSON lines.
+		{name: "dump", args: []string{"-dump"}, spec: `%invalid { }
+/[a-zé]+/ { }
+/"[^"]*"/ < { }
+  /[a-z]+/ { }
+> { }
+//
+package main
+
+func main() {
+	panic("not run")
+}
+`,
+			in: "é \"ab c\"\n\xffx",
+			out: `{"kind":"[a-zé]+","text":"é","line":0,"col":0,"offset":0}
+{"kind":"\"[^\"]*\"","text":"\"ab c\"","line":0,"col":2,"offset":3}
+{"kind":"[a-z]+","text":"ab","line":0,"col":3,"offset":4}
+{"kind":"[a-z]+","text":"c","line":0,"col":6,"offset":7}
+{"kind":"%invalid","text":"�","line":1,"col":0,"offset":10}
+{"kind":"[a-zé]+","text":"x","line":1,"col":1,"offset":11}
+`},
+		// Test that -filter writes a program copying its input with the matches of
+		// the rules replaced by what their actions return.
+		{name: "filter", args: []string{"-filter"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/colou?r/ { return "hue" }
+/"[^"]*"/ < { }
+  /[a-z]+/ { return strings.ToUpper(yylex.Text()) }
+> { }
+/[0-9]+/ { n, _ := strconv.Atoi(yylex.Text()); return strconv.Itoa(2 * n) }
+/#[^\n]*/ { }
+//
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+`,
+			in:  "the colour 21, \"red é green\" # gone\nend",
+			out: "the hue 42, \"RED é GREEN\" \nend"},
+		// Test that byte order marks are skipped, and UTF-16 input read as runes.
+		{name: "bom", args: []string{"-s", "-bom", "utf16"}, spec: `/[^ ]+/ { fmt.Printf("%+q %d ", yylex.Text(), yylex.Column()) }
+/ / { }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	for _, in := range []string{
+		"\xef\xbb\xbfab c",
+		"\xff\xfea\x00b\x00 \x00=\xd8\x00\xde",
+		"\xfe\xff\x00a\x00b\x00 \xd8=\xde\x00\x00",
+		"ab \ufeffc",
+	} {
+		NN_FUN(NewLexer(strings.NewReader(in)))
+		fmt.Println()
+	}
+}
+`,
+			out: `"ab" 0 "c" 3 
+"ab" 0 "\U0001f600" 3 
+"ab" 0 "\U0001f600\ufffd" 3 
+"ab" 0 "\ufeffc" 3 
+`},
+		// Test that with -crlf, Tokens and ParallelTokens lex the line breaks
+		// "\r\n" as "\n", giving offsets into the string lexed.
+		{name: "crlftokens", args: []string{"-s", "-crlf", "-incremental", "-parallel"}, modes: []string{"-lazy=false", "-lazy"}, spec: `/[a-z]+/ { }
+/\n/ { }
+//
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+func main() {
+	for _, src := range []string{"ab\r\ncd", "a\r\r\nb\r"} {
+		toks := Tokens(src)
+		for _, t := range toks {
+			fmt.Print(t.Rule, " ", src[t.Offset:t.Offset+t.Len], " ")
+		}
+		fmt.Println()
+		for n := 1; n < 8; n++ {
+			if got := ParallelTokens(src, "", n); !reflect.DeepEqual(got, toks) {
+				fmt.Printf("%q in %d chunks: got %v, want %v\n", src, n, got, toks)
+			}
+		}
+	}
+}
+`,
+			out: "0 ab 1 \r\n 0 cd \n0 a -1 \r 1 \r\n 0 b -1 \r \n"},
+		// Test that -crlf reads the line breaks "\r\n" as "\n", from readers and
+		// strings alike.
+		{name: "crlf", args: []string{"-s", "-crlf"}, spec: `/[a-z]+\n/ { fmt.Printf("%q %d ", yylex.Text(), yylex.Line()) }
+/\r/ { fmt.Print("CR ") }
+/./ { fmt.Printf("%+q ", yylex.Text()) }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	for _, in := range []string{"ab\r\ncd\r\n", "a\rb\r", "x\r\xff", "a\r\r\nb"} {
+		NN_FUN(NewLexer(strings.NewReader(in)))
+		fmt.Println()
+		NN_FUN(NewLexerString(in))
+		fmt.Println()
+	}
+}
+`,
+			out: `"ab\n" 0 "cd\n" 1 
+"ab\n" 0 "cd\n" 1 
+"a" CR "b" CR 
+"a" CR "b" CR 
+"x" CR "\ufffd" 
+"x" CR "\xff" 
+"a" CR "\n" "b" 
+"a" CR "\n" "b" 
+`},
+		// Test that interactive lexers pass each token to its action without waiting
+		// for the input after it.
+		{name: "interactive", args: []string{"-s"}, modes: []string{"-lazy=false", "-lazy"}, spec: `%option interactive
+/[a-z]+;/ { fmt.Println(yylex.Text()); lexed <- true }
+//
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+var lexed = make(chan bool)
+
+// A conn sends its messages one at a time, each once the token before it
+// is lexed.
+type conn struct {
+	msgs []string
+	r    []rune
+	sent bool
+}
+
+func (c *conn) ReadRune() (rune, int, error) {
+	if len(c.r) == 0 {
+		if c.sent {
+			<-lexed
+		}
+		if len(c.msgs) == 0 {
+			return 0, 0, io.EOF
+		}
+		c.r, c.msgs, c.sent = []rune(c.msgs[0]), c.msgs[1:], true
+	}
+	r := c.r[0]
+	c.r = c.r[1:]
+	return r, 1, nil
+}
+
+func main() {
+	NN_FUN(NewLexerReader(&conn{msgs: []string{"ab;", "cd;"}}))
+}
+`,
+			out: "ab;\ncd;\n"},
+		{name: "bol", args: []string{"-s", "-split", "-incremental"}, modes: []string{"-lazy=false", "-lazy"}, spec: `%option bol
+/^#[^\n]*/ { fmt.Print("C") }
+/^\t[^\n]*/ { fmt.Print("R") }
+/#/ { fmt.Print("H") }
+/[^\n]/ { fmt.Print(".") }
+/\n/ { fmt.Print("|") }
+//
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+)
+
+func main() {
+	src := "#a\nx#b\n\tcc\n#d"
+	NN_FUN(NewLexerString(src))
+	fmt.Println()
+	s := bufio.NewScanner(strings.NewReader(src))
+	s.Split(Split())
+	for s.Scan() {
+		fmt.Printf("%q ", s.Text())
+	}
+	fmt.Println()
+	rules := func(toks []Token) {
+		for _, t := range toks {
+			fmt.Print(t.Rule)
+		}
+		fmt.Println()
+	}
+	rules(Tokens(src))
+	// Deleting x makes #b a comment.
+	toks, _, _ := Relex(Tokens(src), src[:3]+src[4:], 3, 4, 3)
+	rules(toks)
+	rnd := rand.New(rand.NewSource(1))
+	toks = Tokens(src)
+	for i := 0; i < 1000; i++ {
+		start := rnd.Intn(len(src) + 1)
+		end := start + rnd.Intn(len(src)-start+1)
+		if end-start > 3 {
+			end = start + 3
+		}
+		ins := ""
+		for k := rnd.Intn(3); k > 0; k-- {
+			ins += string("#\t\nx"[rnd.Intn(4)])
+		}
+		next := src[:start] + ins + src[end:]
+		if len(next) > 40 {
+			next = src[:start] + src[end:]
+			ins = ""
+		}
+		got, _, _ := Relex(toks, next, start, end, start+len(ins))
+		if want := Tokens(next); !reflect.DeepEqual(got, want) {
+			fmt.Printf("%q to %q: got %v, want %v\n", src, next, got, want)
+			return
+		}
+		src, toks = next, got
+	}
+	fmt.Println("ok")
+}
+`,
+			out: "C|.H.|R|C\n\"#a\" \"\\n\" \"x\" \"#\" \"b\" \"\\n\" \"\\tcc\" \"\\n\" \"#d\" \n043234140\n0404140\nok\n"},
+	} {
+		modes := x.modes
+		if modes == nil {
+			modes = []string{""}
+		}
+		for _, mode := range modes {
+			args := x.args
+			if mode != "" {
+				args = append(args[:len(args):len(args)], mode)
+			}
+			if got := runSpec(t, x.spec, x.in, args...); got != x.out {
+				t.Fatalf("%s %s: want %q, got %q", x.name, mode, x.out, got)
+			}
+		}
+	}
+}
+
+// Test that -main writes a program running the rules on the files named by
+// its arguments, or its standard input, from a spec without Go code.
+func TestMainProgram(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "numbers.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/[0-9]+/ { fmt.Println(yylex.Text()) }\n/.|\\n/ { }\n//\n"), 0666), "WriteFile")
+	input := filepath.Join(tmpdir, "input.txt")
+	dieErr(t, ioutil.WriteFile(input, []byte("a1 b22\n333"), 0666), "WriteFile")
+	got, err := exec.Command(nexBin, "-r", "-s", "-main", spec, "--", input, input).CombinedOutput()
+	dieErr(t, err, string(got))
+	if want := "1\n22\n333\n1\n22\n333\n"; string(got) != want {
+		t.Fatalf("want %q, got %q", want, string(got))
+	}
+	cmd := exec.Command(nexBin, "-r", "-s", "-main", spec)
+	cmd.Stdin = strings.NewReader("x 4")
+	got, err = cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	if want := "4\n"; string(got) != want {
+		t.Fatalf("standard input: want %q, got %q", want, string(got))
+	}
+}
+
+// Test that a spec read from standard input, whether named by "-" or not, is
+// written to the file named by -o or else to standard output, and run by -r.
+func TestStdinSpec(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := `/[a-z]+/ { n++ }
+/./ { }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	n := 0
+	NN_FUN(NewLexer(strings.NewReader("ab cd, ef")))
+	fmt.Println(n)
+}
+`
+	out := filepath.Join(tmpdir, "lexer.nn.go")
+	cmd := exec.Command(nexBin, "-s", "-o", out, "-")
+	cmd.Stdin = strings.NewReader(spec)
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	if len(got) != 0 {
+		t.Fatalf("want nothing printed, got %q", got)
+	}
+	src, err := ioutil.ReadFile(out)
+	dieErr(t, err, "ReadFile")
+	if !strings.Contains(string(src), "func main()") {
+		t.Fatalf("%s: want the program, got:\n%s", out, src)
+	}
+	for _, args := range [][]string{{"-r", "-s", "-"}, {"-r", "-s"}} {
+		cmd = exec.Command(nexBin, args...)
+		cmd.Stdin = strings.NewReader(spec)
+		got, err = cmd.CombinedOutput()
+		dieErr(t, err, string(got))
+		if want := "3\n"; string(got) != want {
+			t.Fatalf("%v: want %q, got %q", args, want, got)
+		}
+	}
+	cmd = exec.Command(nexBin, "-s")
+	cmd.Stdin = strings.NewReader(spec)
+	got, err = cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	if !strings.Contains(string(got), "func main()") {
+		t.Fatalf("no arguments: want the program, got:\n%s", got)
+	}
+	cmd = exec.Command(nexBin, "-s", "-o", tmpdir, "-")
+	cmd.Stdin = strings.NewReader(spec)
+	if got, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("-o naming a directory: want an error, got %q", got)
+	}
+}
+
+// Test that a rule matching the empty string draws a warning, and with
+// -strict an error.
+func TestStrict(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	out := filepath.Join(tmpdir, "wc.nn.go")
+	got, err := exec.Command(nexBin, "-s", "-o", out, "wc.nex").CombinedOutput()
+	dieErr(t, err, string(got))
+	want := "wc.nex:2:3: warning: rule /[^ \\t\\r\\n]*/ can match the empty string\n"
+	if string(got) != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	got, err = exec.Command(nexBin, "-strict", "-s", "-o", out, "wc.nex").CombinedOutput()
+	if err == nil {
+		t.Fatalf("-strict: want an error, got %q", got)
+	}
+	if want := strings.Replace(want, "warning: ", "", 1); string(got) != want {
+		t.Fatalf("-strict: want %q, got %q", want, got)
+	}
+}
+
+// Test that nex and its subcommands exit with the status of the kind of
+// failure they meet.
+func TestExitStatus(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	good := filepath.Join(tmpdir, "good.nex")
+	bad := filepath.Join(tmpdir, "bad.nex")
+	missing := filepath.Join(tmpdir, "missing.nex")
+	dieErr(t, ioutil.WriteFile(good, []byte("/a/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	dieErr(t, ioutil.WriteFile(bad, []byte("/(a/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	for _, x := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-check", bad}, 1},
+		{[]string{"-check", missing}, 3},
+		{[]string{"-nosuchflag"}, 2},
+		{[]string{"vet", bad}, 1},
+		{[]string{"vet", missing}, 3},
+		{[]string{"fmt", missing}, 3},
+		{[]string{"test", bad}, 1},
+		{[]string{"repl", missing}, 3},
+		{[]string{"diff", good}, 2},
+		{[]string{"diff", good, bad}, 2},
+		{[]string{"diff", good, missing}, 3},
+		{[]string{"from-flex", good, bad}, 2},
+		{[]string{"from-flex", missing}, 3},
+		{[]string{"export-tmgrammar", bad}, 1},
+		{[]string{"export-tmgrammar", missing}, 3},
+	} {
+		got, err := exec.Command(nexBin, x.args...).CombinedOutput()
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != x.want {
+			t.Errorf("%v: want exit status %d, got %v: %s", x.args, x.want, err, got)
+		}
+	}
+}
+
+// Test that nex vet reports the problems of a spec as warnings, and a spec
+// that does not compile as an error.
+func TestVet(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "vet.nex")
+	for _, x := range []struct{ src, want string }{
+		{"/[a-z]+/ { }\n/if/ { }\n//\npackage main\n", ":2:1: warning: rule /if/ is shadowed by /[a-z]+/ at line 1\n"},
+		{"/(a/ { }\n//\npackage main\n", ":1:4: unmatched '('\n"},
+	} {
+		dieErr(t, ioutil.WriteFile(spec, []byte(x.src), 0666), "WriteFile")
+		got, err := exec.Command(nexBin, "vet", spec).CombinedOutput()
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+			t.Fatalf("%q: want exit status 1, got %v", x.src, err)
+		}
+		if want := spec + x.want; string(got) != want {
+			t.Fatalf("%q: want %q, got %q", x.src, want, got)
+		}
+	}
+}
+
+// Test that a config file sets the defaults of the flags of the specs below
+// it, which the command line overrides.
+func TestConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	write := func(name, src string) string {
+		name = filepath.Join(tmpdir, name)
+		dieErr(t, os.MkdirAll(filepath.Dir(name), 0777), "MkdirAll")
+		dieErr(t, ioutil.WriteFile(name, []byte(src), 0666), "WriteFile")
+		return name
+	}
+	write("nex.toml", "# Shared options.\nprefix = \"tok\"\noutput-dir = \"gen\"  # beside this file\nwarnings-as-errors = true\n")
+	good := write(filepath.Join("a", "good.nex"), "/a/ { return 1 }\n//\npackage lexer\n")
+	empty := write(filepath.Join("a", "empty.nex"), "/a*/ { return 1 }\n//\npackage lexer\n")
+	out := filepath.Join(tmpdir, "gen", "good.nn.go")
+	got, err := exec.Command(nexBin, good).CombinedOutput()
+	dieErr(t, err, string(got))
+	b, err := ioutil.ReadFile(out)
+	dieErr(t, err, "ReadFile")
+	if !strings.Contains(string(b), "tokSymType") {
+		t.Fatalf("want the prefix tok in:\n%s", b)
+	}
+	// The command line takes precedence.
+	got, err = exec.Command(nexBin, "-p", "zz", good).CombinedOutput()
+	dieErr(t, err, string(got))
+	b, err = ioutil.ReadFile(out)
+	dieErr(t, err, "ReadFile")
+	if !strings.Contains(string(b), "zzSymType") {
+		t.Fatalf("-p zz: want the prefix zz in:\n%s", b)
+	}
+	// Warnings are errors, and their spec has no output.
+	got, err = exec.Command(nexBin, empty).CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+		t.Fatalf("warnings-as-errors: want exit status 1, got %v: %s", err, got)
+	}
+	if want := empty + ":1:1: rule /a*/ can match the empty string\n"; string(got) != want {
+		t.Fatalf("warnings-as-errors: want %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "gen", "empty.nn.go")); !os.IsNotExist(err) {
+		t.Fatalf("warnings-as-errors: want no output, got %v", err)
+	}
+	// A later spec with a config file of its own is warned of.
+	other := write(filepath.Join("b", "other.nex"), "/b/ { return 1 }\n//\npackage lexer\n")
+	otherConfig := write(filepath.Join("b", ".nexrc"), "prefix = \"b\"\n")
+	got, err = exec.Command(nexBin, good, other).CombinedOutput()
+	dieErr(t, err, string(got))
+	if want := other + ": warning: config file " + otherConfig + " ignored, as the options of all the specs come from " + filepath.Join(tmpdir, "nex.toml") + "\n"; string(got) != want {
+		t.Fatalf("two configs: want %q, got %q", want, got)
+	}
+	// Errors in the config file are usage errors.
+	write("nex.toml", "prefix = \"tok\"\ncolour = true\n")
+	got, err = exec.Command(nexBin, good).CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 2 {
+		t.Fatalf("unknown key: want exit status 2, got %v: %s", err, got)
+	}
+	if want := filepath.Join(tmpdir, "nex.toml") + ":2:1: unknown key \"colour\"\n"; string(got) != want {
+		t.Fatalf("unknown key: want %q, got %q", want, got)
+	}
+}
+
+// Test that -gen leaves alone the outputs of unchanged specs.
+func TestGen(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	out := filepath.Join(tmpdir, "lexer.nn.go")
+	gen := func(src string) string {
+		dieErr(t, ioutil.WriteFile(spec, []byte(src), 0666), "WriteFile")
+		got, err := exec.Command(nexBin, "-gen", spec).CombinedOutput()
+		dieErr(t, err, string(got))
+		if len(got) != 0 {
+			t.Fatalf("want nothing printed, got %q", got)
+		}
+		b, err := ioutil.ReadFile(out)
+		dieErr(t, err, "ReadFile")
+		return string(b)
+	}
+	src := "/a/ { return 1 }\n//\npackage lexer\n"
+	if got := gen(src); !strings.Contains(got, "// nex -gen sha256:") {
+		t.Fatalf("want a stamp, got:\n%s", got)
+	}
+	// An output left alone keeps this edit.
+	f, err := os.OpenFile(out, os.O_APPEND|os.O_WRONLY, 0)
+	dieErr(t, err, "OpenFile")
+	_, err = f.WriteString("// edited\n")
+	dieErr(t, err, "WriteString")
+	dieErr(t, f.Close(), "Close")
+	if got := gen(src); !strings.HasSuffix(got, "// edited\n") {
+		t.Fatalf("unchanged spec: want the output left alone")
+	}
+	if got := gen(src + "// changed\n"); strings.HasSuffix(got, "// edited\n") {
+		t.Fatalf("changed spec: want the output generated again")
+	}
+}
+
+// Test that -outdir mirrors the paths of the inputs.
+func TestOutdir(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	for _, dir := range []string{"a", filepath.Join("b", "c")} {
+		dieErr(t, os.MkdirAll(filepath.Join(tmpdir, dir), 0777), "MkdirAll")
+		dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, dir, "lexer.nex"), []byte("/a/ { return 1 }\n//\npackage lexer\n"), 0666), "WriteFile")
+	}
+	cmd := exec.Command(nexBin, "-outdir", "gen", filepath.Join("a", "lexer.nex"), filepath.Join("b", "c", "lexer.nex"))
+	cmd.Dir = tmpdir
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	for _, dir := range []string{"a", filepath.Join("b", "c")} {
+		_, err := os.Stat(filepath.Join(tmpdir, "gen", dir, "lexer.nn.go"))
+		dieErr(t, err, "Stat")
+	}
+	cmd = exec.Command(nexBin, "-outdir", "gen", filepath.Join("..", "a", "lexer.nex"))
+	cmd.Dir = filepath.Join(tmpdir, "b")
+	if got, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("input outside the current directory: want an error, got %q", got)
+	}
+}
+
+// Test that Go files nex did not generate are only overwritten with -f.
+func TestOverwrite(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	out := filepath.Join(tmpdir, "lexer.nn.go")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/a/ { return 1 }\n//\npackage lexer\n"), 0666), "WriteFile")
+	hand := "package lexer\n\n// Written by hand.\n"
+	dieErr(t, ioutil.WriteFile(out, []byte(hand), 0666), "WriteFile")
+	if got, err := exec.Command(nexBin, spec).CombinedOutput(); err == nil {
+		t.Fatalf("want an error, got %q", got)
+	}
+	got, err := ioutil.ReadFile(out)
+	dieErr(t, err, "ReadFile")
+	if string(got) != hand {
+		t.Fatalf("want the file left alone, got:\n%s", got)
+	}
+	// Outputs of nex, and any file with -f, are overwritten.
+	for _, args := range [][]string{{"-f", spec}, {spec}} {
+		out, err := exec.Command(nexBin, args...).CombinedOutput()
+		dieErr(t, err, string(out))
+	}
+}
+
+// Test that separate lexers can run in concurrent goroutines, under the race
+// detector, whether their tables are built by nex or as they run.
+func TestConcurrentLexers(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "race.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte(`/[a-z]+/ < { }
+  /[aeiou]/ { return 2 }
+> { return 1 }
+/"/ { yylex.PushFamily(STR); return 3 }
+/[0-9]+|./ { return 4 }
+%family STR <
+  /"/ { yylex.PopFamily(); return 3 }
+  /[^"]+/ { return 5 }
+>
+//
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+type yySymType struct{}
+
+const text = "abc \"x y\" 12 hello \"\" zz 7"
+
+// lex returns the tokens of text, as Lex, Split and Tokens see them.
+func lex() string {
+	var b strings.Builder
+	lx := NewLexerString(text)
+	for k := lx.Lex(nil); k != 0; k = lx.Lex(nil) {
+		fmt.Fprint(&b, k)
+	}
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Split(Split())
+	for sc.Scan() {
+		b.WriteString(" " + sc.Text())
+	}
+	fmt.Fprint(&b, " ", len(Tokens(text)))
+	return b.String()
+}
+
+func main() {
+	res := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i] = lex()
+		}(i)
+	}
+	wg.Wait()
+	for _, s := range res[1:] {
+		if s != res[0] {
+			fmt.Println("got", s, "and", res[0])
+			os.Exit(1)
+		}
+	}
+	fmt.Println(res[0])
+}
+`), 0666), "WriteFile")
+	for _, mode := range []string{"-lazy=false", "-fast", "-lazy"} {
+		out := filepath.Join(tmpdir, "race.go")
+		got, err := exec.Command(nexBin, "-split", "-incremental", mode, "-o", out, spec).CombinedOutput()
+		dieErr(t, err, string(got))
+		got, err = exec.Command("go", "run", "-race", out).CombinedOutput()
+		if err != nil && strings.Contains(string(got), "-race") {
+			t.Skip("no race detector: " + string(got))
+		}
+		dieErr(t, err, string(got))
+		want := "2143534442214334144 abc   \" x   y \"   12   hello   \" \"   zz   7 18\n"
+		if string(got) != want {
+			t.Fatalf("%s: want %q, got %q", mode, want, string(got))
+		}
+	}
+}
+
+// To save time, we combine several test cases into a single nex program.
+func TestGiantProgram(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	wd, err := os.Getwd()
+	dieErr(t, err, "Getwd")
+	dieErr(t, os.Chdir(tmpdir), "Chdir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	defer func() {
+		dieErr(t, os.Chdir(wd), "Chdir")
+	}()
+	s := "package main\n"
+	body := ""
+	for i, x := range []struct {
+		prog, in, out string
+	}{
+		// Test parentheses and $.
+		{`
+/[a-z]*/ <  { *lval += "[" }
+  /a(($*|$$)($($)$$$))$($$$)*/ { *lval += "0" }
+  /(e$|f$)/ { *lval += "1" }
+  /(qux)*/  { *lval += "2" }
+  /$/       { *lval += "." }
+>           { *lval += "]" }
+`, "a b c d e f g aaab aaaa eeeg fffe quxqux quxq quxe",
+			"[0][.][.][.][1][1][.][.][0][.][1][2][2.][21]"},
+		// Exercise ^ and rule precedence.
+		{`
+/[a-z]*/ <  { *lval += "[" }
+  /((^*|^^)(^(^)^^^))^(^^^)*bar/ { *lval += "0" }
+  /(^foo)*/ { *lval += "1" }
+  /^fooo$/  { *lval += "2" }
+  /^f(oo)*/ { *lval += "3" }
+  /^foo*/   { *lval += "4" }
+  /^/       { *lval += "." }
+>           { *lval += "]" }
+`, "foo bar foooo fooo fooooo fooof baz foofoo",
+			"[1][0][3][2][4][4][.][1]"},
+		// Anchored empty matches.
+		{`
+/^/ { *lval += "BEGIN" }
+/$/ { *lval += "END" }
+`, "", "BEGIN"},
+
+		{`
+/$/ { *lval += "END" }
+/^/ { *lval += "BEGIN" }
+`, "", "END"},
+
+		{`
+/^$/ { *lval += "BOTH" }
+/^/ { *lval += "BEGIN" }
+/$/ { *lval += "END" }
+`, "", "BOTH"},
+		// Built-in Line and Column counters.
+		// Ugly hack to import fmt.
+		{`"fmt"
+/\*/    { *lval += yySymType(fmt.Sprintf("[%d,%d]", yylex.Line(), yylex.Column())) }
+`,
+			`..*.
+**
+...
+...*.*
+*
+`, "[0,2][1,0][1,1][3,3][3,5][4,0]"},
+		// Patterns like awk's BEGIN and END.
+		{`
+<          { *lval += "[" }
+  /[0-9]*/ { *lval += "N" }
+  /;/      { *lval += ";" }
+  /./      { *lval += "." }
+>          { *lval += "]\n" }
+`, "abc 123 xyz;a1b2c3;42", "[....N....;.N.N.N;N]\n"},
+		// A partial match regex has no effect on an immediately following match.
+		{`
+/abcd/ { *lval += "ABCD" }
+/\n/   { *lval += "\n" }
+`, "abcd\nbabcd\naabcd\nabcabcd\n", "ABCD\nABCD\nABCD\nABCD\n"},
+
+		// Nested regex test. The simplistic parser means we must use commented
+		// braces to balance out quoted braces.
+		// Sprinkle in a couple of return statements to check Lex() saves stack
+		// state correctly between calls.
+		{`
+/a[bcd]*e/ < { *lval += "[" }
+  /a/        { *lval += "A" }
+  /bcd/ <    { *lval += "(" }
+  /c/        { *lval += "X"; return 1 }
+  >          { *lval += ")" }
+  /e/        { *lval += "E" }
+  /ccc/ <    {
+    *lval += "{"
+    // }  [balance out the quoted left brace]
+  }
+  /./        { *lval += "?" }
+  >          {
+    // {  [balance out the quoted right brace]
+    *lval += "}"
+    return 2
+  }
+>            { *lval += "]" }
+/\n/ { *lval += "\n" }
+/./ { *lval += "." }
+`, "abcdeabcabcdabcdddcccbbbcde", "[A(X)E].......[A(X){???}(X)E]"},
+
+		// Exercise hyphens in character classes.
+		{`
+/[a-z-]*/ < { *lval += "[" }
+  /[^-a-df-m]/ { *lval += "0" }
+  /./       { *lval += "1" }
+>           { *lval += "]" }
+/\n/ { *lval += "\n" }
+/./ { *lval += "." }
+`, "-azb-ycx@d--w-e-", "[11011010].[1110101]"},
+
+		// Overlapping character classes.
+		{`
+/[a-e]+[d-h]+/ { *lval += "0" }
+/[m-n]+[k-p]+[^k-r]+[o-p]+/ { *lval += "1" }
+/./ { *(*string)(lval) += yylex.Text() }
+`, "abcdefghijmnopabcoq", "0ij1q"},
+	} {
+		id := fmt.Sprintf("%v", i)
+		s += `import "./nex_test` + id + "\"\n"
+		dieErr(t, os.Mkdir("nex_test"+id, 0777), "Mkdir")
+		// Ugly hack to import packages.
+		prog := x.prog
+		importLine := ""
+		if prog[0] != '\n' {
+			v := strings.SplitN(prog, "\n", 2)
+			prog = v[1]
+			importLine = "import " + v[0]
+		}
+		dieErr(t, ioutil.WriteFile(id+".nex", []byte(prog+`//
+package nex_test`+id+`
+
+`+importLine+`
+
+type yySymType string
+
+func Go() {
+  x := NewLexer(bufio.NewReader(strings.NewReader(`+"`"+x.in+"`"+`)))
+  lval := new(yySymType)
+  for x.Lex(lval) != 0 { }
+  s := string(*lval)
+  if s != `+"`"+x.out+"`"+`{
+    panic(`+"`"+x.prog+": want "+x.out+", got ` + s"+`)
+  }
+}
+`), 0777), "WriteFile")
+		_, cerr := exec.Command(nexBin, "-o", filepath.Join("nex_test"+id, "tmp.go"), id+".nex").CombinedOutput()
+		dieErr(t, cerr, "nex: "+s)
+		body += "nex_test" + id + ".Go()\n"
+	}
+	s += "func main() {\n" + body + "}\n"
+	err = ioutil.WriteFile("tmp.go", []byte(s), 0777)
+	dieErr(t, err, "WriteFile")
+	output, err := exec.Command("go", "run", "tmp.go").CombinedOutput()
+	dieErr(t, err, string(output))
+}
+
+func copy(dst, src string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(d, s); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func copyToDir(dst, src string) error {
+	return copy(filepath.Join(dst, filepath.Base(src)), src)
+}
+
+// harnessSpec is a spec whose lexer the harnesses nex generates test.
+const harnessSpec = `/[a-z]+/ { return 1 }
+/[0-9]+/ { return 2 }
+/[ \n]/ { }
+//
+package lexer
+
+type yySymType struct{}
+`
+
+// genHarness writes harnessSpec to a new directory, with an input under
+// testdata and the tokens the lexer finds in it, and runs nex on it with the
+// flags args. It returns the directory.
+func genHarness(t *testing.T, args ...string) string {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte(harnessSpec), 0666), "WriteFile")
+	dieErr(t, os.Mkdir(filepath.Join(tmpdir, "testdata"), 0777), "Mkdir")
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "testdata", "words.input"), []byte("ab 42\ncd\n"), 0666), "WriteFile")
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "testdata", "words.tokens"), []byte("1 \"ab\"\n2 \"42\"\n1 \"cd\"\n"), 0666), "WriteFile")
+	got, err := exec.Command(nexBin, append(args, spec)...).CombinedOutput()
+	dieErr(t, err, string(got))
+	return tmpdir
+}
+
+// goTest runs go test with the flags args on the Go files of dir, and
+// returns what it prints.
+func goTest(dir string, args ...string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("go", append(append([]string{"test"}, args...), files...)...)
+	cmd.Dir = dir
+	got, err := cmd.CombinedOutput()
+	return string(got), err
+}
+
+// Test that the harness of -gentest passes when the tokens of the inputs
+// match their golden files, and fails when they do not.
+func TestGenTest(t *testing.T) {
+	dir := genHarness(t, "-gentest")
+	defer func() {
+		dieErr(t, os.RemoveAll(dir), "RemoveAll")
+	}()
+	got, err := goTest(dir, "-v", "-run", "TestLexerGolden")
+	dieErr(t, err, got)
+	if !strings.Contains(got, "--- PASS: TestLexerGolden/words") {
+		t.Fatalf("want words to pass, got:\n%s", got)
+	}
+	golden := filepath.Join(dir, "testdata", "words.tokens")
+	dieErr(t, ioutil.WriteFile(golden, []byte("1 \"ab\"\n1 \"42\"\n1 \"cd\"\n"), 0666), "WriteFile")
+	got, err = goTest(dir, "-run", "TestLexerGolden")
+	if err == nil {
+		t.Fatalf("wrong golden file: want a failure, got:\n%s", got)
+	}
+	if want := filepath.Join("testdata", "words.tokens") + ":2: got 2 \"42\", want 1 \"42\""; !strings.Contains(got, want) {
+		t.Fatalf("wrong golden file: want %q in:\n%s", want, got)
+	}
+}
+
+// Test that the harness of -genfuzz runs its seeds, and fuzzes the lexer.
+func TestGenFuzz(t *testing.T) {
+	dir := genHarness(t, "-genfuzz")
+	defer func() {
+		dieErr(t, os.RemoveAll(dir), "RemoveAll")
+	}()
+	got, err := goTest(dir, "-v", "-run", "FuzzLexer")
+	dieErr(t, err, got)
+	if !strings.Contains(got, "--- PASS: FuzzLexer") {
+		t.Fatalf("want FuzzLexer to pass, got:\n%s", got)
+	}
+	got, err = goTest(dir, "-run", "XXX", "-fuzz", "FuzzLexer", "-fuzztime", "200x")
+	dieErr(t, err, got)
+}
+
+// Test that the benchmarks of -genbench lex the inputs under testdata, and
+// report the rate of tokens.
+func TestGenBench(t *testing.T) {
+	dir := genHarness(t, "-genbench")
+	defer func() {
+		dieErr(t, os.RemoveAll(dir), "RemoveAll")
+	}()
+	got, err := goTest(dir, "-run", "XXX", "-bench", "BenchmarkLexer", "-benchtime", "10x")
+	dieErr(t, err, got)
+	if !strings.Contains(got, "BenchmarkLexer/words") || !strings.Contains(got, "MB/s") || !strings.Contains(got, "tokens/s") {
+		t.Fatalf("want a benchmark of words in MB/s and tokens/s, got:\n%s", got)
+	}
+}
+
+// Test that the generated code has no init function and no exported
+// package-level variables, and that no variable is initialized with the
+// tables of the DFAs, which are built when first used.
+func TestNoTableGlobals(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/[a-z]+/ < { }\n  /[aeiou]/ { }\n> { }\n/\"/ { }\n//\npackage lexer\n"), 0666), "WriteFile")
+	out := filepath.Join(tmpdir, "lexer.nn.go")
+	for _, args := range [][]string{{}, {"-s"}, {"-s", "-semantic"}, {"-participle"}, {"-fast"}, {"-lazy"}, {"-pool"}} {
+		got, err := exec.Command(nexBin, append(args, "-o", out, spec)...).CombinedOutput()
+		dieErr(t, err, string(got))
+		f, err := parser.ParseFile(token.NewFileSet(), out, nil, 0)
+		dieErr(t, err, "ParseFile")
+		for _, d := range f.Decls {
+			switch d := d.(type) {
+			case *ast.FuncDecl:
+				if d.Name.Name == "init" {
+					t.Errorf("%v: init function", args)
+				}
+			case *ast.GenDecl:
+				if d.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range d.Specs {
+					v := spec.(*ast.ValueSpec)
+					for _, name := range v.Names {
+						if name.IsExported() {
+							t.Errorf("%v: exported variable %s", args, name.Name)
+						}
+					}
+					for _, x := range v.Values {
+						ast.Inspect(x, func(n ast.Node) bool {
+							if _, ok := n.(*ast.CompositeLit); ok {
+								t.Errorf("%v: variable %s holds tables", args, v.Names[0].Name)
+							}
+							return true
+						})
+					}
+				}
+			}
+		}
+	}
+}
+
+// Test that -shard splits the tables into files of at most the given number
+// of rows, which build with the lexer into the same program.
+func TestShard(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	dieErr(t, copyToDir(tmpdir, "toy.nex"), "copy toy.nex")
+	cmd := exec.Command(nexBin, "-s", "-shard", "5", "toy.nex")
+	cmd.Dir = tmpdir
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	shards, err := filepath.Glob(filepath.Join(tmpdir, "toy.nn_tables_*.go"))
+	dieErr(t, err, "Glob")
+	if len(shards) < 2 {
+		t.Fatalf("want several table files, got %v", shards)
+	}
+	for _, name := range shards {
+		b, err := ioutil.ReadFile(name)
+		dieErr(t, err, "ReadFile")
+		if rows := strings.Count(string(b), "\n\t\t{"); rows == 0 || rows > 5 {
+			t.Fatalf("%s: want 1 to 5 rows, got %d", name, rows)
+		}
+	}
+	cmd = exec.Command("go", append([]string{"run", filepath.Join(tmpdir, "toy.nn.go")}, shards...)...)
+	cmd.Dir = tmpdir
+	cmd.Stdin = strings.NewReader("if 6 * 9 then x")
+	got, err = cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	if want := "A keyword: if\nAn integer: 6\nAn operator: *\nAn integer: 9\nA keyword: then\nAn identifier: x\n"; string(got) != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+// Test that -nfamermaid and -dfamermaid draw each rule as a composite state
+// of a Mermaid state diagram, escaping the characters Mermaid treats
+// specially.
+func TestMermaid(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/ab?/ { }\n/:/ { }\n//\npackage lexer\n"), 0666), "WriteFile")
+	nfa := filepath.Join(tmpdir, "nfa.mmd")
+	dfa := filepath.Join(tmpdir, "dfa.mmd")
+	got, err := exec.Command(nexBin, "-nfamermaid", nfa, "-dfamermaid", dfa, "-o", filepath.Join(tmpdir, "lexer.nn.go"), spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	for name, want := range map[string]string{
+		nfa: `stateDiagram-v2
+  state NFA_1 {
+    [*] --> NFA_1_0
+    NFA_1_0 --> NFA_1_1 : a
+    NFA_1_1 --> NFA_1_2 : ε
+    NFA_1_1 --> NFA_1_2 : b
+    NFA_1_2 --> [*]
+  }
+  state NFA_2 {
+    [*] --> NFA_2_0
+    NFA_2_0 --> NFA_2_1 : #58;
+    NFA_2_1 --> [*]
+  }
+`,
+		dfa: `stateDiagram-v2
+  state DFA_1 {
+    [*] --> DFA_1_0
+    DFA_1_0 --> DFA_1_1 : a
+    DFA_1_1 --> [*]
+    DFA_1_1 --> DFA_1_2 : b
+    DFA_1_2 --> [*]
+  }
+  state DFA_2 {
+    [*] --> DFA_2_0
+    DFA_2_0 --> DFA_2_1 : #58;
+    DFA_2_1 --> [*]
+  }
+`,
+	} {
+		b, err := ioutil.ReadFile(name)
+		dieErr(t, err, "ReadFile")
+		if string(b) != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", name, b, want)
+		}
+	}
+}
+
+// Test that -version prints the version nex stamps on the files it
+// generates, and exits without reading any input.
+func TestVersion(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	got, err := exec.Command(nexBin, "-version", filepath.Join(tmpdir, "missing.nex")).CombinedOutput()
+	dieErr(t, err, string(got))
+	fields := strings.Fields(string(got))
+	if len(fields) < 3 || fields[0] != "nex" || !strings.HasPrefix(fields[2], "go") {
+		t.Fatalf("want \"nex VERSION GOVERSION\", got %q", got)
+	}
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/a/ { return 1 }\n//\npackage lexer\n"), 0666), "WriteFile")
+	got, err = exec.Command(nexBin, spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	src, err := ioutil.ReadFile(filepath.Join(tmpdir, "lexer.nn.go"))
+	dieErr(t, err, "ReadFile")
+	// The header must match the pattern of https://golang.org/s/generatedcode.
+	want := "// Code generated by nex " + fields[1] + ". DO NOT EDIT.\n"
+	if !strings.HasPrefix(string(src), want) {
+		t.Fatalf("want the header %q, got:\n%s", want, src)
+	}
+}
+
+// Test that nex expands the glob patterns among its inputs itself, and that
+// an error in one input is reported with its filename without stopping the
+// others.
+func TestMultipleInputs(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	for name, src := range map[string]string{
+		"a.nex": "/a/ { return 1 }\n//\npackage lexer\n",
+		"b.nex": "/(a/ { return 1 }\n//\npackage lexer\n",
+		"c.nex": "/c/ { return 1 }\n//\npackage lexer\n",
+	} {
+		dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, name), []byte(src), 0666), "WriteFile")
+	}
+	gen := filepath.Join(tmpdir, "gen")
+	dieErr(t, os.Mkdir(gen, 0777), "Mkdir")
+	// With no shell to expand it, the pattern reaches nex as it is.
+	got, err := exec.Command(nexBin, "-o", gen, filepath.Join(tmpdir, "*.nex")).CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+		t.Fatalf("want exit status 1, got %v: %s", err, got)
+	}
+	if want := filepath.Join(tmpdir, "b.nex") + ":1:4: unmatched '('\n"; string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	for _, name := range []string{"a.nn.go", "c.nn.go"} {
+		_, err := os.Stat(filepath.Join(gen, name))
+		dieErr(t, err, "Stat")
+	}
+	if _, err := os.Stat(filepath.Join(gen, "b.nn.go")); !os.IsNotExist(err) {
+		t.Errorf("want no output for the bad spec, got %v", err)
+	}
+	got, err = exec.Command(nexBin, "-o", gen, filepath.Join(tmpdir, "*.nexx")).CombinedOutput()
+	if err == nil || !strings.Contains(string(got), "no files match") {
+		t.Errorf("pattern matching nothing: want an error, got %v: %s", err, got)
+	}
+}
+
+// Test that -check writes nothing, and fails on specs that are invalid or
+// whose Go code does not parse.
+func TestCheck(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	for _, x := range []struct {
+		src, want string
+	}{
+		{"/a/ { return 1 }\n//\npackage lexer\n", ""},
+		{"/(a/ { return 1 }\n//\npackage lexer\n", "lexer.nex:1:4: unmatched '('\n"},
+		{"/a/ { return 1 }\n//\npackage lexer\nfunc f( {}\n", "lexer.nex: generated code:"},
+	} {
+		spec := filepath.Join(tmpdir, "lexer.nex")
+		dieErr(t, ioutil.WriteFile(spec, []byte(x.src), 0666), "WriteFile")
+		cmd := exec.Command(nexBin, "-check", "lexer.nex")
+		cmd.Dir = tmpdir
+		got, err := cmd.CombinedOutput()
+		status := 0
+		if e, ok := err.(*exec.ExitError); ok {
+			status = e.ExitCode()
+		} else {
+			dieErr(t, err, string(got))
+		}
+		if x.want == "" && (status != 0 || len(got) != 0) {
+			t.Errorf("%q: want success, got status %d: %s", x.src, status, got)
+		}
+		if x.want != "" && (status != 1 || !strings.HasPrefix(string(got), x.want)) {
+			t.Errorf("%q: want status 1 and %q, got status %d: %s", x.src, x.want, status, got)
+		}
+		files, err := filepath.Glob(filepath.Join(tmpdir, "*.go"))
+		dieErr(t, err, "Glob")
+		if len(files) != 0 {
+			t.Fatalf("%q: want nothing written, got %v", x.src, files)
+		}
+	}
+}
+
+// Test that -stats prints the automaton sizes of each rule on standard
+// error.
+func TestStats(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/ab?/ { }\n/[0-9]+/ { }\n//\npackage lexer\n"), 0666), "WriteFile")
+	got, err := exec.Command(nexBin, "-stats", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	want := `   line  NFA  DFA  alphabet regex
+      1    3    3         3 ab?
+      2    3    2         2 [0-9]+
+  total    6    5           2 rules
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Test that -json prints each warning and error as a JSON object on a line
+// of its own.
+func TestJSONDiagnostics(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "empty.nex"), []byte("/a*/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "bad.nex"), []byte("/a/ { }\n/(a/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	cmd := exec.Command(nexBin, "-json", "-check", "empty.nex", "bad.nex", "missing.nex")
+	cmd.Dir = tmpdir
+	got, err := cmd.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 3 {
+		t.Fatalf("want exit status 3, got %v: %s", err, got)
+	}
+	type diagnostic struct {
+		File     string
+		Line     int
+		Col      int
+		Severity string
+		Code     string
+		Message  string
+	}
+	want := []diagnostic{
+		{"empty.nex", 1, 1, "warning", "empty-match", "rule /a*/ can match the empty string"},
+		{"bad.nex", 2, 4, "error", "regex", "unmatched '('"},
+		{"missing.nex", 0, 0, "error", "io", "open missing.nex: no such file or directory"},
+	}
+	lines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("want %d lines, got:\n%s", len(want), got)
+	}
+	for i, line := range lines {
+		var d diagnostic
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if d != want[i] {
+			t.Errorf("got %+v, want %+v", d, want[i])
+		}
+	}
+}
+
+// Test that -watch regenerates the output whenever the spec changes, and with
+// -r reruns the program.
+func TestWatch(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	version := 0
+	write := func(src string) {
+		dieErr(t, ioutil.WriteFile(spec, []byte(src), 0666), "WriteFile")
+		// Files written in quick succession may share a modification time.
+		version++
+		mtime := time.Unix(int64(1e9+version), 0)
+		dieErr(t, os.Chtimes(spec, mtime, mtime), "Chtimes")
+	}
+	// watch starts nex with the flags args, and returns a function giving
+	// each line it prints in turn and one stopping it.
+	watch := func(args ...string) (func() string, func()) {
+		cmd := exec.Command(nexBin, append(args, "lexer.nex")...)
+		cmd.Dir = tmpdir
+		r, w := io.Pipe()
+		cmd.Stdout, cmd.Stderr = w, w
+		dieErr(t, cmd.Start(), "Start")
+		lines := make(chan string)
+		go func() {
+			in := bufio.NewScanner(r)
+			for in.Scan() {
+				lines <- in.Text()
+			}
+		}()
+		next := func() string {
+			select {
+			case line := <-lines:
+				return line
+			case <-time.After(time.Minute):
+				t.Fatal("timed out")
+			}
+			return ""
+		}
+		return next, func() {
+			cmd.Process.Kill()
+			w.Close()
+			cmd.Wait()
+		}
+	}
+	write("/a/ { return 1 }\n//\npackage lexer\n")
+	next, stop := watch("-watch")
+	defer stop()
+	for _, want := range []string{"return 1", "return 2"} {
+		if line := next(); line != "nex: regenerated from lexer.nex" {
+			t.Fatalf("want the output regenerated, got %q", line)
+		}
+		src, err := ioutil.ReadFile(filepath.Join(tmpdir, "lexer.nn.go"))
+		dieErr(t, err, "ReadFile")
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("want the output to contain %q, got:\n%s", want, src)
+		}
+		write("/a/ { return 2 }\n//\npackage lexer\n")
+	}
+	prog := `/[a-z]+/ { fmt.Println(%q) }
+//
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	NN_FUN(NewLexer(strings.NewReader("ab")))
+}
+`
+	write(fmt.Sprintf(prog, "old"))
+	next, stop = watch("-watch", "-r", "-s")
+	defer stop()
+	for _, want := range []string{"old", "new"} {
+		if line := next(); line != want {
+			t.Fatalf("want %q, got %q", want, line)
+		}
+		write(fmt.Sprintf(prog, "new"))
+	}
+}
+
+// Test that nex fmt prints the formatted spec, or its diff with -d, or
+// rewrites the file with -w.
+func TestFmt(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	src := "/a/{return 1}\n/b/   {  }\n//\npackage main\n"
+	want := "/a/ { return 1 }\n/b/ {}\n//\npackage main\n"
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte(src), 0666), "WriteFile")
+	got, err := exec.Command(nexBin, "fmt", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	cmd := exec.Command(nexBin, "fmt")
+	cmd.Stdin = strings.NewReader(src)
+	got, err = cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	if string(got) != want {
+		t.Errorf("standard input: want %q, got %q", want, got)
+	}
+	got, err = exec.Command(nexBin, "fmt", "-d", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	if !strings.Contains(string(got), "\n-/a/{return 1}\n") || !strings.Contains(string(got), "\n+/a/ { return 1 }\n") {
+		t.Errorf("-d: want a diff, got:\n%s", got)
+	}
+	got, err = exec.Command(nexBin, "fmt", "-w", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	if len(got) != 0 {
+		t.Errorf("-w: want nothing printed, got %q", got)
+	}
+	b, err := ioutil.ReadFile(spec)
+	dieErr(t, err, "ReadFile")
+	if string(b) != want {
+		t.Errorf("-w: want %q, got %q", want, b)
+	}
+	// A formatted spec has no diff.
+	got, err = exec.Command(nexBin, "fmt", "-d", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	if len(got) != 0 {
+		t.Errorf("-d of a formatted spec: want nothing printed, got %q", got)
+	}
+	dieErr(t, ioutil.WriteFile(spec, []byte("/a/ { \n"), 0666), "WriteFile")
+	got, err = exec.Command(nexBin, "fmt", "-w", spec).CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 || string(got) != spec+":1:5: unmatched '{'\n" {
+		t.Errorf("unmatched brace: want exit status 1 and an error, got %v: %q", err, got)
+	}
+	b, err = ioutil.ReadFile(spec)
+	dieErr(t, err, "ReadFile")
+	if string(b) != "/a/ { \n" {
+		t.Errorf("unmatched brace: want the file left alone, got %q", b)
+	}
+}
+
+// Test that -dfajson writes the DFAs of every rule of every spec, in a form
+// that can be run.
+func TestDFAJSON(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "a.nex"), []byte("/ab?/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "b.nex"), []byte("/\"/ < { }\n  /[^\"]+/ { }\n> { }\n//\npackage main\n"), 0666), "WriteFile")
+	cmd := exec.Command(nexBin, "-check", "-dfajson", "dfa.json", "a.nex", "b.nex")
+	cmd.Dir = tmpdir
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	b, err := ioutil.ReadFile(filepath.Join(tmpdir, "dfa.json"))
+	dieErr(t, err, "ReadFile")
+	type state struct {
+		Accept      bool
+		Transitions []struct{ Lo, Hi, Next int }
+		Default     int
+	}
+	type rule struct {
+		Line   int
+		Regex  string
+		States []state
+		Rules  []rule
+	}
+	var specs []struct {
+		File  string
+		Rules []rule
+	}
+	dieErr(t, json.Unmarshal(b, &specs), "Unmarshal")
+	if len(specs) != 2 || specs[0].File != "a.nex" || specs[1].File != "b.nex" {
+		t.Fatalf("want the dumps of a.nex and b.nex, got:\n%s", b)
+	}
+	// match runs the DFA of x on s.
+	match := func(x rule, s string) bool {
+		n := 0
+		for _, r := range s {
+			next := x.States[n].Default
+			for _, e := range x.States[n].Transitions {
+				if e.Lo <= int(r) && int(r) <= e.Hi {
+					next = e.Next
+				}
+			}
+			if next < 0 {
+				return false
+			}
+			n = next
+		}
+		return x.States[n].Accept
+	}
+	a := specs[0].Rules
+	if len(a) != 1 || a[0].Line != 1 || a[0].Regex != "ab?" {
+		t.Fatalf("a.nex: want the rule /ab?/, got %+v", a)
+	}
+	for s, want := range map[string]bool{"a": true, "ab": true, "": false, "b": false, "abb": false} {
+		if match(a[0], s) != want {
+			t.Errorf("/ab?/ on %q: want %v", s, want)
+		}
+	}
+	nested := specs[1].Rules
+	if len(nested) != 1 || len(nested[0].Rules) != 1 || nested[0].Rules[0].Line != 2 {
+		t.Fatalf("b.nex: want a rule with one nested rule, got %+v", nested)
+	}
+	for s, want := range map[string]bool{"xy": true, "\u00e9": true, "x\"": false} {
+		if match(nested[0].Rules[0], s) != want {
+			t.Errorf("/[^\"]+/ on %q: want %v", s, want)
+		}
+	}
+}
+
+// Test that nex repl lexes each line of its input with the rules of the
+// spec, showing the tokens of nested rules indented.
+func TestRepl(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/[a-z]+/ { }\n/[0-9]+;/ < { }\n  /[0-9]/ { }\n> { }\n/ / { }\n//\npackage main\n"), 0666), "WriteFile")
+	cmd := exec.Command(nexBin, "repl", spec)
+	cmd.Stdin = strings.NewReader("ab cd\n12;\n")
+	got, err := cmd.CombinedOutput()
+	dieErr(t, err, string(got))
+	want := `0-2  line 1 /[a-z]+/  "ab"
+2-3  line 5 / /       " "
+3-5  line 1 /[a-z]+/  "cd"
+5-6  no match         "\n"
+0-3    line 2 /[0-9]+;/  "12;"
+  0-1  line 3 /[0-9]/    "1"
+  1-2  line 3 /[0-9]/    "2"
+  2-3  no match          ";"
+3-4    no match          "\n"
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Test that nex test compares the tokens of each input with its golden file,
+// which -update writes.
+func TestSpecTest(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/[a-z]+/ { }\n/[0-9]+/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	dieErr(t, os.Mkdir(filepath.Join(tmpdir, "testdata"), 0777), "Mkdir")
+	dieErr(t, ioutil.WriteFile(filepath.Join(tmpdir, "testdata", "a.input"), []byte("ab 42\n"), 0666), "WriteFile")
+	golden := filepath.Join(tmpdir, "testdata", "a.want")
+	// nexTest runs nex test with the flags args, and checks its exit status
+	// and that its output contains want.
+	nexTest := func(status int, want string, args ...string) {
+		got, err := exec.Command(nexBin, append(append([]string{"test"}, args...), spec)...).CombinedOutput()
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() != status || !ok && status != 0 {
+			t.Fatalf("%v: want exit status %d, got %v: %s", args, status, err, got)
+		}
+		if !strings.Contains(string(got), want) {
+			t.Fatalf("%v: want %q in the output, got:\n%s", args, want, got)
+		}
+	}
+	nexTest(1, "run nex test -update to create it")
+	nexTest(0, "ok   "+spec+"\t1 inputs", "-update")
+	b, err := ioutil.ReadFile(golden)
+	dieErr(t, err, "ReadFile")
+	if want := "1 \"ab\"\n- \" \"\n2 \"42\"\n- \"\\n\"\n"; string(b) != want {
+		t.Fatalf("-update: want %q, got %q", want, b)
+	}
+	nexTest(0, "ok   "+spec+"\t1 inputs")
+	// A change to the rules shows in a diff of the golden file.
+	dieErr(t, ioutil.WriteFile(spec, []byte("/[a-z]+/ { }\n/[0-9]/ { }\n/[ \\n]/ { }\n//\npackage main\n"), 0666), "WriteFile")
+	nexTest(1, "-2 \"42\"\n")
+	nexTest(1, "FAIL "+spec+"\t1 of 1 inputs")
+	b, err = ioutil.ReadFile(golden)
+	dieErr(t, err, "ReadFile")
+	if !strings.Contains(string(b), "2 \"42\"") {
+		t.Fatalf("want the golden file left alone, got %q", b)
+	}
+}
+
+// Test that the harness of -gentest and nex test keep their golden files
+// apart, so both pass on the inputs they share.
+func TestGoldenFiles(t *testing.T) {
+	dir := genHarness(t, "-gentest")
+	defer func() {
+		dieErr(t, os.RemoveAll(dir), "RemoveAll")
+	}()
+	spec := filepath.Join(dir, "lexer.nex")
+	got, err := exec.Command(nexBin, "test", "-update", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	got, err = exec.Command(nexBin, "test", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	out, err := goTest(dir, "-run", "TestLexerGolden")
+	dieErr(t, err, out)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "testdata", "words.tokens"))
+	dieErr(t, err, "ReadFile")
+	if want := "1 \"ab\"\n2 \"42\"\n1 \"cd\"\n"; string(b) != want {
+		t.Errorf("nex test -update: want words.tokens left alone, got %q", b)
+	}
+}
+
+// Test that specs can declare the names of the packages the lexer uses, and
+// import those packages under other names.
+func TestPackageNames(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "names.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte(`/[a-z]+/ { fmt.Println(token(yylex.Text()), yylex.Position()) }
+/./ { }
+//
+package main
+
+import (
+	"fmt"
+	str "strings"
+)
+
+type yySymType struct{}
+
+var scanner = "scanned"
+
+func token(s string) string { return str.ToUpper(s) }
+
+func main() {
+	lx := NewLexer(str.NewReader("ab c"))
+	for lx.Lex(nil) != 0 {
+	}
+	fmt.Println(scanner)
+}
+`), 0666), "WriteFile")
+	got, err := exec.Command(nexBin, "-r", spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	want := "AB <input>:1:1\nC <input>:1:4\nscanned\n"
+	if string(got) != want {
+		t.Fatalf("want %q, got %q", want, string(got))
+	}
+}
+
+// Test that -cpuprofile and -memprofile write profiles go tool pprof reads.
+func TestProfiles(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "nex")
+	dieErr(t, err, "TempDir")
+	defer func() {
+		dieErr(t, os.RemoveAll(tmpdir), "RemoveAll")
+	}()
+	spec := filepath.Join(tmpdir, "lexer.nex")
+	dieErr(t, ioutil.WriteFile(spec, []byte("/[a-z]+/ { return 1 }\n//\npackage lexer\n"), 0666), "WriteFile")
+	cpu := filepath.Join(tmpdir, "cpu.out")
+	mem := filepath.Join(tmpdir, "mem.out")
+	got, err := exec.Command(nexBin, "-cpuprofile", cpu, "-memprofile", mem, spec).CombinedOutput()
+	dieErr(t, err, string(got))
+	_, err = os.Stat(filepath.Join(tmpdir, "lexer.nn.go"))
+	dieErr(t, err, "Stat")
+	for profile, want := range map[string]string{cpu: "Type: cpu", mem: "Type: alloc_space"} {
+		got, err := exec.Command("go", "tool", "pprof", "-top", nexBin, profile).CombinedOutput()
+		dieErr(t, err, string(got))
+		if !strings.Contains(string(got), want) {
+			t.Errorf("%s: want %q, got:\n%s", profile, want, got)
+		}
+	}
 }
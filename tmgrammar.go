@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// exportTMGrammarMain implements `nex export-tmgrammar`, which writes an
+// approximation of a spec as a TextMate grammar, for editors. It returns the
+// status of the worst failure reported.
+func exportTMGrammarMain(args []string) int {
+	fs := flag.NewFlagSet("nex export-tmgrammar", flag.ExitOnError)
+	output := fs.String("o", "", "output file")
+	name := fs.String("name", "", "name of the language (default: the base name of the spec)")
+	scope := fs.String("scope", "", "scope name of the grammar (default: source.NAME)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: nex export-tmgrammar [-o file] [-name name] [-scope scope] [spec.nex]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		usageExit("nex export-tmgrammar: extraneous arguments after ", fs.Arg(0))
+	}
+	filename, in := "<stdin>", io.Reader(os.Stdin)
+	if fs.NArg() == 1 {
+		filename = fs.Arg(0)
+		f, err := os.Open(filename)
+		if err != nil {
+			report(filename, err)
+			return exitStatus
+		}
+		defer f.Close()
+		in = f
+		if *name == "" {
+			*name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+		}
+	}
+	if *name == "" {
+		usageExit("nex export-tmgrammar: -name is needed when reading standard input")
+	}
+	if *scope == "" {
+		*scope = "source." + strings.ToLower(*name)
+	}
+	sp, err := nex.ParseSpec(in, filename)
+	if err == nil {
+		// Report bad regexes at their position in the spec.
+		_, err = nex.CompileSpec(sp, nex.Options{Filename: filename, Lazy: true})
+	}
+	if err != nil {
+		report(filename, err)
+		return exitStatus
+	}
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			report(*output, err)
+			return exitStatus
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := nex.ExportTMGrammar(out, sp, *name, *scope); err != nil {
+		report(filename, err)
+	}
+	return exitStatus
+}
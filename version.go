@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// printVersion describes this binary for the -version flag, including the VCS
+// revision it was built from when available.
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "nex %s %s\n", nex.Version(), runtime.Version())
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			fmt.Fprintf(w, "  %s=%s\n", s.Key, s.Value)
+		}
+	}
+}
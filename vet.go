@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/blynn/nex/pkg/nex"
+)
+
+// vetMain implements `nex vet`, which reports rules that are probably
+// mistakes without generating anything. It returns exitSpec if it finds any,
+// and otherwise the status of the worst failure reported.
+func vetMain(args []string) int {
+	fs := flag.NewFlagSet("nex vet", flag.ExitOnError)
+	fs.BoolVar(&jsonDiagnostics, "json", false, "print the problems as JSON objects")
+	maxStates := fs.Int("maxstates", nex.DefaultMaxStates, "report rules whose DFA has more states than this")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: nex vet [-json] [-maxstates n] spec.nex...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	specs, err := expandInputs(fs.Args())
+	dieErr(err, "nex vet")
+	for _, name := range specs {
+		f, err := os.Open(name)
+		if err != nil {
+			report(name, err)
+			continue
+		}
+		sp, err := nex.ParseSpec(f, name)
+		f.Close()
+		if err != nil {
+			report(name, err)
+			continue
+		}
+		problems, err := nex.Lint(sp, nex.Options{Filename: name, MaxStates: *maxStates})
+		if err != nil {
+			report(name, err)
+			continue
+		}
+		for _, e := range problems {
+			warn(e)
+			fail(exitSpec)
+		}
+	}
+	return exitStatus
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// watch is set by the -watch flag.
+var watch bool
+
+// watchInterval is how often -watch polls the inputs for changes.
+var watchInterval = 500 * time.Millisecond
+
+// watchInputs polls the modification times of the inputs and calls regen
+// with those that changed, starting with all of them. It never returns.
+// Polling stops while regen runs, which with -r lasts until the program
+// exits.
+func watchInputs(inputs []string, regen func(changed []string)) {
+	mtimes := make(map[string]time.Time)
+	for {
+		var changed []string
+		for _, input := range inputs {
+			fi, err := os.Stat(input)
+			if err != nil {
+				// The file may be in the middle of being replaced.
+				continue
+			}
+			if !fi.ModTime().Equal(mtimes[input]) {
+				mtimes[input] = fi.ModTime()
+				changed = append(changed, input)
+			}
+		}
+		if len(changed) > 0 {
+			regen(changed)
+		}
+		time.Sleep(watchInterval)
+	}
+}